@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	filepath "path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"gopkg.in/yaml.v2"
+)
+
+// albumsPrefix Where album pages and indexes are uploaded, albums only reference the originals
+const albumsPrefix = "albums/"
+
+// Where an album came from, manifest albums are rebuilt every run while other albums only grow
+const (
+	AlbumManifest = "manifest"
+	AlbumFolder   = "folder" // named after a subfolder of the input directory
+	AlbumEvents   = "events" // found by the events command
+)
+
+// AlbumDefinition An album in the album manifest
+type AlbumDefinition struct {
+	Name  string   `yaml:"name" toml:"name"`
+	Dates []string `yaml:"dates" toml:"dates"` // years, dates or date ranges like 2016-05-13:2016-05-20
+	Files []string `yaml:"files" toml:"files"` // keys in the bucket, eg. 2016/2016-05-13/IMG_0001.jpg
+	Cover string   `yaml:"cover" toml:"cover"` // key of the photo to use as cover
+}
+
+// albumManifest Contents of the album manifest file
+type albumManifest struct {
+	Albums []AlbumDefinition `yaml:"albums" toml:"albums"`
+}
+
+// Album Contents of albums/<id>/album.json
+type Album struct {
+	ID     string            `json:"id"`
+	Name   string            `json:"name"`
+	Source string            `json:"source"`
+	Files  []string          `json:"files"`           // keys of the originals, sorted by date
+	Cover  string            `json:"cover,omitempty"` // key of a pinned cover
+	URLs   map[string]string `json:"urls,omitempty"`
+	Thumbs map[string]string `json:"thumbs"` // of the files that have one, relative to the page unless presigned
+}
+
+// albumSummary An entry in albums/albums.json, listed on the main page
+type albumSummary struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Source string `json:"source"`
+	Count  int    `json:"count"`
+	Cover  string `json:"cover,omitempty"` // thumbnail relative to the root of the bucket
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+}
+
+var albumIDRegExp = regexp.MustCompile(`[^a-z0-9]+`)
+
+// AlbumID Turns an album name into the folder name used in the bucket, eg. Japan trip 2016 becomes japan-trip-2016
+func AlbumID(name string) string {
+	return strings.Trim(albumIDRegExp.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+// LoadAlbumManifest Reads the album manifest, a YAML or TOML file depending on the extension
+func LoadAlbumManifest(fileName string) ([]AlbumDefinition, error) {
+	if len(fileName) == 0 {
+		return nil, nil
+	}
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var manifest albumManifest
+	if strings.ToLower(filepath.Ext(fileName)) == ".toml" {
+		err = toml.Unmarshal(data, &manifest)
+	} else {
+		err = yaml.Unmarshal(data, &manifest)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing album manifest %s: %v", fileName, err)
+	}
+	for _, album := range manifest.Albums {
+		if len(AlbumID(album.Name)) == 0 {
+			return nil, fmt.Errorf("albums in %s need a name", fileName)
+		}
+	}
+	return manifest.Albums, nil
+}
+
+// folderAlbums Groups the files found in the input directory by the subfolder they are in, keyed by the name
+// of the folder directly in the input directory. Files in the input directory itself aren't in an album.
+func folderAlbums(inDirName string, fileMap map[string][]string) map[string][]string {
+	albums := make(map[string][]string)
+	for dateKey, files := range fileMap {
+		date, err := time.Parse("2006-01-02", dateKey)
+		if err != nil {
+			continue
+		}
+		for _, fileName := range files {
+			rel, err := filepath.Rel(inDirName, fileName)
+			if err != nil {
+				continue
+			}
+			parts := strings.Split(filepath.ToSlash(rel), "/")
+			if len(parts) > 1 && !isLiveMovie(fileName) && isPublished(fileName, date, filterInfo(fileName)) {
+				albums[parts[0]] = append(albums[parts[0]], objectKey(fileName, date))
+			}
+		}
+	}
+	return albums
+}
+
+// resolveAlbum Lists the originals in the bucket matching a manifest album
+func resolveAlbum(svc s3iface.S3API, bucketName string, definition AlbumDefinition) ([]string, error) {
+	var keys []string
+	for _, target := range definition.Dates {
+		dates, err := parseDateRange(target)
+		if err != nil {
+			return nil, fmt.Errorf("album %s: %v", definition.Name, err)
+		}
+		objects := GetObjectsFromBucket(svc, bucketName, dates.prefix)
+		legacy := legacyThumbs(objects, knownOriginals(svc, bucketName, objects))
+		for _, obj := range objects {
+			matches := dayKeyRegExp.FindStringSubmatch(*obj.Key)
+			if _, ok := legacy[*obj.Key]; matches == nil || ok || IsGenerated(*obj.Key) || IsCompanion(*obj.Key) {
+				continue
+			}
+			if date, err := time.Parse("2006-01-02", matches[1]); err == nil && dates.Contains(date) {
+				keys = append(keys, *obj.Key)
+			}
+		}
+	}
+	for _, key := range definition.Files {
+		keys = append(keys, strings.TrimPrefix(key, "/"))
+	}
+	return keys, nil
+}
+
+// readAlbum Reads an album's album.json, nil if it doesn't exist
+func readAlbum(svc s3iface.S3API, bucketName, id string) *Album {
+	reader := GetFromS3(svc, albumsPrefix+id+"/album.json", bucketName)
+	if reader == nil {
+		return nil
+	}
+	var album Album
+	if err := json.NewDecoder(reader).Decode(&album); err != nil {
+		return nil
+	}
+	return &album
+}
+
+// readAlbums Reads the list of albums from albums/albums.json
+func readAlbums(svc s3iface.S3API, bucketName string) []albumSummary {
+	var albumStruct map[string][]albumSummary
+	reader := GetFromS3(svc, albumsPrefix+"albums.json", bucketName)
+	if reader == nil {
+		return nil
+	}
+	json.NewDecoder(reader).Decode(&albumStruct)
+	return albumStruct["albums"]
+}
+
+// uniqueKeys Sorts keys by date and name, dropping duplicates
+func uniqueKeys(keys []string) []string {
+	sort.Strings(keys)
+	var unique []string
+	for _, key := range keys {
+		if len(unique) == 0 || unique[len(unique)-1] != key {
+			unique = append(unique, key)
+		}
+	}
+	return unique
+}
+
+// writeAlbum Uploads an album's album.json and page, returning its entry for albums.json
+func writeAlbum(svc s3iface.S3API, bucketName string, album Album) albumSummary {
+	album.Files = uniqueKeys(album.Files)
+	album.URLs = nil
+	album.Thumbs = make(map[string]string)
+	thumbs := existingThumbs(svc, bucketName, album.Files)
+	for _, key := range album.Files {
+		if cfg.Access == AccessPresigned {
+			if album.URLs == nil {
+				album.URLs = make(map[string]string)
+			}
+			album.URLs[key] = PresignURL(svc, key, bucketName, cfg.Expiry())
+		}
+		if thumbs[thumbKey(key)] {
+			album.Thumbs[key] = "../../" + thumbKey(key)
+			if cfg.Access == AccessPresigned {
+				album.Thumbs[key] = PresignURL(svc, thumbKey(key), bucketName, cfg.Expiry())
+			}
+		}
+	}
+	albumJSON, _ := json.Marshal(album)
+	UploadToS3(svc, albumsPrefix+album.ID+"/album.json", bucketName, albumJSON, int64(len(albumJSON)), true)
+
+	// Links are relative to albums/<id>/ unless presigned
+	link := func(key string) string {
+		if url, ok := album.URLs[key]; ok {
+			return url
+		}
+		return "../../" + key
+	}
+	summary := albumSummary{ID: album.ID, Name: album.Name, Source: album.Source, Count: len(album.Files), Cover: assetsPrefix + "folder.svg"}
+	data := pageData{Page: "album", Title: album.Name, Back: "../../index.html", Assets: "../../" + assetsPrefix}
+	var candidates []coverCandidate
+	for _, key := range album.Files {
+		data.Items = append(data.Items, pageItem{Name: path.Base(key), URL: link(key), Thumb: album.Thumbs[key], Movie: IsMovie(key)})
+		if thumbs[thumbKey(key)] {
+			candidates = append(candidates, coverCandidate{Name: key, Thumb: thumbKey(key)})
+		}
+		if matches := dayKeyRegExp.FindStringSubmatch(key); matches != nil {
+			if len(summary.From) == 0 || matches[1] < summary.From {
+				summary.From = matches[1]
+			}
+			if matches[1] > summary.To {
+				summary.To = matches[1]
+			}
+		}
+	}
+	if cover, ok := pickCover(candidates, album.Cover); ok {
+		summary.Cover = cover.Thumb
+		if cfg.Access == AccessPresigned {
+			summary.Cover = album.Thumbs[cover.Name]
+		}
+	}
+	uploadPage(svc, bucketName, albumsPrefix+album.ID+"/index.html", data)
+	return summary
+}
+
+// manifestAlbums Lists the files of the albums in the manifest
+func manifestAlbums(svc s3iface.S3API, bucketName string, definitions []AlbumDefinition) ([]Album, error) {
+	var albums []Album
+	for _, definition := range definitions {
+		keys, err := resolveAlbum(svc, bucketName, definition)
+		if err != nil {
+			return nil, err
+		}
+		albums = append(albums, Album{ID: AlbumID(definition.Name), Name: definition.Name, Source: AlbumManifest, Files: keys, Cover: definition.Cover})
+	}
+	return albums, nil
+}
+
+// addToAlbums Adds files to albums of a source, keeping the files already in them. Albums with the same id
+// from another source are left alone.
+func addToAlbums(svc s3iface.S3API, bucketName string, added map[string][]string, source string) []Album {
+	var albums []Album
+	for name, keys := range added {
+		album := Album{ID: AlbumID(name), Name: name, Source: source, Files: keys}
+		if len(album.ID) == 0 {
+			continue
+		}
+		if existing := readAlbum(svc, bucketName, album.ID); existing != nil {
+			if existing.Source != source {
+				log.Info("Album ", name, " already exists, not adding files to it.")
+				continue
+			}
+			album.Name, album.Cover = existing.Name, existing.Cover
+			album.Files = append(existing.Files, keys...)
+		}
+		albums = append(albums, album)
+	}
+	return albums
+}
+
+// refreshAlbums Rebuilds the albums in the manifest and adds the files of each folder album
+func refreshAlbums(svc s3iface.S3API, bucketName string, added map[string][]string) error {
+	definitions, err := LoadAlbumManifest(cfg.AlbumManifest)
+	if err != nil {
+		return err
+	}
+	albums, err := manifestAlbums(svc, bucketName, definitions)
+	if err != nil {
+		return err
+	}
+	var replaced []string
+	if len(cfg.AlbumManifest) > 0 {
+		replaced = append(replaced, AlbumManifest)
+	}
+
+	// The manifest wins when a folder has the same name as an album in it
+	manifestIDs := make(map[string]bool)
+	for _, album := range albums {
+		manifestIDs[album.ID] = true
+	}
+	for _, album := range addToAlbums(svc, bucketName, added, AlbumFolder) {
+		if !manifestIDs[album.ID] {
+			albums = append(albums, album)
+		}
+	}
+	if len(albums) == 0 && len(replaced) == 0 {
+		return nil
+	}
+	updateAlbums(svc, bucketName, albums, replaced...)
+	return nil
+}
+
+// updateAlbums Uploads the albums and updates albums.json and the main page. Albums from the replaced
+// sources that weren't passed in are dropped from the list, so removed albums disappear from the site.
+func updateAlbums(svc s3iface.S3API, bucketName string, albums []Album, replaced ...string) {
+	summaries := make(map[string]albumSummary)
+	for _, summary := range readAlbums(svc, bucketName) {
+		if !contains(replaced, summary.Source) {
+			summaries[summary.ID] = summary
+		}
+	}
+	for _, album := range albums {
+		summaries[album.ID] = writeAlbum(svc, bucketName, album)
+		log.Info("Updated album ", album.Name, " with ", summaries[album.ID].Count, " files.")
+	}
+
+	list := []albumSummary{}
+	for _, summary := range summaries {
+		list = append(list, summary)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].From != list[j].From {
+			return list[i].From > list[j].From // newest first
+		}
+		return list[i].Name < list[j].Name
+	})
+	albumJSON, _ := json.Marshal(map[string][]albumSummary{"albums": list})
+	UploadToS3(svc, albumsPrefix+"albums.json", bucketName, albumJSON, int64(len(albumJSON)), true)
+	updateSearchAlbums(svc, bucketName, list)
+	createMainWebsite(svc, bucketName, readYears(svc, bucketName))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	filepath "path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAlbumID(t *testing.T) {
+	tests := map[string]string{
+		"Japan trip 2016": "japan-trip-2016",
+		"  Mum & Dad ":    "mum-dad",
+		"holiday":         "holiday",
+		"!!!":             "",
+	}
+	for name, expected := range tests {
+		if id := AlbumID(name); id != expected {
+			t.Errorf("AlbumID(%q) = %q, expected %q", name, id, expected)
+		}
+	}
+}
+
+func TestAlbumsGolden(t *testing.T) {
+	fake := setupProcess(t)
+	inDir := t.TempDir()
+	createFixtures(t, inDir, photoFixtures)
+
+	manifest := filepath.Join(t.TempDir(), "albums.yaml")
+	os.WriteFile(manifest, []byte(`albums:
+  - name: Spring 2016
+    dates: ["2016-05-13:2016-05-14"]
+    files: [2017/2017-01-01/IMG_0004.jpg]
+    cover: 2016/2016-05-14/IMG_0003.jpg
+`), 0666)
+	cfg.AlbumManifest = manifest
+	cfg.FolderAlbums = true
+
+	process(fake, inDir, "", testBucket)
+	checkGolden(t, fake, "albums")
+
+	// Removing an album from the manifest removes it from the list, folder albums are kept
+	os.WriteFile(manifest, []byte("albums: []\n"), 0666)
+	if err := refreshAlbums(fake, testBucket, nil); err != nil {
+		t.Fatal(err)
+	}
+	var albums map[string][]albumSummary
+	json.Unmarshal(fake.Object(testBucket, albumsPrefix+"albums.json"), &albums)
+	if len(albums["albums"]) != 1 || albums["albums"][0].ID != "holiday" {
+		t.Errorf("expected only the folder album to be left, got %v", albums)
+	}
+}
+
+func TestShareAlbum(t *testing.T) {
+	fake := setupProcess(t)
+	inDir := t.TempDir()
+	createFixtures(t, inDir, photoFixtures)
+	cfg.FolderAlbums = true
+	process(fake, inDir, "", testBucket)
+
+	sharePage, err := createShare(fake, testBucket, "album:holiday", "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest shareManifest
+	json.Unmarshal(fake.Object(testBucket, strings.TrimSuffix(sharePage, "index.html")+"share.json"), &manifest)
+	if manifest.Title != "holiday" || len(manifest.Files) != 1 || manifest.Files[0].URL != "../../2016/2016-05-14/IMG_0003.jpg" {
+		t.Errorf("unexpected share manifest: %+v", manifest)
+	}
+	if manifest.Files[0].Thumb != "../../"+thumbKey("2016/2016-05-14/IMG_0003.jpg") {
+		t.Errorf("expected the thumbnail to be linked, got %+v", manifest.Files[0])
+	}
+
+	// Nothing is linked for files without a thumbnail
+	DeleteFromS3(fake, thumbKey("2016/2016-05-14/IMG_0003.jpg"), testBucket)
+	sharePage, _ = createShare(fake, testBucket, "album:holiday", "", "", 0)
+	manifest = shareManifest{}
+	json.Unmarshal(fake.Object(testBucket, strings.TrimSuffix(sharePage, "index.html")+"share.json"), &manifest)
+	if len(manifest.Files) != 1 || manifest.Files[0].Thumb != "" {
+		t.Errorf("expected no thumbnail, got %+v", manifest.Files)
+	}
+	if _, err := createShare(fake, testBucket, "album:missing", "", "", 0); err == nil {
+		t.Error("expected an error sharing a missing album")
+	}
+}
+
+func TestAlbumMissingThumbnails(t *testing.T) {
+	fake := setupProcess(t)
+	inDir := t.TempDir()
+	createFixtures(t, inDir, photoFixtures)
+	process(fake, inDir, "", testBucket)
+	DeleteFromS3(fake, thumbKey("2016/2016-05-13/IMG_0001.jpg"), testBucket)
+
+	// Only the thumbnails that exist are linked or picked as cover
+	summary := writeAlbum(fake, testBucket, Album{ID: "test", Name: "Test", Files: []string{"2016/2016-05-13/IMG_0001.jpg", "2016/2016-05-13/IMG_0002.JPG"}})
+	if summary.Cover != thumbKey("2016/2016-05-13/IMG_0002.JPG") {
+		t.Errorf("expected the photo with a thumbnail as cover, got %s", summary.Cover)
+	}
+	album := readAlbum(fake, testBucket, "test")
+	if _, ok := album.Thumbs["2016/2016-05-13/IMG_0001.jpg"]; ok || album.Thumbs["2016/2016-05-13/IMG_0002.JPG"] != "../../"+thumbKey("2016/2016-05-13/IMG_0002.JPG") {
+		t.Errorf("expected only the existing thumbnail in album.json, got %v", album.Thumbs)
+	}
+	page := string(fake.Object(testBucket, albumsPrefix+"test/index.html"))
+	if strings.Contains(page, thumbKey("2016/2016-05-13/IMG_0001.jpg")) || !strings.Contains(page, `<div class="blank" title="IMG_0001.jpg">`) {
+		t.Errorf("expected a blank tile for the photo without a thumbnail, got\n%s", page)
+	}
+
+	createTimelineShard(fake, testBucket, day(2016, time.May, 13))
+	var shard timelineShard
+	json.Unmarshal(fake.Object(testBucket, "2016/2016-05/timeline.json"), &shard)
+	if thumbs := shard.Days[0].Thumbs; len(thumbs) != 2 || len(thumbs["IMG_0001.jpg"]) > 0 {
+		t.Errorf("expected no thumbnail for IMG_0001.jpg in the timeline, got %v", thumbs)
+	}
+}
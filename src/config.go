@@ -0,0 +1,349 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	filepath "path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// TranscodeProfile Settings passed to ffmpeg when shrinking movies
+type TranscodeProfile struct {
+	VideoCodec   string  `yaml:"video_codec" toml:"video_codec"`
+	Preset       string  `yaml:"preset" toml:"preset"`
+	CRF          int     `yaml:"crf" toml:"crf"`
+	AudioCodec   string  `yaml:"audio_codec" toml:"audio_codec"`
+	AudioBitrate string  `yaml:"audio_bitrate" toml:"audio_bitrate"`
+	MinRatio     float64 `yaml:"min_ratio" toml:"min_ratio"` // only keep the shrunk movie if it is smaller than this ratio
+}
+
+// Access modes for objects in the bucket
+const (
+	AccessPublic     = "public"     // everything is uploaded with the ACL, eg. public-read
+	AccessPresigned  = "presigned"  // photos are private, indexes carry time limited presigned URLs
+	AccessCloudFront = "cloudfront" // nothing gets an ACL, the bucket is served through CloudFront
+)
+
+// Rules for picking the cover of a date, month or year, pinned covers always win
+const (
+	CoverFirst  = "first"  // the first photo by name
+	CoverRandom = "random" // a random photo, which only changes when the folder does
+	CoverFaces  = "faces"  // the photo with the most face regions tagged by a photo manager
+)
+
+// Profile Named set of settings, flags override anything set here
+type Profile struct {
+	Bucket             string            `yaml:"bucket" toml:"bucket"`
+	Region             string            `yaml:"region" toml:"region"`
+	Endpoint           string            `yaml:"endpoint" toml:"endpoint"` // S3 compatible endpoint, eg. http://minio.local:9000
+	PathStyle          bool              `yaml:"path_style" toml:"path_style"`
+	InsecureSkipVerify bool              `yaml:"insecure_skip_verify" toml:"insecure_skip_verify"`
+	AccessKey          string            `yaml:"access_key" toml:"access_key"`
+	SecretKey          string            `yaml:"secret_key" toml:"secret_key"`
+	AWSProfile         string            `yaml:"aws_profile" toml:"aws_profile"`       // profile in ~/.aws/credentials
+	Layout             string            `yaml:"layout" toml:"layout"`                 // time format used for folders in the output directory
+	ThumbnailWidth     uint              `yaml:"thumbnail_size" toml:"thumbnail_size"` // in pixels
+	Transcode          TranscodeProfile  `yaml:"transcode" toml:"transcode"`
+	ACL                string            `yaml:"acl" toml:"acl"`
+	Access             string            `yaml:"access" toml:"access"`
+	LinkExpiry         string            `yaml:"link_expiry" toml:"link_expiry"`     // how long presigned URLs are valid for, at most 168h
+	PrivatePages       bool              `yaml:"private_pages" toml:"private_pages"` // presigned mode only, keep the pages private so share pages are the way in
+	SiteTitle          string            `yaml:"site_title" toml:"site_title"`
+	Theme              string            `yaml:"theme" toml:"theme"` // directory with templates and assets overriding the built-in theme
+	Cover              string            `yaml:"cover" toml:"cover"`
+	MapTiles           string            `yaml:"map_tiles" toml:"map_tiles"` // tile URL template for the map page
+	MapAttribution     string            `yaml:"map_attribution" toml:"map_attribution"`
+	Gazetteer          string            `yaml:"gazetteer" toml:"gazetteer"`           // tab separated places used to name events and locations
+	AlbumManifest      string            `yaml:"album_manifest" toml:"album_manifest"` // YAML or TOML file defining albums
+	FolderAlbums       bool              `yaml:"folder_albums" toml:"folder_albums"`   // create albums from the subfolders of the input directory
+	Covers             map[string]string `yaml:"covers" toml:"covers"`                 // pinned covers by year, month or date
+	Include            []string          `yaml:"include" toml:"include"`
+	Exclude            []string          `yaml:"exclude" toml:"exclude"`
+	Archive            Filter            `yaml:"archive" toml:"archive"` // which files are uploaded to the bucket
+	Publish            Filter            `yaml:"publish" toml:"publish"` // which archived files are shown on the website
+	Overwrite          bool              `yaml:"overwrite" toml:"overwrite"`
+	KeepMoviesOriginal bool              `yaml:"keep_movies_original" toml:"keep_movies_original"`
+	Encrypt            bool              `yaml:"encrypt" toml:"encrypt"`   // encrypt originals before uploading
+	KeyFile            string            `yaml:"key_file" toml:"key_file"` // use a key file instead of a passphrase
+	DisableThumbnails  bool              `yaml:"disable_thumbnails" toml:"disable_thumbnails"`
+	MotionPhotos       bool              `yaml:"motion_photos" toml:"motion_photos"`                     // extract the movies phones embed in motion photos
+	BurstWindow        string            `yaml:"burst_window" toml:"burst_window"`                       // photos taken closer together can be stacked, 0 turns stacks off
+	BurstDistance      int               `yaml:"burst_distance" toml:"burst_distance"`                   // bits the perceptual hashes of a burst may differ in
+	Privacy            string            `yaml:"privacy" toml:"privacy"`                                 // keep, strip-gps or strip-all
+	StripOriginals     bool              `yaml:"strip_originals" toml:"strip_originals"`                 // upload stripped copies in place of the originals
+	OriginalsPrefix    string            `yaml:"originals_prefix" toml:"originals_prefix"`               // private prefix for untouched originals when stripping
+	OriginalsStorage   string            `yaml:"originals_storage_class" toml:"originals_storage_class"` // eg. GLACIER or DEEP_ARCHIVE
+	Geofences          []Geofence        `yaml:"geofences" toml:"geofences"`                             // areas where locations are always stripped
+	Move               bool              `yaml:"move" toml:"move"`                                       // remove sources once copied and uploaded
+	TrashDir           string            `yaml:"trash_dir" toml:"trash_dir"`                             // move sources here instead of deleting them
+}
+
+// Config Contents of the config file
+type Config struct {
+	DefaultProfile string             `yaml:"default_profile" toml:"default_profile"`
+	Profiles       map[string]Profile `yaml:"profiles" toml:"profiles"`
+}
+
+// DefaultProfile Returns the settings used when nothing is configured
+func DefaultProfile() Profile {
+	return Profile{
+		Region:         "us-east-1",
+		Layout:         "2006/2006-01-02",
+		ThumbnailWidth: 160,
+		Transcode: TranscodeProfile{
+			VideoCodec:   "libx264",
+			Preset:       "medium",
+			CRF:          25,
+			AudioCodec:   "aac",
+			AudioBitrate: "96k",
+			MinRatio:     0.93,
+		},
+		ACL:             "public-read",
+		Access:          AccessPublic,
+		LinkExpiry:      "168h",
+		Cover:           CoverFirst,
+		BurstWindow:     "10s",
+		BurstDistance:   10,
+		Privacy:         PrivacyKeep,
+		OriginalsPrefix: "originals/",
+	}
+}
+
+// DefaultConfigFile Returns the config file used if none is passed in, prefers config.yaml over config.toml
+func DefaultConfigFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	dir := filepath.Join(home, ".config", "s3-photo-hosting")
+	for _, name := range []string{"config.yaml", "config.yml", "config.toml"} {
+		fileName := filepath.Join(dir, name)
+		if _, err := os.Stat(fileName); err == nil {
+			return fileName
+		}
+	}
+	return filepath.Join(dir, "config.yaml")
+}
+
+// LoadConfig Reads a YAML or TOML config file. A missing default config file gives an empty config, any other
+// missing file is an error as it was asked for.
+func LoadConfig(fileName string) (*Config, error) {
+	config := &Config{Profiles: make(map[string]Profile)}
+	if len(fileName) == 0 {
+		return config, nil
+	}
+
+	data, err := os.ReadFile(fileName)
+	if os.IsNotExist(err) && fileName == DefaultConfigFile() {
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".toml":
+		err = loadTOMLConfig(data, config)
+	default:
+		err = yaml.Unmarshal(data, config)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %v", fileName, err)
+	}
+	return config, nil
+}
+
+// loadTOMLConfig Decodes each profile on top of the defaults, the same way UnmarshalYAML does
+func loadTOMLConfig(data []byte, config *Config) error {
+	var raw struct {
+		DefaultProfile string                    `toml:"default_profile"`
+		Profiles       map[string]toml.Primitive `toml:"profiles"`
+	}
+	meta, err := toml.Decode(string(data), &raw)
+	if err != nil {
+		return err
+	}
+	config.DefaultProfile = raw.DefaultProfile
+	for name, primitive := range raw.Profiles {
+		profile := DefaultProfile()
+		if err := meta.PrimitiveDecode(primitive, &profile); err != nil {
+			return err
+		}
+		config.Profiles[name] = profile
+	}
+	return nil
+}
+
+// UnmarshalYAML Starts a profile from the defaults, so only the keys in the file change them. An empty acl or
+// a false flag is kept rather than taken as not set.
+func (p *Profile) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Profile // without the UnmarshalYAML method
+	*p = DefaultProfile()
+	return unmarshal((*plain)(p))
+}
+
+// ProfileName Returns the profile to use if none was asked for
+func (c *Config) ProfileName(name string) string {
+	if len(name) == 0 {
+		name = c.DefaultProfile
+	}
+	if len(name) == 0 {
+		name = "default"
+	}
+	return name
+}
+
+// GetProfile Returns the named profile (or the default one), profiles are read on top of the built in defaults
+func (c *Config) GetProfile(name string) (Profile, error) {
+	name = c.ProfileName(name)
+	profile, ok := c.Profiles[name]
+	if !ok {
+		if name != "default" {
+			return DefaultProfile(), fmt.Errorf("profile %s not found in config file", name)
+		}
+		return DefaultProfile(), nil
+	}
+	return profile, nil
+}
+
+// Validate Checks the settings that can't be checked when parsing
+func (p Profile) Validate() error {
+	switch p.Access {
+	case AccessPublic, AccessPresigned, AccessCloudFront:
+	default:
+		return fmt.Errorf("unknown access mode %s, use %s, %s or %s", p.Access, AccessPublic, AccessPresigned, AccessCloudFront)
+	}
+	expiry, err := time.ParseDuration(p.LinkExpiry)
+	if err != nil {
+		return fmt.Errorf("invalid link expiry %s: %v", p.LinkExpiry, err)
+	}
+	if expiry > 7*24*time.Hour {
+		return fmt.Errorf("link expiry %s is longer than the 7 days S3 allows", p.LinkExpiry)
+	}
+	switch p.Cover {
+	case CoverFirst, CoverRandom, CoverFaces:
+	default:
+		return fmt.Errorf("unknown cover rule %s, use %s, %s or %s", p.Cover, CoverFirst, CoverRandom, CoverFaces)
+	}
+	if len(p.Theme) > 0 {
+		if info, err := os.Stat(p.Theme); err != nil || !info.IsDir() {
+			return fmt.Errorf("theme directory %s not found", p.Theme)
+		}
+	}
+	if _, err := time.ParseDuration(p.BurstWindow); len(p.BurstWindow) > 0 && err != nil {
+		return fmt.Errorf("invalid burst window %s, eg. 10s", p.BurstWindow)
+	}
+	if p.BurstDistance < 0 || p.BurstDistance > 64 {
+		return fmt.Errorf("burst distance %d needs to be between 0 and 64 bits", p.BurstDistance)
+	}
+	if err := p.Archive.validate("archive"); err != nil {
+		return err
+	}
+	if err := p.Publish.validate("publish"); err != nil {
+		return err
+	}
+	if !p.Publish.IsEmpty() && len(p.OriginalsPrefix) == 0 {
+		return fmt.Errorf("files that aren't published are archived in the originals prefix, which can't be empty")
+	}
+	if p.Encrypt && len(p.OriginalsPrefix) == 0 {
+		return fmt.Errorf("encrypted originals are kept in the originals prefix, which can't be empty")
+	}
+	switch p.Privacy {
+	case PrivacyKeep, PrivacyStripGPS, PrivacyStripAll:
+	default:
+		return fmt.Errorf("unknown privacy policy %s, use %s, %s or %s", p.Privacy, PrivacyKeep, PrivacyStripGPS, PrivacyStripAll)
+	}
+	if len(p.OriginalsPrefix) > 0 && (!strings.HasSuffix(p.OriginalsPrefix, "/") || dayKeyRegExp.MatchString(p.OriginalsPrefix+"2006/2006-01-02/x")) {
+		return fmt.Errorf("originals prefix %s needs to be a folder outside the date folders, eg. originals/", p.OriginalsPrefix)
+	}
+	for _, fence := range p.Geofences {
+		if fence.Radius <= 0 {
+			return fmt.Errorf("geofence %s needs a radius in metres", fence.Name)
+		}
+	}
+	if len(p.MapTiles) > 0 && !(strings.Contains(p.MapTiles, "{z}") && strings.Contains(p.MapTiles, "{x}") && strings.Contains(p.MapTiles, "{y}")) {
+		return fmt.Errorf("map tile URL %s needs {z}, {x} and {y}", p.MapTiles)
+	}
+	// Checked up front so a broken manifest doesn't only show up after uploading
+	if _, err := LoadAlbumManifest(p.AlbumManifest); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Expiry Returns how long presigned URLs are valid for
+func (p Profile) Expiry() time.Duration {
+	expiry, err := time.ParseDuration(p.LinkExpiry)
+	if err != nil {
+		return 7 * 24 * time.Hour
+	}
+	return expiry
+}
+
+// Bursts Returns when photos are stacked as near-duplicates, false when stacking is turned off
+func (p Profile) Bursts() (burstOptions, bool) {
+	window, err := time.ParseDuration(p.BurstWindow)
+	if err != nil || window <= 0 {
+		return burstOptions{}, false
+	}
+	return burstOptions{Window: window, Distance: p.BurstDistance}, true
+}
+
+// ThumbnailSize Returns the width of the thumbnails
+func (p Profile) ThumbnailSize() uint {
+	if p.ThumbnailWidth == 0 {
+		return DefaultProfile().ThumbnailWidth
+	}
+	return p.ThumbnailWidth
+}
+
+// Title Returns the title for the main page, defaults to the bucket name
+func (p Profile) Title() string {
+	if len(p.SiteTitle) > 0 {
+		return p.SiteTitle
+	}
+	return p.Bucket
+}
+
+// Included Checks a file name against the include and exclude patterns
+func (p Profile) Included(fileName string) bool {
+	if p.Excluded(fileName) {
+		return false
+	}
+	if len(p.Include) == 0 {
+		return true
+	}
+	return matchAny(p.Include, fileName)
+}
+
+// Excluded Checks a file or directory name against the exclude patterns
+func (p Profile) Excluded(fileName string) bool {
+	return matchAny(p.Exclude, fileName)
+}
+
+// matchAny Case insensitive glob match of the base name against a list of patterns
+func matchAny(patterns []string, fileName string) bool {
+	baseName := strings.ToLower(filepath.Base(fileName))
+	for _, pattern := range patterns {
+		if matched, err := filepath.Match(strings.ToLower(pattern), baseName); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// showConfig Prints the effective config for the `config show` command, the secret key is masked
+func showConfig(configFile, profileName string, profile Profile) error {
+	if len(profile.SecretKey) > 0 {
+		profile.SecretKey = "****"
+	}
+	out, err := yaml.Marshal(profile)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("# config file: %s\n# profile: %s\n%s", configFile, profileName, out)
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	filepath "path/filepath"
+	"testing"
+)
+
+func TestProfileDefaults(t *testing.T) {
+	for _, test := range []struct{ name, content string }{
+		{"config.yaml", "profiles:\n  default:\n    acl: \"\"\n    burst_distance: 0\n    transcode:\n      crf: 20\n"},
+		{"config.toml", "[profiles.default]\nacl = \"\"\nburst_distance = 0\n[profiles.default.transcode]\ncrf = 20\n"},
+	} {
+		fileName := filepath.Join(t.TempDir(), test.name)
+		os.WriteFile(fileName, []byte(test.content), 0666)
+		config, err := LoadConfig(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		profile, err := config.GetProfile("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Keys that are set win even when empty, the rest keep their defaults
+		if profile.ACL != "" || profile.BurstDistance != 0 || profile.Transcode.CRF != 20 {
+			t.Errorf("%s: expected the values set in the file, got %+v", test.name, profile)
+		}
+		if profile.Transcode.VideoCodec != "libx264" || profile.Region != "us-east-1" || profile.Access != AccessPublic {
+			t.Errorf("%s: expected the defaults for everything else, got %+v", test.name, profile)
+		}
+	}
+}
+
+func TestLoadMissingConfig(t *testing.T) {
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "config.yaml")); err == nil {
+		t.Error("expected an error for a missing config file that was passed in")
+	}
+
+	// Without a config file in the default place the defaults are used
+	t.Setenv("HOME", t.TempDir())
+	config, err := LoadConfig(DefaultConfigFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile, err := config.GetProfile(""); err != nil || profile.Region != "us-east-1" {
+		t.Errorf("expected the default profile, got %+v: %v", profile, err)
+	}
+}
+
+func TestThumbnailSize(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(fileName, []byte("profiles:\n  default:\n    thumbnail_size: 240\n  other:\n    thumbnail_size: 0\n"), 0666)
+	config, err := LoadConfig(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]uint{"default": 240, "other": 160} {
+		if profile, err := config.GetProfile(name); err != nil || profile.ThumbnailSize() != expected {
+			t.Errorf("%s: expected thumbnails %d wide, got %d: %v", name, expected, profile.ThumbnailSize(), err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// coverCandidate A photo, or the cover of a date, that could be picked as cover
+type coverCandidate struct {
+	Name  string // file name for dates, date folder for months and years
+	Thumb string
+	Faces int
+}
+
+// pickCover Picks a cover using the configured rule, a candidate whose name matches pinned always wins.
+// Random picks are seeded with the candidates, so the cover only changes when they do.
+func pickCover(candidates []coverCandidate, pinned string) (coverCandidate, bool) {
+	if len(candidates) == 0 {
+		return coverCandidate{}, false
+	}
+	for _, candidate := range candidates {
+		if len(pinned) > 0 && candidate.Name == pinned {
+			return candidate, true
+		}
+	}
+
+	switch cfg.Cover {
+	case CoverRandom:
+		hash := fnv.New32a()
+		for _, candidate := range candidates {
+			hash.Write([]byte(candidate.Name + "\n"))
+		}
+		return candidates[hash.Sum32()%uint32(len(candidates))], true
+	case CoverFaces:
+		best := candidates[0]
+		for _, candidate := range candidates[1:] {
+			if candidate.Faces > best.Faces {
+				best = candidate
+			}
+		}
+		return best, true
+	}
+	return candidates[0], true
+}
+
+// pinnedCover Gets the pinned cover for a year or month relative to the year folder, eg. 2016-05-13/IMG_0001.jpg,
+// or for a date as a file name
+func pinnedCover(name string) string {
+	return cfg.Covers[name]
+}
+
+// dateCovers The covers of a list of dates as candidates for a month or year. Pins for months and years name a
+// photo, so a pinned date cover is picked by its date folder and the matching photo's thumbnail is used.
+func dateCovers(dates []folderStruct, pinned string) ([]coverCandidate, string) {
+	var candidates []coverCandidate
+	pinnedDate, pinnedFile := path.Split(pinned)
+	for _, dateF := range dates {
+		if dateF.Thumb == folderIcon {
+			continue
+		}
+		thumb := dateF.Thumb
+		if len(pinnedFile) > 0 && dateF.Date+"/" == pinnedDate && !strings.Contains(thumb, "://") {
+			thumb = "../" + thumbKey(dateF.Date[:len("2006")]+"/"+dateF.Date+"/"+pinnedFile)
+		}
+		candidates = append(candidates, coverCandidate{Name: dateF.Date, Thumb: thumb, Faces: dateF.Faces})
+	}
+	return candidates, strings.TrimSuffix(pinnedDate, "/")
+}
+
+// yearSummary An entry in years.json
+type yearSummary struct {
+	Year   string `json:"year"`
+	Cover  string `json:"cover,omitempty"` // thumbnail relative to the root of the bucket
+	Photos int    `json:"photos"`
+	Videos int    `json:"videos"`
+	From   string `json:"from,omitempty"` // first and last date with photos
+	To     string `json:"to,omitempty"`
+}
+
+// UnmarshalJSON Reads a year, older versions only listed the year itself
+func (y *yearSummary) UnmarshalJSON(data []byte) error {
+	var year string
+	if err := json.Unmarshal(data, &year); err == nil {
+		*y = yearSummary{Year: year}
+		return nil
+	}
+	type plain yearSummary // without the UnmarshalJSON method
+	return json.Unmarshal(data, (*plain)(y))
+}
+
+// summarizeYear Counts the photos and movies of a year and picks its cover
+func summarizeYear(year string, dates []folderStruct) yearSummary {
+	summary := yearSummary{Year: year, Cover: assetsPrefix + "folder.svg"}
+	for _, dateF := range dates {
+		summary.Photos += dateF.Count - dateF.Videos
+		summary.Videos += dateF.Videos
+		if len(summary.From) == 0 {
+			summary.From = dateF.Date
+		}
+		summary.To = dateF.Date
+	}
+	if cover, ok := pickCover(dateCovers(dates, pinnedCover(year))); ok {
+		summary.Cover = relativeLink(year+"/", cover.Thumb)
+	}
+	return summary
+}
+
+// readYears Reads years.json, nil if it doesn't exist yet
+func readYears(svc s3iface.S3API, bucketName string) []yearSummary {
+	var yearStruct map[string][]yearSummary
+	reader := GetFromS3(svc, "years.json", bucketName)
+	if reader == nil {
+		return nil
+	}
+	json.NewDecoder(reader).Decode(&yearStruct)
+	return yearStruct["years"]
+}
+
+// writeYears Uploads years.json and the main page listing them
+func writeYears(svc s3iface.S3API, bucketName string, years []yearSummary) {
+	yearJSON, _ := json.Marshal(map[string][]yearSummary{"years": years})
+	UploadToS3(svc, "years.json", bucketName, yearJSON, int64(len(yearJSON)), true)
+	createMainWebsite(svc, bucketName, years)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestPickCover(t *testing.T) {
+	setupProcess(t)
+	candidates := []coverCandidate{{Name: "a.jpg"}, {Name: "b.jpg", Faces: 3}, {Name: "c.jpg", Faces: 1}}
+
+	for _, test := range []struct {
+		rule, pinned, expected string
+	}{
+		{CoverFirst, "", "a.jpg"},
+		{CoverFaces, "", "b.jpg"},
+		{CoverFirst, "c.jpg", "c.jpg"},
+		{CoverFaces, "c.jpg", "c.jpg"},
+		{CoverFirst, "missing.jpg", "a.jpg"},
+	} {
+		cfg.Cover = test.rule
+		if cover, _ := pickCover(candidates, test.pinned); cover.Name != test.expected {
+			t.Errorf("%s cover pinned to %q: got %s, expected %s", test.rule, test.pinned, cover.Name, test.expected)
+		}
+	}
+
+	// Random covers only change when the candidates do
+	cfg.Cover = CoverRandom
+	first, _ := pickCover(candidates, "")
+	for i := 0; i < 5; i++ {
+		if cover, _ := pickCover(candidates, ""); cover != first {
+			t.Errorf("expected the same random cover every time, got %s and %s", first.Name, cover.Name)
+		}
+	}
+	if _, ok := pickCover(nil, ""); ok {
+		t.Error("expected no cover without candidates")
+	}
+}
+
+func TestYearSummaryReadsOldYears(t *testing.T) {
+	var years map[string][]yearSummary
+	if err := json.Unmarshal([]byte(`{"years":["2016",{"year":"2017","photos":2}]}`), &years); err != nil {
+		t.Fatal(err)
+	}
+	if len(years["years"]) != 2 || years["years"][0].Year != "2016" || years["years"][1].Photos != 2 {
+		t.Errorf("unexpected years %+v", years)
+	}
+}
+
+func TestCountFaceRegions(t *testing.T) {
+	xmp := `<mwg-rs:RegionList><rdf:Bag>
+		<rdf:li mwg-rs:Name="Ann" mwg-rs:Type="Face"/>
+		<rdf:li><mwg-rs:Type>Face</mwg-rs:Type></rdf:li>
+		<rdf:li mwg-rs:Type="Pet"/>
+	</rdf:Bag></mwg-rs:RegionList>`
+	if faces := countFaceRegions([]byte(xmp)); faces != 2 {
+		t.Errorf("expected 2 faces, got %d", faces)
+	}
+}
+
+func TestPinnedCovers(t *testing.T) {
+	fake := setupProcess(t)
+	cfg.Covers = map[string]string{"2016-05-13": "IMG_0002.JPG", "2016": "2016-05-14/IMG_0003.jpg"}
+	inDir := t.TempDir()
+	createFixtures(t, inDir, photoFixtures)
+	process(fake, inDir, "", testBucket)
+
+	var dates map[string][]folderStruct
+	json.Unmarshal(fake.Object(testBucket, "2016/dates.json"), &dates)
+	if dates["dates"][0].Thumb != "../_renditions/2016/2016-05-13/IMG_0002.JPG/thumb.jpg" {
+		t.Errorf("expected the pinned date cover, got %+v", dates["dates"][0])
+	}
+	years := readYears(fake, testBucket)
+	if len(years) == 0 || years[0].Cover != "_renditions/2016/2016-05-14/IMG_0003.jpg/thumb.jpg" {
+		t.Errorf("expected the pinned year cover, got %+v", years)
+	}
+
+	// Unpinning the date changes its cover when the folder is updated
+	delete(cfg.Covers, "2016-05-13")
+	createJSONandWebsiteForFolder(fake, testBucket, time.Date(2016, time.May, 13, 0, 0, 0, 0, time.UTC))
+	json.Unmarshal(fake.Object(testBucket, "2016/dates.json"), &dates)
+	if dates["dates"][0].Thumb != "../_renditions/2016/2016-05-13/IMG_0001.jpg/thumb.jpg" {
+		t.Errorf("expected the cover to be updated, got %+v", dates["dates"][0])
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted files start with a header followed by AES-GCM sealed chunks:
+//
+//	magic (8) | kdf (1) | salt (16) | file nonce (16) | chunk size (4)
+//
+// The master key is derived from the passphrase (scrypt) or key file (HKDF) and the salt, each file gets
+// its own key derived from the master key and the file nonce. Chunk nonces are the chunk counter with the
+// last byte set on the final chunk, so truncated or reordered files fail to decrypt.
+const (
+	encryptMagic     = "S3PHENC1"
+	encryptChunkSize = 64 * 1024
+	kdfScrypt        = 1
+	kdfKeyFile       = 2
+	saltSize         = 16
+	fileNonceSize    = 16
+	headerSize       = len(encryptMagic) + 1 + saltSize + fileNonceSize + 4
+)
+
+// Environment variables holding secrets, so they don't show up in the process list
+const (
+	passphraseEnv    = "S3_PHOTO_PASSPHRASE"     // passphrase for encrypting originals
+	secretKeyEnv     = "S3_PHOTO_SECRET_KEY"     // secret key when passing -access-key
+	sharePasswordEnv = "S3_PHOTO_SHARE_PASSWORD" // password of a share page
+)
+
+// ErrNotEncrypted is returned when decrypting a file that doesn't have the encryption header
+var ErrNotEncrypted = errors.New("file is not encrypted")
+
+// ErrNoKey is returned when an encrypted file is found but there is no passphrase or key file
+var ErrNoKey = errors.New("file is encrypted, set $" + passphraseEnv + " or pass -keyfile")
+
+// Keyring Derives the keys used to encrypt and decrypt originals
+type Keyring struct {
+	secret  []byte
+	kdf     byte
+	salt    []byte            // salt used when encrypting, one per run so scrypt only runs once
+	masters map[string][]byte // master keys by kdf and salt
+	lock    sync.Mutex
+}
+
+// NewKeyring Creates a keyring from a key file, or a passphrase if no key file is given
+func NewKeyring(passphrase, keyFile string) (*Keyring, error) {
+	keyring := &Keyring{kdf: kdfScrypt, secret: []byte(passphrase), masters: make(map[string][]byte)}
+	if len(keyFile) > 0 {
+		secret, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		keyring.kdf = kdfKeyFile
+		keyring.secret = secret
+	}
+	if len(keyring.secret) == 0 {
+		return nil, errors.New("need a passphrase or key file to encrypt")
+	}
+
+	keyring.salt = make([]byte, saltSize)
+	if _, err := rand.Read(keyring.salt); err != nil {
+		return nil, err
+	}
+	return keyring, nil
+}
+
+// master Gets the master key for a salt, caching it as scrypt is slow on purpose
+func (k *Keyring) master(kdf byte, salt []byte) ([]byte, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	cacheKey := string(append([]byte{kdf}, salt...))
+	if key, ok := k.masters[cacheKey]; ok {
+		return key, nil
+	}
+	if kdf != k.kdf {
+		return nil, fmt.Errorf("file was encrypted with a %s", kdfName(kdf))
+	}
+
+	var key []byte
+	var err error
+	switch kdf {
+	case kdfScrypt:
+		key, err = scrypt.Key(k.secret, salt, 1<<15, 8, 1, 32)
+	case kdfKeyFile:
+		key = make([]byte, 32)
+		_, err = io.ReadFull(hkdf.New(sha256.New, k.secret, salt, []byte("master")), key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	k.masters[cacheKey] = key
+	return key, nil
+}
+
+// kdfName Describes a key derivation function for error messages
+func kdfName(kdf byte) string {
+	if kdf == kdfKeyFile {
+		return "key file"
+	}
+	return "passphrase"
+}
+
+// fileCipher Gets the AES-GCM cipher for a file from the header
+func (k *Keyring) fileCipher(header []byte) (cipher.AEAD, error) {
+	kdf := header[len(encryptMagic)]
+	salt := header[len(encryptMagic)+1 : len(encryptMagic)+1+saltSize]
+	fileNonce := header[len(encryptMagic)+1+saltSize : len(encryptMagic)+1+saltSize+fileNonceSize]
+	master, err := k.master(kdf, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, master, fileNonce, []byte("file")), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce Gets the nonce for a chunk, the last byte marks the final chunk
+func chunkNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// Encrypt Encrypts src into dst one chunk at a time
+func (k *Keyring) Encrypt(dst io.Writer, src io.Reader) error {
+	header := make([]byte, 0, headerSize)
+	header = append(header, encryptMagic...)
+	header = append(header, k.kdf)
+	header = append(header, k.salt...)
+	fileNonce := make([]byte, fileNonceSize)
+	if _, err := rand.Read(fileNonce); err != nil {
+		return err
+	}
+	header = append(header, fileNonce...)
+	header = binary.BigEndian.AppendUint32(header, encryptChunkSize)
+
+	gcm, err := k.fileCipher(header)
+	if err != nil {
+		return err
+	}
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+
+	// Read a chunk at a time, peeking ahead to know if it is the last one
+	reader := bufio.NewReaderSize(src, encryptChunkSize)
+	chunk := make([]byte, encryptChunkSize)
+	for counter := uint64(0); ; counter++ {
+		n, err := io.ReadFull(reader, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		_, peekErr := reader.Peek(1)
+		last := peekErr == io.EOF
+		if _, err := dst.Write(gcm.Seal(nil, chunkNonce(counter, last), chunk[:n], header)); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// EncryptingReader Encrypts src while it is read, so a file can be streamed into an upload. Close it when done
+// so the encryption stops if the upload fails part way.
+func (k *Keyring) EncryptingReader(src io.Reader) io.ReadCloser {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(k.Encrypt(writer, src))
+	}()
+	return reader
+}
+
+// Decrypt Decrypts src into dst, returns ErrNotEncrypted if src doesn't have the header
+func (k *Keyring) Decrypt(dst io.Writer, src io.Reader) error {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(src, header); err != nil || !IsEncrypted(header) {
+		return ErrNotEncrypted
+	}
+	chunkSize := int(binary.BigEndian.Uint32(header[headerSize-4:]))
+	gcm, err := k.fileCipher(header)
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReaderSize(src, chunkSize+gcm.Overhead())
+	chunk := make([]byte, chunkSize+gcm.Overhead())
+	for counter := uint64(0); ; counter++ {
+		n, err := io.ReadFull(reader, chunk)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("encrypted file is truncated: %v", err)
+		}
+		_, peekErr := reader.Peek(1)
+		last := peekErr == io.EOF
+		plainText, err := gcm.Open(nil, chunkNonce(counter, last), chunk[:n], header)
+		if err != nil {
+			return errors.New("unable to decrypt file, wrong key or the file is corrupt")
+		}
+		if _, err := dst.Write(plainText); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// IsEncrypted Checks whether data starts with the encryption header
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptMagic))
+}
+
+// EncryptedSize Returns the size of a file once encrypted
+func EncryptedSize(plainSize int64) int64 {
+	chunks := (plainSize + encryptChunkSize - 1) / encryptChunkSize
+	if chunks == 0 {
+		chunks = 1 // empty files still get a final chunk
+	}
+	return int64(headerSize) + plainSize + chunks*16
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/nfnt/resize"
+)
+
+// Fingerprint What is needed to find near-duplicates and pick the best of them
+type Fingerprint struct {
+	Hash      string  // 64 bit difference hash in hex
+	Sharpness float64 // variance of the Laplacian, blurry photos score low
+}
+
+// NewFingerprint Hashes an image and scores its sharpness, a thumbnail is enough for both and keeps it fast
+func NewFingerprint(img image.Image) Fingerprint {
+	return Fingerprint{Hash: fmt.Sprintf("%016x", differenceHash(img)), Sharpness: blurScore(img)}
+}
+
+// gray Gets the luminance of a pixel from 0 to 255
+func gray(img image.Image, x, y int) float64 {
+	r, g, b, _ := img.At(x, y).RGBA()
+	return (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 257
+}
+
+// differenceHash Shrinks the image to 9x8 and sets a bit for each pixel brighter than its right neighbour,
+// so similar images have hashes that differ in only a few bits
+func differenceHash(img image.Image) uint64 {
+	small := resize.Resize(9, 8, img, resize.Bilinear)
+	bounds := small.Bounds()
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if gray(small, bounds.Min.X+x, bounds.Min.Y+y) > gray(small, bounds.Min.X+x+1, bounds.Min.Y+y) {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// blurScore Variance of the Laplacian of the grayscale image, edges in sharp photos give a high variance
+func blurScore(img image.Image) float64 {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width < 3 || height < 3 {
+		return 0
+	}
+	lum := make([]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			lum[y*width+x] = gray(img, bounds.Min.X+x, bounds.Min.Y+y)
+		}
+	}
+	var sum, sumSquares float64
+	for y := 1; y < height-1; y++ {
+		for x := 1; x < width-1; x++ {
+			i := y*width + x
+			laplacian := lum[i-1] + lum[i+1] + lum[i-width] + lum[i+width] - 4*lum[i]
+			sum += laplacian
+			sumSquares += laplacian * laplacian
+		}
+	}
+	n := float64((width - 2) * (height - 2))
+	mean := sum / n
+	// Rounded so photos.json doesn't change between runs on different machines
+	return float64(int64((sumSquares/n-mean*mean)*100)) / 100
+}
+
+// hashDistance Counts the bits that differ between two hashes, -1 if either is missing
+func hashDistance(a, b string) int {
+	x, errA := strconv.ParseUint(a, 16, 64)
+	y, errB := strconv.ParseUint(b, 16, 64)
+	if len(a) == 0 || len(b) == 0 || errA != nil || errB != nil {
+		return -1
+	}
+	return bits.OnesCount64(x ^ y)
+}
+
+// burstOptions When photos count as near-duplicates
+type burstOptions struct {
+	Window   time.Duration // photos further apart than this are never grouped
+	Distance int           // most bits the hashes of neighbouring frames may differ in
+}
+
+// burstGroup Near-duplicate photos in the order they were taken, the sharpest one is the cover
+type burstGroup struct {
+	Cover string   `json:"cover"`
+	Files []string `json:"files"`
+}
+
+// findBursts Groups the photos of a day taken within the window of the previous one and looking like it.
+// Photos without a hash, such as movies, are never grouped.
+func findBursts(fileNames []string, info map[string]PhotoInfo, options burstOptions) []burstGroup {
+	type frame struct {
+		name  string
+		taken time.Time
+	}
+	var frames []frame
+	for _, fileName := range fileNames {
+		if len(info[fileName].Hash) == 0 {
+			continue
+		}
+		taken, err := time.Parse("2006-01-02T15:04:05", info[fileName].Taken)
+		if err != nil {
+			continue
+		}
+		frames = append(frames, frame{fileName, taken})
+	}
+	sort.SliceStable(frames, func(i, j int) bool {
+		if !frames[i].taken.Equal(frames[j].taken) {
+			return frames[i].taken.Before(frames[j].taken)
+		}
+		return frames[i].name < frames[j].name
+	})
+
+	var groups []burstGroup
+	var current []string
+	flush := func() {
+		if len(current) > 1 {
+			group := burstGroup{Cover: current[0], Files: current}
+			for _, fileName := range current {
+				if info[fileName].Sharpness > info[group.Cover].Sharpness {
+					group.Cover = fileName
+				}
+			}
+			groups = append(groups, group)
+		}
+		current = nil
+	}
+	for i, f := range frames {
+		if i > 0 {
+			previous := frames[i-1]
+			distance := hashDistance(info[previous.name].Hash, info[f.name].Hash)
+			if f.taken.Sub(previous.taken) > options.Window || distance < 0 || distance > options.Distance {
+				flush()
+			}
+		}
+		current = append(current, f.name)
+	}
+	flush()
+	return groups
+}
+
+// stackBursts Marks the photos of each burst with the name of its sharpest frame, the day page shows only
+// that one with the rest stacked behind it
+func stackBursts(fileNames []string, info map[string]PhotoInfo) {
+	for fileName, fileInfo := range info {
+		fileInfo.Stack = ""
+		info[fileName] = fileInfo
+	}
+	options, ok := cfg.Bursts()
+	if !ok {
+		return
+	}
+	for _, group := range findBursts(fileNames, info, options) {
+		for _, fileName := range group.Files {
+			fileInfo := info[fileName]
+			fileInfo.Stack = group.Cover
+			info[fileName] = fileInfo
+		}
+	}
+}
+
+// dayBursts The near-duplicates found on a day, for the dupes report
+type dayBursts struct {
+	Date   string       `json:"date"`
+	Groups []burstGroup `json:"groups"`
+}
+
+// findDupes Reads the photos.json of every day in the targets and groups their near-duplicates
+func findDupes(svc s3iface.S3API, bucketName string, targets []string, options burstOptions) ([]dayBursts, error) {
+	if len(targets) == 0 {
+		targets = []string{""}
+	}
+	var days []dayBursts
+	seen := make(map[string]bool)
+	for _, target := range targets {
+		dates, err := parseDateRange(target)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range GetObjectsFromBucket(svc, bucketName, dates.prefix) {
+			matches := dayKeyRegExp.FindStringSubmatch(*obj.Key)
+			if matches == nil || matches[2] != "photos.json" || seen[matches[1]] {
+				continue
+			}
+			if date, err := time.Parse("2006-01-02", matches[1]); err != nil || !dates.Contains(date) {
+				continue
+			}
+			seen[matches[1]] = true
+
+			var folder struct {
+				Files []string             `json:"files"`
+				Info  map[string]PhotoInfo `json:"info"`
+			}
+			reader := GetFromS3(svc, *obj.Key, bucketName)
+			if reader == nil {
+				continue
+			}
+			if err := json.NewDecoder(reader).Decode(&folder); err != nil {
+				return nil, fmt.Errorf("%s: %v", *obj.Key, err)
+			}
+			if groups := findBursts(folder.Files, folder.Info, options); len(groups) > 0 {
+				days = append(days, dayBursts{Date: matches[1], Groups: groups})
+			}
+		}
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Date < days[j].Date })
+	return days, nil
+}
+
+// formatDupes Lists each group on a line with the sharpest photo first and marked with a *
+func formatDupes(days []dayBursts) string {
+	var out strings.Builder
+	for _, day := range days {
+		folder := day.Date[:4] + "/" + day.Date + "/"
+		for _, group := range day.Groups {
+			line := []string{"*" + folder + group.Cover}
+			for _, fileName := range group.Files {
+				if fileName != group.Cover {
+					line = append(line, folder+fileName)
+				}
+			}
+			out.WriteString(strings.Join(line, " ") + "\n")
+		}
+	}
+	return out.String()
+}
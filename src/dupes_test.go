@@ -0,0 +1,77 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+	"time"
+
+	"github.com/nfnt/resize"
+)
+
+// testPattern Draws stripes whose brightness depends on the offset, so shifted copies look alike
+func testPattern(width, height, offset int) image.Image {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetGray(x, y, color.Gray{uint8((x*255/width + y*3 + offset) % 256)})
+		}
+	}
+	return img
+}
+
+func TestFingerprint(t *testing.T) {
+	sharp := testPattern(160, 120, 0)
+	similar := NewFingerprint(testPattern(160, 120, 2))
+	blurred := NewFingerprint(resize.Resize(160, 120, resize.Resize(20, 15, sharp, resize.Bilinear), resize.Bilinear))
+	other := NewFingerprint(image.NewGray(image.Rect(0, 0, 160, 120)))
+	fingerprint := NewFingerprint(sharp)
+
+	if distance := hashDistance(fingerprint.Hash, similar.Hash); distance < 0 || distance > 10 {
+		t.Errorf("expected similar images to have close hashes, got a distance of %d", distance)
+	}
+	if distance := hashDistance(fingerprint.Hash, other.Hash); distance <= 10 {
+		t.Errorf("expected different images to have distant hashes, got a distance of %d", distance)
+	}
+	if fingerprint.Sharpness <= blurred.Sharpness {
+		t.Errorf("expected the sharp image to score higher, got %v and %v", fingerprint.Sharpness, blurred.Sharpness)
+	}
+	if hashDistance("", fingerprint.Hash) != -1 {
+		t.Error("expected no distance without a hash")
+	}
+}
+
+func TestFindBursts(t *testing.T) {
+	info := map[string]PhotoInfo{
+		"IMG_0001.jpg": {Taken: "2016-05-13T12:00:00", Hash: "ff00ff00ff00ff00", Sharpness: 10},
+		"IMG_0002.jpg": {Taken: "2016-05-13T12:00:01", Hash: "ff00ff00ff00ff01", Sharpness: 30},
+		"IMG_0003.jpg": {Taken: "2016-05-13T12:00:02", Hash: "ff00ff00ff00ff03", Sharpness: 20},
+		"IMG_0004.jpg": {Taken: "2016-05-13T12:00:03", Hash: "00ff00ff00ff00ff", Sharpness: 50}, // something else
+		"IMG_0005.jpg": {Taken: "2016-05-13T12:05:00", Hash: "00ff00ff00ff00ff", Sharpness: 50}, // too late
+		"MVI_0006.mp4": {Taken: "2016-05-13T12:00:01"},
+	}
+	fileNames := []string{"IMG_0005.jpg", "IMG_0004.jpg", "IMG_0003.jpg", "IMG_0002.jpg", "IMG_0001.jpg", "MVI_0006.mp4"}
+	groups := findBursts(fileNames, info, burstOptions{Window: 10 * time.Second, Distance: 4})
+	if len(groups) != 1 || groups[0].Cover != "IMG_0002.jpg" || len(groups[0].Files) != 3 || groups[0].Files[0] != "IMG_0001.jpg" {
+		t.Fatalf("expected one burst with the sharpest frame as cover, got %+v", groups)
+	}
+
+	days := []dayBursts{{Date: "2016-05-13", Groups: groups}}
+	expected := "*2016/2016-05-13/IMG_0002.jpg 2016/2016-05-13/IMG_0001.jpg 2016/2016-05-13/IMG_0003.jpg\n"
+	if report := formatDupes(days); report != expected {
+		t.Errorf("unexpected report:\n%s", report)
+	}
+
+	old := cfg
+	defer func() { cfg = old }()
+	cfg = DefaultProfile()
+	stackBursts(fileNames, info)
+	if info["IMG_0001.jpg"].Stack != "IMG_0002.jpg" || info["IMG_0004.jpg"].Stack != "" {
+		t.Errorf("expected the burst to be stacked, got %+v", info)
+	}
+	cfg.BurstWindow = "0"
+	stackBursts(fileNames, info)
+	if info["IMG_0001.jpg"].Stack != "" {
+		t.Error("expected no stacks when they are turned off")
+	}
+}
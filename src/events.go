@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// gazetteerPlaces The places in the configured gazetteer, loaded when processing starts
+var gazetteerPlaces []place
+
+// gazetteerRadius Places further than this many km from a photo aren't used to name its event
+const gazetteerRadius = 100
+
+// eventPhoto A file in the library with when and where it was taken
+type eventPhoto struct {
+	Key   string
+	Taken time.Time
+	Lat   *float64
+	Lon   *float64
+}
+
+// eventOptions How the library is split into events
+type eventOptions struct {
+	Gap      time.Duration // a longer gap between photos starts a new event
+	Distance float64       // km between photos that starts a new event, 0 ignores locations
+	MinFiles int           // smaller events aren't turned into albums
+}
+
+// place A named location in the gazetteer
+type place struct {
+	Name string
+	Lat  float64
+	Lon  float64
+}
+
+// readEventPhotos Reads when and where the files gathered by addFilesToMap were taken, sorted by time
+func readEventPhotos(fileMap map[string][]string) []eventPhoto {
+	var photos []eventPhoto
+	for dateKey, files := range fileMap {
+		date, err := time.Parse("2006-01-02", dateKey)
+		if err != nil {
+			log.Error("Error parsing date: ", dateKey)
+			continue
+		}
+		for _, fileName := range files {
+			if isLiveMovie(fileName) {
+				continue
+			}
+			info := ReadPhotoInfo(fileName)
+			if !isPublished(fileName, date, info) {
+				continue
+			}
+			taken, err := time.ParseInLocation("2006-01-02T15:04:05", info.Taken, time.Local)
+			if err != nil {
+				taken = date
+			}
+			photos = append(photos, eventPhoto{Key: objectKey(fileName, date), Taken: taken, Lat: info.Lat, Lon: info.Lon})
+		}
+	}
+	sort.Slice(photos, func(i, j int) bool {
+		if !photos[i].Taken.Equal(photos[j].Taken) {
+			return photos[i].Taken.Before(photos[j].Taken)
+		}
+		return photos[i].Key < photos[j].Key
+	})
+	return photos
+}
+
+// distanceKm Great circle distance between two points using the haversine formula
+func distanceKm(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadius = 6371
+	toRadians := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRadians(lat2 - lat1)
+	dLon := toRadians(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// clusterEvents Splits photos sorted by time into events. A new event starts when photos are further apart than
+// the gap, or with a distance set when a photo is further than that from the last located photo of the event.
+func clusterEvents(photos []eventPhoto, options eventOptions) [][]eventPhoto {
+	var events [][]eventPhoto
+	var last *eventPhoto // last photo with a location in the current event
+	for i, photo := range photos {
+		split := i == 0 || photo.Taken.Sub(photos[i-1].Taken) > options.Gap
+		if !split && options.Distance > 0 && photo.Lat != nil && last != nil {
+			split = distanceKm(*last.Lat, *last.Lon, *photo.Lat, *photo.Lon) > options.Distance
+		}
+		if split {
+			events = append(events, nil)
+			last = nil
+		}
+		events[len(events)-1] = append(events[len(events)-1], photo)
+		if photo.Lat != nil && photo.Lon != nil {
+			last = &photos[i]
+		}
+	}
+	return events
+}
+
+// LoadGazetteer Reads a tab separated list of places, either a GeoNames dump such as cities15000.txt or lines
+// of name, latitude and longitude. Lines starting with # are skipped.
+func LoadGazetteer(fileName string) ([]place, error) {
+	if len(fileName) == 0 {
+		return nil, nil
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var places []place
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if len(strings.TrimSpace(text)) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		nameField, latField := 0, 1
+		if len(fields) > 5 {
+			nameField, latField = 1, 4 // GeoNames: id, name, ascii name, alternate names, latitude, longitude, ...
+		} else if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected name, latitude and longitude separated by tabs", fileName, line)
+		}
+		lat, latErr := strconv.ParseFloat(fields[latField], 64)
+		lon, lonErr := strconv.ParseFloat(fields[latField+1], 64)
+		if latErr != nil || lonErr != nil {
+			return nil, fmt.Errorf("%s:%d: invalid coordinates", fileName, line)
+		}
+		places = append(places, place{Name: fields[nameField], Lat: lat, Lon: lon})
+	}
+	return places, scanner.Err()
+}
+
+// nearestPlace Gets the name of the closest place within gazetteerRadius, empty if there is none
+func nearestPlace(places []place, lat, lon float64) string {
+	name, closest := "", float64(gazetteerRadius)
+	for _, p := range places {
+		if distance := distanceKm(lat, lon, p.Lat, p.Lon); distance <= closest {
+			name, closest = p.Name, distance
+		}
+	}
+	return name
+}
+
+// eventName Names an event after its dates and the place most of its located photos are closest to,
+// eg. Kyoto 2016-05-13 to 2016-05-20
+func eventName(event []eventPhoto, places []place) string {
+	from, to := event[0].Taken.Format("2006-01-02"), event[len(event)-1].Taken.Format("2006-01-02")
+	name := from
+	if from != to {
+		name += " to " + to
+	}
+
+	counts := make(map[string]int)
+	best := ""
+	for _, photo := range event {
+		if photo.Lat == nil || photo.Lon == nil {
+			continue
+		}
+		if p := nearestPlace(places, *photo.Lat, *photo.Lon); len(p) > 0 {
+			counts[p]++
+			if counts[p] > counts[best] {
+				best = p
+			}
+		}
+	}
+	if len(best) > 0 {
+		name = best + " " + name
+	}
+	return name
+}
+
+// createEvents Clusters the files in the library into events and uploads them as albums, replacing the events
+// found last time. Without a bucket, or with dryRun, the events are only logged.
+func createEvents(svc s3iface.S3API, bucketName, inDirName, gazetteer string, options eventOptions, dryRun bool) error {
+	places, err := LoadGazetteer(gazetteer)
+	if err != nil {
+		return err
+	}
+	fileMap := make(map[string][]string)
+	addFilesToMap(inDirName, fileMap)
+
+	sources := make(map[string]string)
+	if len(bucketName) > 0 {
+		for _, summary := range readAlbums(svc, bucketName) {
+			sources[summary.ID] = summary.Source
+		}
+	}
+
+	var albums []Album
+	names := make(map[string]int)
+	for _, event := range clusterEvents(readEventPhotos(fileMap), options) {
+		if len(event) < options.MinFiles {
+			continue
+		}
+		name := eventName(event, places)
+		if names[name]++; names[name] > 1 {
+			name = fmt.Sprintf("%s (%d)", name, names[name])
+		}
+		album := Album{ID: AlbumID(name), Name: name, Source: AlbumEvents}
+		if source, ok := sources[album.ID]; ok && source != AlbumEvents {
+			log.Info("Album ", name, " already exists, skipping event.")
+			continue
+		}
+		for _, photo := range event {
+			album.Files = append(album.Files, photo.Key)
+		}
+		log.Info("Event ", name, " with ", len(album.Files), " files.")
+		albums = append(albums, album)
+	}
+
+	if dryRun || len(bucketName) == 0 {
+		return nil
+	}
+	updateAlbums(svc, bucketName, albums, AlbumEvents)
+	return nil
+}
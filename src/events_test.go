@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	filepath "path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func located(key string, taken time.Time, lat, lon float64) eventPhoto {
+	return eventPhoto{Key: key, Taken: taken, Lat: &lat, Lon: &lon}
+}
+
+func TestClusterEvents(t *testing.T) {
+	start := time.Date(2016, time.May, 13, 9, 0, 0, 0, time.UTC)
+	photos := []eventPhoto{
+		located("a", start, 35.01, 135.76),                   // Kyoto
+		{Key: "b", Taken: start.Add(2 * time.Hour)},          // no location, stays in the event
+		located("c", start.Add(4*time.Hour), 34.69, 135.50),  // Osaka, 40km away
+		located("d", start.Add(5*time.Hour), 35.68, 139.69),  // Tokyo, 370km away
+		located("e", start.Add(24*time.Hour), 35.68, 139.69), // a day later
+	}
+
+	for _, test := range []struct {
+		options  eventOptions
+		expected string
+	}{
+		{eventOptions{Gap: 6 * time.Hour}, "abcd e"},
+		{eventOptions{Gap: 6 * time.Hour, Distance: 100}, "abc d e"},
+		{eventOptions{Gap: 6 * time.Hour, Distance: 10}, "ab c d e"},
+		{eventOptions{Gap: 48 * time.Hour}, "abcde"},
+	} {
+		var events []string
+		for _, event := range clusterEvents(photos, test.options) {
+			keys := ""
+			for _, photo := range event {
+				keys += photo.Key
+			}
+			events = append(events, keys)
+		}
+		if got := strings.Join(events, " "); got != test.expected {
+			t.Errorf("%+v: got %s, expected %s", test.options, got, test.expected)
+		}
+	}
+}
+
+func TestEventNames(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "places.txt")
+	os.WriteFile(fileName, []byte("# name, latitude, longitude\nKyoto\t35.0116\t135.7681\n"+
+		"1850147\tTokyo\tTokyo\tTokio\t35.6895\t139.69171\tP\tPPLC\tJP\n"), 0666)
+	places, err := LoadGazetteer(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(places) != 2 || places[1].Name != "Tokyo" {
+		t.Fatalf("unexpected places: %v", places)
+	}
+
+	day := time.Date(2016, time.May, 13, 9, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		event    []eventPhoto
+		expected string
+	}{
+		{[]eventPhoto{{Taken: day}}, "2016-05-13"},
+		{[]eventPhoto{located("a", day, 35.0, 135.7), {Taken: day.AddDate(0, 0, 7)}}, "Kyoto 2016-05-13 to 2016-05-20"},
+		{[]eventPhoto{located("a", day, 35.0, 135.7), located("b", day, 35.6, 139.6), located("c", day, 35.6, 139.7)}, "Tokyo 2016-05-13"},
+		{[]eventPhoto{located("a", day, 51.5, -0.1)}, "2016-05-13"}, // too far from anything in the gazetteer
+	} {
+		if name := eventName(test.event, places); name != test.expected {
+			t.Errorf("got %s, expected %s", name, test.expected)
+		}
+	}
+
+	os.WriteFile(fileName, []byte("Kyoto,35.0116,135.7681\n"), 0666)
+	if _, err := LoadGazetteer(fileName); err == nil {
+		t.Error("expected an error for a comma separated gazetteer")
+	}
+}
+
+func TestCreateEvents(t *testing.T) {
+	fake := setupProcess(t)
+	inDir := t.TempDir()
+	createFixtures(t, inDir, photoFixtures)
+	process(fake, inDir, "", testBucket)
+
+	if err := createEvents(fake, testBucket, inDir, "", eventOptions{Gap: 6 * time.Hour, MinFiles: 2}, false); err != nil {
+		t.Fatal(err)
+	}
+	album := readAlbum(fake, testBucket, "2016-05-13")
+	if album == nil || album.Source != AlbumEvents || strings.Join(album.Files, ",") != "2016/2016-05-13/IMG_0001.jpg,2016/2016-05-13/IMG_0002.JPG,2016/2016-05-13/IMG_0006.jpeg" {
+		t.Fatalf("unexpected event album: %+v", album)
+	}
+	if summaries := readAlbums(fake, testBucket); len(summaries) != 1 {
+		t.Errorf("expected single photos to be left out, got %v", summaries)
+	}
+}
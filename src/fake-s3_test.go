@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// fakeS3 An in-memory S3 bucket, only the calls the uploader makes are implemented. Tests call it directly as
+// the S3 client, or through ServeHTTP to go through the SDK's own requests against an endpoint.
+type fakeS3 struct {
+	s3iface.S3API // calling anything else panics
+
+	lock    sync.Mutex
+	objects map[string][]byte   // keyed by bucket/key
+	puts    []string            // keys uploaded, in order
+	parts   map[string][][]byte // parts of multipart uploads in progress, keyed by upload id
+	etags   map[string]string   // ETags returned instead of the md5, keyed by bucket/key
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: make(map[string][]byte), parts: make(map[string][][]byte), etags: make(map[string]string)}
+}
+
+func fakeETag(data []byte) *string {
+	sum := md5.Sum(data)
+	return aws.String(`"` + hex.EncodeToString(sum[:]) + `"`)
+}
+
+// Keys Returns all keys in a bucket, sorted
+func (f *fakeS3) Keys(bucket string) []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var keys []string
+	for name := range f.objects {
+		if strings.HasPrefix(name, bucket+"/") {
+			keys = append(keys, strings.TrimPrefix(name, bucket+"/"))
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Object Returns the contents of an object, nil if it doesn't exist
+func (f *fakeS3) Object(bucket, key string) []byte {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.objects[bucket+"/"+key]
+}
+
+// SetETag Makes the bucket return etag for an object, like the ETag of a multipart upload or a corrupted one
+func (f *fakeS3) SetETag(bucket, key, etag string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.etags[bucket+"/"+key] = etag
+}
+
+// etag Returns the ETag of an object, the caller holds the lock
+func (f *fakeS3) etag(name string, data []byte) *string {
+	if etag, ok := f.etags[name]; ok {
+		return aws.String(`"` + etag + `"`)
+	}
+	return fakeETag(data)
+}
+
+// ResetPuts Clears the list of uploaded keys
+func (f *fakeS3) ResetPuts() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.puts = nil
+}
+
+func (f *fakeS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	data, err := io.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.objects[*input.Bucket+"/"+*input.Key] = data
+	delete(f.etags, *input.Bucket+"/"+*input.Key)
+	f.puts = append(f.puts, *input.Key)
+	return &s3.PutObjectOutput{ETag: fakeETag(data)}, nil
+}
+
+func (f *fakeS3) CreateMultipartUpload(input *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	id := *input.Bucket + "/" + *input.Key
+	f.parts[id] = nil
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(id)}, nil
+}
+
+func (f *fakeS3) UploadPart(input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	data, err := io.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.parts[*input.UploadId] = append(f.parts[*input.UploadId], data)
+	return &s3.UploadPartOutput{ETag: fakeETag(data)}, nil
+}
+
+func (f *fakeS3) CompleteMultipartUpload(input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	data := bytes.Join(f.parts[*input.UploadId], nil)
+	delete(f.parts, *input.UploadId)
+	f.objects[*input.Bucket+"/"+*input.Key] = data
+	delete(f.etags, *input.Bucket+"/"+*input.Key)
+	f.puts = append(f.puts, *input.Key)
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) AbortMultipartUpload(input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.parts, *input.UploadId)
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	data, ok := f.objects[*input.Bucket+"/"+*input.Key]
+	if !ok {
+		return &s3.GetObjectOutput{}, awserr.New("NoSuchKey", "The specified key does not exist.", nil)
+	}
+	return &s3.GetObjectOutput{
+		Body:          io.NopCloser(bytes.NewReader(data)),
+		ContentLength: aws.Int64(int64(len(data))),
+		ETag:          f.etag(*input.Bucket+"/"+*input.Key, data),
+	}, nil
+}
+
+func (f *fakeS3) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	data, ok := f.objects[*input.Bucket+"/"+*input.Key]
+	if !ok {
+		return &s3.HeadObjectOutput{}, awserr.New("NotFound", "Not Found", nil)
+	}
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(data))), ETag: f.etag(*input.Bucket+"/"+*input.Key, data)}, nil
+}
+
+func (f *fakeS3) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.objects, *input.Bucket+"/"+*input.Key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// ListObjectsPages Returns the objects 1000 at a time, like S3 does
+func (f *fakeS3) ListObjectsPages(input *s3.ListObjectsInput, fn func(*s3.ListObjectsOutput, bool) bool) error {
+	prefix := *input.Bucket + "/" + aws.StringValue(input.Prefix)
+	var contents []*s3.Object
+	f.lock.Lock()
+	for name, data := range f.objects {
+		if strings.HasPrefix(name, prefix) {
+			contents = append(contents, &s3.Object{
+				Key:          aws.String(strings.TrimPrefix(name, *input.Bucket+"/")),
+				Size:         aws.Int64(int64(len(data))),
+				ETag:         f.etag(name, data),
+				LastModified: aws.Time(time.Now()),
+			})
+		}
+	}
+	f.lock.Unlock()
+	sort.Slice(contents, func(i, j int) bool { return *contents[i].Key < *contents[j].Key })
+
+	for start := 0; ; start += 1000 {
+		end := start + 1000
+		if end >= len(contents) {
+			fn(&s3.ListObjectsOutput{Contents: contents[start:], IsTruncated: aws.Bool(false)}, true)
+			return nil
+		}
+		if !fn(&s3.ListObjectsOutput{Contents: contents[start:end], IsTruncated: aws.Bool(true)}, false) {
+			return nil
+		}
+	}
+}
+
+type fakeListResult struct {
+	XMLName     xml.Name            `xml:"ListBucketResult"`
+	Name        string              `xml:"Name"`
+	Prefix      string              `xml:"Prefix"`
+	IsTruncated bool                `xml:"IsTruncated"`
+	Contents    []fakeListedContent `xml:"Contents"`
+}
+
+type fakeListedContent struct {
+	Key          string `xml:"Key"`
+	Size         int64  `xml:"Size"`
+	ETag         string `xml:"ETag"`
+	LastModified string `xml:"LastModified"`
+}
+
+// ServeHTTP Serves the buckets over a minimal S3 compatible API using path style addressing, like MinIO
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket := aws.String(parts[0])
+	if len(parts) == 1 || len(parts[1]) == 0 {
+		// Listing a bucket, all in one go
+		result := fakeListResult{Name: *bucket, Prefix: r.URL.Query().Get("prefix")}
+		f.ListObjectsPages(&s3.ListObjectsInput{Bucket: bucket, Prefix: aws.String(result.Prefix)}, func(page *s3.ListObjectsOutput, last bool) bool {
+			for _, obj := range page.Contents {
+				result.Contents = append(result.Contents, fakeListedContent{
+					Key:          *obj.Key,
+					Size:         *obj.Size,
+					ETag:         *obj.ETag,
+					LastModified: obj.LastModified.UTC().Format(time.RFC3339),
+				})
+			}
+			return true
+		})
+		w.Header().Set("Content-Type", "application/xml")
+		xml.NewEncoder(w).Encode(result)
+		return
+	}
+
+	key := aws.String(parts[1])
+	switch r.Method {
+	case http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		out, _ := f.PutObject(&s3.PutObjectInput{Bucket: bucket, Key: key, Body: bytes.NewReader(data)})
+		w.Header().Set("ETag", *out.ETag)
+	case http.MethodDelete:
+		f.DeleteObject(&s3.DeleteObjectInput{Bucket: bucket, Key: key})
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet, http.MethodHead:
+		out, err := f.GetObject(&s3.GetObjectInput{Bucket: bucket, Key: key})
+		if err != nil {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				io.WriteString(w, `<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`)
+			}
+			return
+		}
+		w.Header().Set("ETag", *out.ETag)
+		w.Header().Set("Content-Length", strconv.FormatInt(*out.ContentLength, 10))
+		if r.Method == http.MethodGet {
+			io.Copy(w, out.Body)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -3,6 +3,9 @@ package main
 import (
 	//	"errors"
 	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
 	"image/jpeg"
 	"io"
 	"os"
@@ -24,7 +27,30 @@ func DefaultTime() time.Time {
 // IsJpeg Checks whether a file is a jpeg
 func IsJpeg(fileName string) bool {
 	fileExt := strings.ToLower(filepath.Ext(fileName))
-	return fileExt == ".jpg" // TODO! || fileExt == ".jpeg"
+	return fileExt == ".jpg" || fileExt == ".jpeg"
+}
+
+// IsHeic Checks whether a file is a HEIC photo, which is archived but can't be shown on the website
+func IsHeic(fileName string) bool {
+	fileExt := strings.ToLower(filepath.Ext(fileName))
+	return fileExt == ".heic" || fileExt == ".heif"
+}
+
+// IsSidecar Checks whether a file is an XMP sidecar written by a photo manager such as darktable or Lightroom
+func IsSidecar(fileName string) bool {
+	return strings.ToLower(filepath.Ext(fileName)) == ".xmp"
+}
+
+// FindSidecar Gets the XMP sidecar of a photo or movie, either IMG_0001.jpg.xmp as darktable names them or
+// IMG_0001.xmp as Lightroom does. Empty if there is none.
+func FindSidecar(fileName string) string {
+	base := strings.TrimSuffix(fileName, filepath.Ext(fileName))
+	for _, sidecar := range []string{fileName + ".xmp", fileName + ".XMP", base + ".xmp", base + ".XMP"} {
+		if info, err := os.Stat(sidecar); err == nil && !info.IsDir() {
+			return sidecar
+		}
+	}
+	return ""
 }
 
 // IsMovie returns true is the file is a movie
@@ -60,6 +86,10 @@ func GetDateTaken(fileName string) time.Time {
 		return DefaultTime()
 	}
 
+	if IsHeic(fileName) {
+		return heicDateTaken(fileName)
+	}
+
 	// Get the file extension for example .jpg
 	if !IsJpeg(fileName) {
 		// Get the current date and time for files that aren't photos
@@ -88,18 +118,43 @@ func GetDateTaken(fileName string) time.Time {
 	return date
 }
 
-// CreateDir helper to create a folder if it doesn't exist
-func CreateDir(dirName string) {
-	if _, err := os.Stat(dirName); os.IsNotExist(err) {
-		// Ok directory doesn't exist, create it
-		err := os.Mkdir(dirName, 0777)
-		if err != nil {
-			log.Error("Error creating directory: ", err.Error())
+// heicDateTaken Gets the date taken from the EXIF block a HEIC photo keeps as one of its items, the file
+// modification time if there is none. The block starts with the same header as in a jpeg, so it is found by
+// looking for that rather than walking the boxes.
+func heicDateTaken(fileName string) time.Time {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return DefaultTime()
+	}
+	header := []byte("Exif\x00\x00")
+	for offset := 0; ; {
+		index := bytes.Index(data[offset:], header)
+		if index < 0 {
+			return GetFileModTime(fileName)
 		}
+		// The item type in the meta box is also called Exif, so keep looking until one decodes
+		offset += index
+		if x, err := exif.Decode(bytes.NewReader(data[offset:])); err == nil {
+			if date, err := x.DateTime(); err == nil {
+				return date
+			}
+		}
+		offset += len(header)
+	}
+}
+
+// CreateDir helper to create a folder, and any parent folders, if it doesn't exist
+func CreateDir(dirName string) error {
+	if err := os.MkdirAll(dirName, 0777); err != nil {
+		return fmt.Errorf("error creating directory %s: %v", dirName, err)
 	}
+	return nil
 }
 
-// CopyFile Helper function to copy a file
+// CopyFile Helper function to copy a file. The copy is written to a temporary file next to the destination,
+// synced to disk and checked against the checksum of what was read before being renamed, so a crash or a bad
+// write never leaves a broken file behind.
+// Permissions and access/modification times are kept.
 func CopyFile(src, dst string) error {
 	// open input file
 	in, err := os.Open(src)
@@ -107,28 +162,98 @@ func CopyFile(src, dst string) error {
 		return err
 	}
 	defer in.Close()
+	inStat, err := in.Stat()
+	if err != nil {
+		return err
+	}
 
-	// create dest file
-	out, err := os.Create(dst)
+	// create temp file in the same folder, renaming is only atomic on the same drive
+	out, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".tmp")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(out.Name()) // no-op once renamed
 	defer out.Close()
 
-	// copy contents from source to destination
-	_, err = io.Copy(out, in)
-	cerr := out.Close()
+	// copy contents from source to destination, hashing them on the way, and make sure it is on disk
+	hash := md5.New()
+	size, err := io.Copy(io.MultiWriter(out, hash), in)
+	if err != nil {
+		return err
+	}
+	if size != inStat.Size() {
+		return fmt.Errorf("copied %d bytes of %s but expected %d", size, src, inStat.Size())
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if sum, err := FileMD5(out.Name()); err != nil {
+		return err
+	} else if sum != hex.EncodeToString(hash.Sum(nil)) {
+		return fmt.Errorf("checksum of the copy of %s differs from the source", src)
+	}
+
+	if err := os.Chmod(out.Name(), inStat.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := os.Chtimes(out.Name(), GetFileAccessTime(inStat), inStat.ModTime()); err != nil {
+		return err
+	}
+	if err := os.Rename(out.Name(), dst); err != nil {
+		return err
+	}
+
+	// sync the folder too so the rename survives a crash, not supported on all platforms
+	if dir, err := os.Open(filepath.Dir(dst)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// FileMD5 Gets the MD5 of a file as hex, which is what S3 uses as ETag
+func FileMD5(fileName string) (string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := md5.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// VerifyCopy Checks that a copy has the same size and checksum as the source
+func VerifyCopy(src, dst string) error {
+	if GetFileSize(src) != GetFileSize(dst) {
+		return fmt.Errorf("size of %s differs from %s", dst, src)
+	}
+	srcSum, err := FileMD5(src)
 	if err != nil {
 		return err
 	}
-	return cerr
+	dstSum, err := FileMD5(dst)
+	if err != nil {
+		return err
+	}
+	if srcSum != dstSum {
+		return fmt.Errorf("checksum of %s differs from %s", dst, src)
+	}
+	return nil
 }
 
-// CreateThumbNail Creates a thumbnail for an image
-func CreateThumbNail(inFile string, width uint) ([]byte, error) {
+// CreateThumbNail Creates a thumbnail for an image, along with the fingerprint of the image used to find
+// near-duplicates
+func CreateThumbNail(inFile string, width uint) ([]byte, Fingerprint, error) {
 	file, err := os.Open(inFile)
 	if err != nil {
-		return nil, err
+		return nil, Fingerprint{}, err
 	}
 
 	defer file.Close()
@@ -136,7 +261,7 @@ func CreateThumbNail(inFile string, width uint) ([]byte, error) {
 	// decode jpeg into image.Image
 	img, err := jpeg.Decode(file)
 	if err != nil {
-		return nil, err
+		return nil, Fingerprint{}, err
 	}
 
 	// resize to width using Lanczos resampling and preserve aspect ratio
@@ -147,7 +272,32 @@ func CreateThumbNail(inFile string, width uint) ([]byte, error) {
 	jpeg.Encode(out, m, nil)
 
 	log.Info("Created thumbnail for file: ", inFile)
-	return out.Bytes(), nil
+	return out.Bytes(), NewFingerprint(m), nil
+}
+
+// CreateDisplayCopy Writes a copy of a photo at most width pixels wide into tmpDir, without any of its metadata,
+// returning the name of the copy
+func CreateDisplayCopy(inFile, tmpDir string, width uint) (string, error) {
+	file, err := os.Open(inFile)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	img, err := jpeg.Decode(file)
+	if err != nil {
+		return "", err
+	}
+	if uint(img.Bounds().Dx()) > width {
+		img = resize.Resize(width, 0, img, resize.Lanczos3)
+	}
+	destFile := filepath.Join(tmpDir, "display-"+filepath.Base(inFile))
+	out, err := os.Create(destFile)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	return destFile, jpeg.Encode(out, img, &jpeg.Options{Quality: 90})
 }
 
 // Gets the size of a file in bytes
@@ -161,5 +311,3 @@ func GetFileSize(fileName string) int64 {
 	fileInfo, _ := file.Stat()
 	return fileInfo.Size()
 }
-
-const thumbNailSize = 160
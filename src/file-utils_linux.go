@@ -0,0 +1,15 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// GetFileAccessTime Gets the last access time of a file
+func GetFileAccessTime(info os.FileInfo) time.Time {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(stat.Atim.Unix())
+	}
+	return info.ModTime()
+}
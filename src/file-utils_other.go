@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// GetFileAccessTime Gets the last access time of a file, not available everywhere so use the modification time
+func GetFileAccessTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	filepath "path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestCopyFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "IMG_0001.jpg")
+	dst := filepath.Join(dir, "copy", "IMG_0001.jpg")
+	os.WriteFile(src, []byte("original"), 0640)
+	atime := time.Date(2016, time.May, 14, 8, 0, 0, 0, time.UTC)
+	mtime := time.Date(2016, time.May, 13, 18, 16, 56, 0, time.UTC)
+	os.Chtimes(src, atime, mtime)
+	if err := CreateDir(filepath.Dir(dst)); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(dst, []byte("replaced"), 0666)
+
+	if err := CopyFile(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("expected the mode to be kept, got %v", info.Mode())
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("expected the modification time to be kept, got %v", info.ModTime())
+	}
+	// Access times can only be read on linux
+	if runtime.GOOS == "linux" && !GetFileAccessTime(info).Equal(atime) {
+		t.Errorf("expected the access time to be kept, got %v", GetFileAccessTime(info))
+	}
+	if err := VerifyCopy(src, dst); err != nil {
+		t.Error(err)
+	}
+
+	// Only the copy is left in the folder, the temporary file was renamed
+	entries, _ := os.ReadDir(filepath.Dir(dst))
+	if len(entries) != 1 || entries[0].Name() != "IMG_0001.jpg" {
+		t.Errorf("expected only the copy in the folder, got %v", entries)
+	}
+
+	// A failed copy leaves the destination alone
+	if err := CopyFile(filepath.Join(dir, "missing.jpg"), dst); err == nil {
+		t.Error("expected an error copying a missing file")
+	}
+	if err := CopyFile(src, filepath.Join(dir, "missing", "IMG_0001.jpg")); err == nil {
+		t.Error("expected an error copying into a missing folder")
+	}
+	if data, _ := os.ReadFile(dst); string(data) != "original" {
+		t.Errorf("expected the copy to be kept, got %q", data)
+	}
+}
+
+func TestCreateDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := CreateDir(filepath.Join(dir, "2016", "2016-05-13")); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateDir(filepath.Join(dir, "2016", "2016-05-13")); err != nil {
+		t.Errorf("expected an existing folder to be fine: %v", err)
+	}
+
+	// A file in the way
+	os.WriteFile(filepath.Join(dir, "2017"), nil, 0666)
+	if err := CreateDir(filepath.Join(dir, "2017", "2017-01-01")); err == nil {
+		t.Error("expected an error creating a folder below a file")
+	}
+}
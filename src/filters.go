@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	filepath "path/filepath"
+	"strings"
+	"time"
+)
+
+// photoIgnoreFile Lists patterns of files to leave out in a directory of the input, it applies to subdirectories too
+const photoIgnoreFile = ".photoignore"
+
+// photoIgnorePrivate Starts a line in .photoignore for files that are archived but not published
+const photoIgnorePrivate = "private:"
+
+// unpublishedFiles Source files matched by a private: line in a .photoignore, filled in by addFilesToMap
+var unpublishedFiles = make(map[string]bool)
+
+// Filter Rules selecting files by name, size, rating, tags and date. An empty filter matches everything.
+type Filter struct {
+	Include      []string `yaml:"include" toml:"include"` // file name patterns, eg. *.jpg
+	Exclude      []string `yaml:"exclude" toml:"exclude"`
+	MinWidth     int      `yaml:"min_width" toml:"min_width"` // in pixels, sizes are only checked for photos
+	MinHeight    int      `yaml:"min_height" toml:"min_height"`
+	MaxWidth     int      `yaml:"max_width" toml:"max_width"`
+	MaxHeight    int      `yaml:"max_height" toml:"max_height"`
+	MinRating    int      `yaml:"min_rating" toml:"min_rating"`       // stars set in a photo manager
+	Tags         []string `yaml:"tags" toml:"tags"`                   // only files with one of these tags
+	ExcludeTags  []string `yaml:"exclude_tags" toml:"exclude_tags"`   // eg. private
+	Dates        []string `yaml:"dates" toml:"dates"`                 // only files taken in these years, dates or ranges
+	ExcludeDates []string `yaml:"exclude_dates" toml:"exclude_dates"` // eg. 2016-05-13:2016-05-20
+}
+
+// usesInfo Checks whether the filter needs the metadata of a file, which is slow to read
+func (f Filter) usesInfo() bool {
+	return f.MinWidth > 0 || f.MinHeight > 0 || f.MaxWidth > 0 || f.MaxHeight > 0 || f.MinRating > 0 || len(f.Tags) > 0 || len(f.ExcludeTags) > 0
+}
+
+// IsEmpty Checks whether the filter matches everything
+func (f Filter) IsEmpty() bool {
+	return !f.usesInfo() && len(f.Include) == 0 && len(f.Exclude) == 0 && len(f.Dates) == 0 && len(f.ExcludeDates) == 0
+}
+
+// Matches Checks a file taken on a date against the rules
+func (f Filter) Matches(fileName string, date time.Time, info PhotoInfo) bool {
+	if matchAny(f.Exclude, fileName) || (len(f.Include) > 0 && !matchAny(f.Include, fileName)) {
+		return false
+	}
+	if info.Width > 0 && ((f.MinWidth > 0 && info.Width < f.MinWidth) || (f.MaxWidth > 0 && info.Width > f.MaxWidth)) {
+		return false
+	}
+	if info.Height > 0 && ((f.MinHeight > 0 && info.Height < f.MinHeight) || (f.MaxHeight > 0 && info.Height > f.MaxHeight)) {
+		return false
+	}
+	if f.MinRating > 0 && info.Rating < f.MinRating {
+		return false
+	}
+	if hasAnyTag(info.Tags, f.ExcludeTags) || (len(f.Tags) > 0 && !hasAnyTag(info.Tags, f.Tags)) {
+		return false
+	}
+	// Ranges are parsed as dates in UTC, so compare the day rather than the time
+	day, _ := time.Parse("2006-01-02", date.Format("2006-01-02"))
+	if inAnyDateRange(f.ExcludeDates, day) || (len(f.Dates) > 0 && !inAnyDateRange(f.Dates, day)) {
+		return false
+	}
+	return true
+}
+
+// validate Checks the ratings and date ranges of a filter
+func (f Filter) validate(name string) error {
+	if f.MinRating < 0 || f.MinRating > 5 {
+		return fmt.Errorf("%s: minimum rating %d needs to be between 0 and 5 stars", name, f.MinRating)
+	}
+	for _, target := range append(append([]string{}, f.Dates...), f.ExcludeDates...) {
+		if _, err := parseDateRange(target); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// hasAnyTag Case insensitive check for any of the wanted tags
+func hasAnyTag(tags, wanted []string) bool {
+	for _, tag := range tags {
+		for _, w := range wanted {
+			if strings.EqualFold(tag, w) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// inAnyDateRange Checks whether a date is in any of the ranges, invalid ranges are caught by validate
+func inAnyDateRange(targets []string, date time.Time) bool {
+	for _, target := range targets {
+		if dates, err := parseDateRange(target); err == nil && dates.Contains(date) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterInfo Reads the metadata of a file when the archive or publish rules need it
+func filterInfo(fileName string) PhotoInfo {
+	if cfg.Archive.usesInfo() || cfg.Publish.usesInfo() {
+		return ReadPhotoInfo(fileName)
+	}
+	return PhotoInfo{}
+}
+
+// isArchived Checks whether a file is uploaded to the bucket
+func isArchived(fileName string, date time.Time, info PhotoInfo) bool {
+	return cfg.Archive.Matches(fileName, date, info)
+}
+
+// isPublished Checks whether a file is shown on the website, rather than only archived or left out
+func isPublished(fileName string, date time.Time, info PhotoInfo) bool {
+	return isArchived(fileName, date, info) && !unpublishedFiles[fileName] && cfg.Publish.Matches(fileName, date, info)
+}
+
+// photoIgnore Patterns from the .photoignore files of a directory and its parents
+type photoIgnore struct {
+	ignored []string // left out completely
+	private []string // archived but not published
+}
+
+// loadPhotoIgnore Adds the patterns in a directory's .photoignore to the ones inherited from its parents.
+// Each line is a file or directory name pattern, private: in front of it only keeps the matches off the website.
+// Lines starting with # are comments.
+func loadPhotoIgnore(dirName string, parent photoIgnore) photoIgnore {
+	file, err := os.Open(filepath.Join(dirName, photoIgnoreFile))
+	if err != nil {
+		return parent
+	}
+	defer file.Close()
+
+	// Copied so sibling directories don't see each other's patterns
+	rules := photoIgnore{append([]string{}, parent.ignored...), append([]string{}, parent.private...)}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(strings.TrimSpace(scanner.Text()), "/")
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, photoIgnorePrivate) {
+			rules.private = append(rules.private, strings.TrimSpace(strings.TrimPrefix(line, photoIgnorePrivate)))
+		} else {
+			rules.ignored = append(rules.ignored, line)
+		}
+	}
+	return rules
+}
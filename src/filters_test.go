@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	filepath "path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFilterMatches(t *testing.T) {
+	photo := PhotoInfo{Width: 4000, Height: 3000, Rating: 3, Tags: []string{"Beach", "family"}}
+	date := day(2016, 5, 13)
+	for _, test := range []struct {
+		name     string
+		filter   Filter
+		info     PhotoInfo
+		expected bool
+	}{
+		{"empty", Filter{}, photo, true},
+		{"include", Filter{Include: []string{"*.JPG"}}, photo, true},
+		{"exclude", Filter{Exclude: []string{"img_*"}}, photo, false},
+		{"min width", Filter{MinWidth: 5000}, photo, false},
+		{"max height", Filter{MaxHeight: 3000}, photo, true},
+		{"unknown size", Filter{MinWidth: 5000}, PhotoInfo{}, true},
+		{"rating", Filter{MinRating: 4}, photo, false},
+		{"tags", Filter{Tags: []string{"beach"}}, photo, true},
+		{"missing tag", Filter{Tags: []string{"work"}}, photo, false},
+		{"excluded tag", Filter{ExcludeTags: []string{"Family"}}, photo, false},
+		{"year", Filter{Dates: []string{"2016"}}, photo, true},
+		{"other year", Filter{Dates: []string{"2017"}}, photo, false},
+		{"excluded range", Filter{ExcludeDates: []string{"2016-05-12:2016-05-13"}}, photo, false},
+	} {
+		if matched := test.filter.Matches("IMG_0001.jpg", date, test.info); matched != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, matched)
+		}
+	}
+	if err := (Filter{Dates: []string{"May 2016"}}).validate("publish"); err == nil {
+		t.Error("expected an invalid date range to be rejected")
+	}
+}
+
+func TestPhotoIgnore(t *testing.T) {
+	setupProcess(t)
+	inDir := t.TempDir()
+	createFixtures(t, inDir, []fixture{
+		{"IMG_0001.jpg", day(2016, 5, 13)},
+		{"IMG_0001_edited.jpg", day(2016, 5, 13)},
+		{"family/IMG_0002.jpg", day(2016, 5, 13)},
+		{"family/kids/IMG_0003.jpg", day(2016, 5, 14)},
+		{"screenshots/IMG_0004.jpg", day(2016, 5, 14)},
+	})
+	os.WriteFile(filepath.Join(inDir, ".photoignore"), []byte("# edits are exported again\n*_edited.jpg\nscreenshots/\nprivate: family/\n"), 0666)
+
+	fileMap := make(map[string][]string)
+	addFilesToMap(inDir, fileMap)
+	var files []string
+	for _, dateFiles := range fileMap {
+		for _, fileName := range dateFiles {
+			rel, _ := filepath.Rel(inDir, fileName)
+			files = append(files, filepath.ToSlash(rel))
+		}
+	}
+	if len(files) != 3 || strings.Contains(strings.Join(files, ","), "edited") || strings.Contains(strings.Join(files, ","), "IMG_0004") {
+		t.Errorf("expected the ignored files to be skipped, got %v", files)
+	}
+	if unpublishedFiles[filepath.Join(inDir, "IMG_0001.jpg")] || !unpublishedFiles[filepath.Join(inDir, "family", "kids", "IMG_0003.jpg")] {
+		t.Errorf("expected everything in the private folder to be unpublished, got %v", unpublishedFiles)
+	}
+}
+
+func TestArchiveWithoutPublishing(t *testing.T) {
+	fake := setupProcess(t)
+	cfg.Publish.Dates = []string{"2017"}
+	inDir := t.TempDir()
+	createFixtures(t, inDir, []fixture{{"IMG_0001.jpg", day(2016, 5, 13)}, {"IMG_0004.jpg", day(2017, 1, 1)}})
+
+	process(fake, inDir, "", testBucket)
+
+	keys := fake.Keys(testBucket)
+	if !strings.Contains(strings.Join(keys, "\n"), "originals/2016/2016-05-13/IMG_0001.jpg") {
+		t.Errorf("expected the 2016 photo to be archived privately, got %v", keys)
+	}
+	for _, key := range keys {
+		if strings.HasPrefix(key, "2016/") {
+			t.Errorf("expected nothing published for 2016, got %s", key)
+		}
+	}
+	if strings.Contains(string(fake.Object(testBucket, "search.json")), "IMG_0001") {
+		t.Error("expected the archived photo to be left out of the search index")
+	}
+
+	// Restoring brings back what was archived too
+	jobs, err := getRestoreJobs(fake, testBucket, nil, t.TempDir())
+	if err != nil || len(jobs) != 2 {
+		t.Errorf("expected to restore both photos, got %v: %v", jobs, err)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// geoPoint A GeoJSON point, coordinates are longitude then latitude
+type geoPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+// geoProperties What the map shows for a photo
+type geoProperties struct {
+	Date  string `json:"date"`
+	Name  string `json:"name"`
+	Thumb string `json:"thumb,omitempty"` // relative to the root of the bucket unless presigned
+	Page  string `json:"page"`            // day page opening the photo, relative to the root of the bucket
+}
+
+// geoFeature A photo with a location in geo.json
+type geoFeature struct {
+	Type       string        `json:"type"`
+	Geometry   geoPoint      `json:"geometry"`
+	Properties geoProperties `json:"properties"`
+}
+
+// geoCollection Contents of geo.json, a GeoJSON FeatureCollection of every photo with a location
+type geoCollection struct {
+	Type     string       `json:"type"`
+	Features []geoFeature `json:"features"`
+}
+
+// updateGeo Replaces the photos of a date in geo.json with the located ones in info, the map page is
+// uploaded along with it
+func updateGeo(svc s3iface.S3API, bucketName string, date time.Time, fileNames []string, info map[string]PhotoInfo, thumbs map[string]string) {
+	collection := geoCollection{Type: "FeatureCollection"}
+	var oldJSON []byte
+	if reader := GetFromS3(svc, "geo.json", bucketName); reader != nil {
+		json.NewDecoder(reader).Decode(&collection)
+		oldJSON, _ = json.Marshal(collection)
+	}
+
+	dateName := date.Format("2006-01-02")
+	folderName := date.Format("2006/2006-01-02/")
+	features := []geoFeature{}
+	for _, feature := range collection.Features {
+		if feature.Properties.Date != dateName {
+			features = append(features, feature)
+		}
+	}
+	for _, fileName := range fileNames {
+		photo := info[fileName]
+		if photo.Lat == nil || photo.Lon == nil {
+			continue
+		}
+		properties := geoProperties{Date: dateName, Name: fileName, Page: folderName + "index.html#" + fileName}
+		if !cfg.DisableThumbnails {
+			properties.Thumb = thumbs[fileName]
+		}
+		features = append(features, geoFeature{
+			Type:       "Feature",
+			Geometry:   geoPoint{Type: "Point", Coordinates: [2]float64{*photo.Lon, *photo.Lat}},
+			Properties: properties,
+		})
+	}
+	sort.SliceStable(features, func(i, j int) bool {
+		if features[i].Properties.Date != features[j].Properties.Date {
+			return features[i].Properties.Date < features[j].Properties.Date
+		}
+		return features[i].Properties.Name < features[j].Properties.Name
+	})
+	collection.Type, collection.Features = "FeatureCollection", features
+
+	geoJSON, _ := json.Marshal(collection)
+	if string(geoJSON) == string(oldJSON) {
+		return
+	}
+	UploadToS3(svc, "geo.json", bucketName, geoJSON, int64(len(geoJSON)), true)
+	uploadPage(svc, bucketName, "map.html", pageData{Page: "map", Title: cfg.Title(), Back: "index.html", Assets: assetsPrefix})
+}
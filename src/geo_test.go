@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestUpdateGeo(t *testing.T) {
+	fake := setupProcess(t)
+	lat, lon := 35.0116, 135.7681
+	located := map[string]PhotoInfo{"IMG_0001.jpg": {Lat: &lat, Lon: &lon}}
+
+	updateGeo(fake, testBucket, day(2016, time.May, 14), []string{"IMG_0001.jpg"}, located, nil)
+	thumbs := map[string]string{"IMG_0001.jpg": thumbKey("2016/2016-05-13/IMG_0001.jpg")}
+	updateGeo(fake, testBucket, day(2016, time.May, 13), []string{"IMG_0001.jpg", "IMG_0002.jpg"}, located, thumbs)
+	var collection geoCollection
+	json.Unmarshal(fake.Object(testBucket, "geo.json"), &collection)
+	if len(collection.Features) != 2 || collection.Features[0].Properties.Date != "2016-05-13" {
+		t.Fatalf("expected a photo on each date, got %+v", collection)
+	}
+	feature := collection.Features[0]
+	if feature.Geometry.Coordinates != [2]float64{lon, lat} || feature.Properties.Page != "2016/2016-05-13/index.html#IMG_0001.jpg" ||
+		feature.Properties.Thumb != "_renditions/2016/2016-05-13/IMG_0001.jpg/thumb.jpg" {
+		t.Errorf("unexpected feature: %+v", feature)
+	}
+	if fake.Object(testBucket, "map.html") == nil {
+		t.Error("expected the map page to be uploaded")
+	}
+
+	// Photos that lost their location are dropped, nothing is uploaded if geo.json doesn't change
+	updateGeo(fake, testBucket, day(2016, time.May, 14), []string{"IMG_0001.jpg"}, nil, nil)
+	fake.ResetPuts()
+	updateGeo(fake, testBucket, day(2016, time.May, 14), []string{"IMG_0001.jpg"}, nil, nil)
+	json.Unmarshal(fake.Object(testBucket, "geo.json"), &collection)
+	if len(collection.Features) != 1 || len(fake.puts) != 0 {
+		t.Errorf("expected only 2016-05-13 to be left without uploading again, got %+v and %v", collection, fake.puts)
+	}
+}
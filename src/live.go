@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	filepath "path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// livePairs Photo and movie source files of Live Photos keyed both ways, filled in by addFilesToMap
+var livePairs = make(map[string]string)
+
+// liveSuffix Goes between the name of a photo and the extension of its Live Photo movie, eg. IMG_1234.live.MOV
+const liveSuffix = ".live"
+
+// motionSuffix Names the movie extracted from a motion photo, eg. IMG_1234.motion.mp4
+const motionSuffix = ".motion.mp4"
+
+// liveMaxDuration Longest movie paired with a photo without Apple's content identifier, Live Photos last about
+// 3 seconds
+const liveMaxDuration = 4 * time.Second
+
+// appleContentID Metadata iPhones write into both halves of a Live Photo to tie them together
+const appleContentID = "com.apple.quicktime.content.identifier"
+
+// pairLivePhotos Pairs the photos (jpeg or HEIC) and movies of a directory sharing a name, the way iPhones export
+// Live Photos.
+// Only movies that look like the movie of a Live Photo are paired, so an ordinary clip named after a photo
+// is still listed on its own.
+func pairLivePhotos(fileNames []string) {
+	photos := make(map[string]string)
+	for _, fileName := range fileNames {
+		if IsJpeg(fileName) || IsHeic(fileName) {
+			photos[strings.ToLower(strings.TrimSuffix(fileName, filepath.Ext(fileName)))] = fileName
+		}
+	}
+	for _, fileName := range fileNames {
+		if !IsMovie(fileName) {
+			continue
+		}
+		if photo, ok := photos[strings.ToLower(strings.TrimSuffix(fileName, filepath.Ext(fileName)))]; ok && isLiveCandidate(fileName) {
+			livePairs[photo], livePairs[fileName] = fileName, photo
+		}
+	}
+}
+
+// isLiveCandidate Checks whether a movie could be the movie of a Live Photo: it carries Apple's content
+// identifier, or it is only a few seconds long
+func isLiveCandidate(fileName string) bool {
+	moov := readMovieHeader(fileName)
+	if bytes.Contains(moov, []byte(appleContentID)) {
+		return true
+	}
+	duration, ok := movieDuration(moov)
+	return ok && duration <= liveMaxDuration
+}
+
+// movieDuration Reads the duration of a movie from the mvhd box in its moov box
+func movieDuration(moov []byte) (time.Duration, bool) {
+	index := bytes.Index(moov, []byte("mvhd"))
+	if index < 0 {
+		return 0, false
+	}
+	// A version byte and flags, then the creation and modification times, timescale and duration
+	mvhd := moov[index+4:]
+	var timescale, duration uint64
+	switch {
+	case len(mvhd) >= 20 && mvhd[0] == 0:
+		timescale, duration = uint64(binary.BigEndian.Uint32(mvhd[12:])), uint64(binary.BigEndian.Uint32(mvhd[16:]))
+	case len(mvhd) >= 32 && mvhd[0] == 1:
+		timescale, duration = uint64(binary.BigEndian.Uint32(mvhd[20:])), binary.BigEndian.Uint64(mvhd[24:])
+	default:
+		return 0, false
+	}
+	if timescale == 0 {
+		return 0, false
+	}
+	return time.Duration(float64(duration) / float64(timescale) * float64(time.Second)), true
+}
+
+// isLiveMovie Checks whether a source file is the movie of a Live Photo, which is shown with its photo
+func isLiveMovie(fileName string) bool {
+	_, ok := livePairs[fileName]
+	return ok && IsMovie(fileName)
+}
+
+// isHeicOnly Checks whether a source file is a HEIC photo or the movie of one, the website can't show them so
+// they are only archived
+func isHeicOnly(fileName string) bool {
+	return IsHeic(fileName) || IsHeic(livePairs[fileName])
+}
+
+// liveName Gets the name a Live Photo movie is stored as, next to its photo
+func liveName(photoFile, movieFile string) string {
+	photoName := strings.Replace(filepath.Base(photoFile), " ", "", -1)
+	return strings.TrimSuffix(photoName, filepath.Ext(photoName)) + liveSuffix + filepath.Ext(movieFile)
+}
+
+// IsLiveVideo Checks whether a key is the movie of a Live Photo
+func IsLiveVideo(key string) bool {
+	return IsMovie(key) && strings.HasSuffix(strings.ToLower(strings.TrimSuffix(key, filepath.Ext(key))), liveSuffix)
+}
+
+// IsMotionClip Checks whether a key is the movie extracted from a motion photo
+func IsMotionClip(key string) bool {
+	return strings.HasSuffix(strings.ToLower(key), motionSuffix)
+}
+
+// IsCompanion Checks whether a key is stored alongside a photo rather than listed on its own: a sidecar or movie
+func IsCompanion(key string) bool {
+	return IsSidecar(key) || IsLiveVideo(key) || IsMotionClip(key)
+}
+
+// mp4Brands Major brands of the MP4 files phones embed in motion photos
+var mp4Brands = []string{"mp42", "mp41", "isom", "iso2", "avc1", "qt  "}
+
+// extractMotionVideo Finds the MP4 that Samsung and Pixel phones append to the jpeg of a motion photo,
+// nil if there is none. The end is found by walking its boxes, as Samsung adds a trailer after it.
+func extractMotionVideo(data []byte) []byte {
+	for offset := 0; ; {
+		index := bytes.Index(data[offset:], []byte("ftyp"))
+		if index < 0 {
+			return nil
+		}
+		start := offset + index - 4
+		offset += index + 4
+		if start < 0 || start+12 > len(data) {
+			continue
+		}
+		brand := string(data[start+8 : start+12])
+		known := false
+		for _, b := range mp4Brands {
+			known = known || brand == b
+		}
+		if !known {
+			continue
+		}
+
+		end := start
+		for end+8 <= len(data) {
+			size := int(binary.BigEndian.Uint32(data[end:]))
+			if size == 1 && end+16 <= len(data) {
+				size = int(binary.BigEndian.Uint64(data[end+8:])) // 64 bit size
+			} else if size == 0 {
+				size = len(data) - end // the last box runs to the end of the file
+			}
+			if size < 8 || end+size > len(data) {
+				break
+			}
+			end += size
+		}
+		// A movie needs more than the ftyp box
+		if end-start > int(binary.BigEndian.Uint32(data[start:])) {
+			return data[start:end]
+		}
+	}
+}
+
+// uploadMotionClip Extracts the movie of a motion photo and uploads it next to the photo, stripped like the photo
+// would be. Returns the name it was uploaded as, empty if the photo has no movie.
+func uploadMotionClip(svc s3iface.S3API, sourceFile, tmpDir, outPath, fileName, bucketName, policy string) (string, error) {
+	data, err := os.ReadFile(sourceFile)
+	if err != nil {
+		return "", err
+	}
+	clip := extractMotionVideo(data)
+	if clip == nil {
+		return "", nil
+	}
+	clipName := strings.TrimSuffix(fileName, filepath.Ext(fileName)) + motionSuffix
+	if policy != PrivacyKeep {
+		clipFile := filepath.Join(tmpDir, clipName)
+		if err := os.WriteFile(clipFile, clip, 0666); err != nil {
+			return "", err
+		}
+		defer os.Remove(clipFile)
+		stripped, err := stripFile(clipFile, tmpDir, policy)
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(stripped)
+		if clip, err = os.ReadFile(stripped); err != nil {
+			return "", err
+		}
+	}
+	UploadToS3(svc, outPath+"/"+clipName, bucketName, clip, int64(len(clip)), cfg.Overwrite)
+	log.Info("Extracted the movie of motion photo ", sourceFile)
+	return clipName, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	filepath "path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mp4Box Builds a box with a size, type and payload
+func mp4Box(boxType string, payload []byte) []byte {
+	box := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(box, uint32(8+len(payload)))
+	copy(box[4:], boxType)
+	return append(box, payload...)
+}
+
+// testMotionVideo A tiny MP4 as phones append it to motion photos
+func testMotionVideo() []byte {
+	movie := mp4Box("ftyp", []byte("mp42\x00\x00\x00\x00isommp42"))
+	movie = append(movie, mp4Box("moov", make([]byte, 16))...)
+	return append(movie, mp4Box("mdat", []byte("not really a movie"))...)
+}
+
+// testHEIC A HEIC photo with only the boxes holding its EXIF block, taken from the jpeg testJPEGWithGPS creates
+func testHEIC(t *testing.T) []byte {
+	photo := testJPEGWithGPS(t)
+	start := bytes.Index(photo, []byte("Exif\x00\x00"))
+	end := start + int(binary.BigEndian.Uint16(photo[start-2:])) - 2 // the segment length includes itself
+	// The infe box naming the Exif item comes first, the item itself is in the mdat box after an offset
+	heic := mp4Box("ftyp", []byte("heic\x00\x00\x00\x00mif1heic"))
+	heic = append(heic, mp4Box("meta", mp4Box("infe", []byte("\x02\x00\x00\x00\x00\x01\x00\x00Exif\x00")))...)
+	return append(heic, mp4Box("mdat", append([]byte{0, 0, 0, 0}, photo[start:end]...))...)
+}
+
+// testLiveVideo A movie with only the header giving its duration
+func testLiveVideo(seconds uint32) []byte {
+	mvhd := make([]byte, 20)
+	binary.BigEndian.PutUint32(mvhd[12:], 600) // timescale
+	binary.BigEndian.PutUint32(mvhd[16:], seconds*600)
+	movie := mp4Box("ftyp", []byte("qt  \x00\x00\x00\x00qt  "))
+	movie = append(movie, mp4Box("mdat", []byte("not really a movie"))...)
+	return append(movie, mp4Box("moov", mp4Box("mvhd", mvhd))...)
+}
+
+func TestExtractMotionVideo(t *testing.T) {
+	movie := testMotionVideo()
+	photo := append([]byte("\xff\xd8 a jpeg mentioning ftyp in passing \xff\xd9"), movie...)
+	if extracted := extractMotionVideo(append(photo, []byte("SEFT trailer")...)); string(extracted) != string(movie) {
+		t.Errorf("expected the movie without the trailer, got %q", extracted)
+	}
+	if extractMotionVideo([]byte("\xff\xd8 just a photo \xff\xd9")) != nil {
+		t.Error("expected no movie in a plain photo")
+	}
+}
+
+func TestLivePhotos(t *testing.T) {
+	fake := setupProcess(t)
+	inDir := t.TempDir()
+	createFixtures(t, inDir, []fixture{{"IMG_0001.jpg", day(2016, 5, 13)}, {"IMG_0002.jpg", day(2016, 5, 13)}})
+	// The movie is only stored, so it doesn't need to be a real one
+	os.WriteFile(filepath.Join(inDir, "IMG_0001.MOV"), testLiveVideo(3), 0666)
+	// Motion photos carry their movie at the end of the jpeg
+	photo, _ := os.ReadFile(filepath.Join(inDir, "IMG_0002.jpg"))
+	os.WriteFile(filepath.Join(inDir, "IMG_0002.jpg"), append(photo, testMotionVideo()...), 0666)
+	os.Chtimes(filepath.Join(inDir, "IMG_0002.jpg"), day(2016, 5, 13), day(2016, 5, 13))
+	cfg.MotionPhotos = true
+
+	process(fake, inDir, "", testBucket)
+
+	keys := strings.Join(fake.Keys(testBucket), "\n")
+	for _, key := range []string{"2016/2016-05-13/IMG_0001.live.MOV", "2016/2016-05-13/IMG_0002.motion.mp4"} {
+		if !strings.Contains(keys, key) {
+			t.Errorf("expected %s to be uploaded, got\n%s", key, keys)
+		}
+	}
+	if strings.Contains(keys, thumbKey("2016/2016-05-13/IMG_0001.live.MOV")) {
+		t.Error("expected no thumbnail for the movie of a Live Photo")
+	}
+	index := string(fake.Object(testBucket, "2016/2016-05-13/photos.json"))
+	if !strings.Contains(index, `"live":"IMG_0001.live.MOV"`) || !strings.Contains(index, `"live":"IMG_0002.motion.mp4"`) {
+		t.Errorf("expected the photos to point at their movies, got %s", index)
+	}
+	if strings.Contains(index, `"IMG_0001.live.MOV",`) || strings.Contains(index, `"IMG_0001.live.MOV"]`) {
+		t.Errorf("expected the movie not to be listed on its own, got %s", index)
+	}
+
+	// The movies are listed with their photos, not on their own
+	report, err := verify(fake, testBucket, "", false, false, 1)
+	if err != nil || report.Total() != 0 {
+		t.Errorf("expected verify to find nothing wrong, got %+v: %v", report, err)
+	}
+}
+
+func TestPairLivePhotos(t *testing.T) {
+	setupProcess(t)
+	inDir := t.TempDir()
+	files := map[string][]byte{
+		"IMG_0001.jpg": nil, "IMG_0001.MOV": testLiveVideo(3),
+		"clip.jpg": nil, "clip.mp4": testLiveVideo(60),
+		"IMG_0002.jpg": nil, "IMG_0002.MOV": append(mp4Box("ftyp", []byte("qt  ")), mp4Box("moov", mp4Box("keys", []byte(appleContentID)))...),
+	}
+	var fileNames []string
+	for name, data := range files {
+		fileNames = append(fileNames, filepath.Join(inDir, name))
+		os.WriteFile(filepath.Join(inDir, name), data, 0666)
+	}
+	pairLivePhotos(fileNames)
+
+	if !isLiveMovie(filepath.Join(inDir, "IMG_0001.MOV")) {
+		t.Error("expected a short movie to be paired with its photo")
+	}
+	if isLiveMovie(filepath.Join(inDir, "clip.mp4")) {
+		t.Error("expected a long movie named after a photo to stay on its own")
+	}
+	if !isLiveMovie(filepath.Join(inDir, "IMG_0002.MOV")) {
+		t.Error("expected a movie with Apple's content identifier to be paired with its photo")
+	}
+}
+
+func TestHeicLivePhotos(t *testing.T) {
+	fake := setupProcess(t)
+	inDir := t.TempDir()
+	os.WriteFile(filepath.Join(inDir, "IMG_0001.HEIC"), testHEIC(t), 0666)
+	os.WriteFile(filepath.Join(inDir, "IMG_0001.MOV"), testLiveVideo(3), 0666)
+	// The movie follows the date of its photo
+	movieDate := day(2016, time.May, 14)
+	os.Chtimes(filepath.Join(inDir, "IMG_0001.MOV"), movieDate, movieDate)
+
+	if date := GetDateTaken(filepath.Join(inDir, "IMG_0001.HEIC")); !date.Equal(time.Date(2016, time.May, 13, 9, 30, 0, 0, time.Local)) {
+		t.Errorf("expected the date taken from the EXIF block, got %v", date)
+	}
+
+	// The website can't show HEIC, so both are only archived, side by side
+	process(fake, inDir, "", testBucket)
+	expected := []string{"originals/2016/2016-05-13/IMG_0001.HEIC", "originals/2016/2016-05-13/IMG_0001.live.MOV"}
+	var archived []string
+	for _, key := range fake.Keys(testBucket) {
+		if strings.HasPrefix(key, "2016/") || IsRendition(key) && key != renditionsManifest {
+			t.Errorf("expected nothing to be published, got %s", key)
+		}
+		if strings.HasPrefix(key, cfg.OriginalsPrefix) {
+			archived = append(archived, key)
+		}
+	}
+	if strings.Join(archived, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v to be archived, got %v", expected, archived)
+	}
+
+	report, err := verify(fake, testBucket, "", false, false, 1)
+	if err != nil || report.Total() != 0 {
+		t.Errorf("expected verify to find nothing wrong, got %+v: %v", report, err)
+	}
+	outDir := t.TempDir()
+	if err := restore(fake, testBucket, nil, outDir, 1); err != nil {
+		t.Fatal(err)
+	}
+	for _, fileName := range []string{"IMG_0001.HEIC", "IMG_0001.live.MOV"} {
+		if _, err := os.Stat(filepath.Join(outDir, "2016", "2016-05-13", fileName)); err != nil {
+			t.Errorf("expected %s to be restored: %v", fileName, err)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"html"
+	"image"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+// PhotoInfo Metadata recorded while processing a photo or movie, shown in the viewer's info panel
+type PhotoInfo struct {
+	Taken       string   `json:"taken,omitempty"` // local time the photo was taken, 2006-01-02T15:04:05
+	Width       int      `json:"width,omitempty"`
+	Height      int      `json:"height,omitempty"`
+	Camera      string   `json:"camera,omitempty"`
+	Lens        string   `json:"lens,omitempty"`
+	Exposure    string   `json:"exposure,omitempty"` // shutter speed, eg. 1/125
+	Aperture    float64  `json:"aperture,omitempty"`
+	ISO         int      `json:"iso,omitempty"`
+	FocalLength float64  `json:"focal_length,omitempty"` // in mm
+	Lat         *float64 `json:"lat,omitempty"`
+	Lon         *float64 `json:"lon,omitempty"`
+	Faces       int      `json:"faces,omitempty"` // face regions tagged by a photo manager, used to pick covers
+	Caption     string   `json:"caption,omitempty"`
+	Tags        []string `json:"tags,omitempty"`      // keywords added in a photo manager
+	Place       string   `json:"place,omitempty"`     // closest place in the gazetteer
+	Rating      int      `json:"rating,omitempty"`    // stars from 1 to 5, -1 for rejected photos
+	Label       string   `json:"label,omitempty"`     // colour label, eg. Red
+	Hash        string   `json:"hash,omitempty"`      // perceptual hash used to find near-duplicates
+	Sharpness   float64  `json:"sharpness,omitempty"` // blur score, the sharpest photo of a burst is its cover
+	Stack       string   `json:"stack,omitempty"`     // cover of the burst the photo is part of
+	Live        string   `json:"live,omitempty"`      // movie of a Live Photo or motion photo, stored next to it
+}
+
+// photoInfo Metadata of the files processed in this run keyed by S3 key, written to photos.json with the folder
+var photoInfo = make(map[string]PhotoInfo)
+
+// ReadPhotoInfo Reads the metadata of a photo or movie, files without exif data only get the date taken.
+// What is set in an XMP sidecar takes precedence over what is embedded in the file.
+func ReadPhotoInfo(fileName string) PhotoInfo {
+	info := readFileInfo(fileName)
+	if sidecar := FindSidecar(fileName); len(sidecar) > 0 {
+		if xmp, err := os.ReadFile(sidecar); err == nil {
+			applyXMP(&info, xmp)
+		}
+	}
+	return info
+}
+
+// readFileInfo Reads the metadata embedded in a photo or movie
+func readFileInfo(fileName string) PhotoInfo {
+	info := PhotoInfo{Taken: GetDateTaken(fileName).Format("2006-01-02T15:04:05")}
+	if IsMovie(fileName) {
+		info.Lat, info.Lon = movieLocation(readMovieHeader(fileName))
+		return info
+	}
+	if !IsJpeg(fileName) {
+		return info
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return info
+	}
+	defer file.Close()
+	if config, _, err := image.DecodeConfig(file); err == nil {
+		info.Width, info.Height = config.Width, config.Height
+	}
+
+	file.Seek(0, 0)
+	applyXMP(&info, readXMP(file))
+
+	file.Seek(0, 0)
+	data, err := exif.Decode(file)
+	if err != nil {
+		return info
+	}
+
+	cameraMake, model := exifString(data, exif.Make), exifString(data, exif.Model)
+	// Most cameras already start the model with the make
+	if len(cameraMake) > 0 && !strings.HasPrefix(strings.ToLower(model), strings.ToLower(cameraMake)) {
+		model = strings.TrimSpace(cameraMake + " " + model)
+	}
+	info.Camera = model
+	if len(info.Caption) == 0 {
+		info.Caption = exifString(data, exif.ImageDescription)
+	}
+	info.Lens = exifString(data, exif.LensModel)
+	if tag, err := data.Get(exif.ExposureTime); err == nil {
+		if num, den, err := tag.Rat2(0); err == nil && num > 0 && den > 0 {
+			info.Exposure = formatExposure(num, den)
+		}
+	}
+	info.Aperture = exifFloat(data, exif.FNumber)
+	info.FocalLength = exifFloat(data, exif.FocalLength)
+	if tag, err := data.Get(exif.ISOSpeedRatings); err == nil {
+		info.ISO, _ = tag.Int(0)
+	}
+	if lat, lon, err := data.LatLong(); err == nil && !math.IsNaN(lat) && !math.IsNaN(lon) && (lat != 0 || lon != 0) {
+		info.Lat, info.Lon = &lat, &lon
+	}
+	return info
+}
+
+// maxMovieHeader Largest moov box read, it only holds the metadata and sample tables
+const maxMovieHeader = 64 << 20
+
+// readMovieHeader Reads the moov box of an MP4 or QuickTime movie, which can be at either end of the file.
+// Returns nil if there is none.
+func readMovieHeader(fileName string) []byte {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var offset int64
+	header := make([]byte, 16)
+	for {
+		// Each box starts with a big endian size that includes the header, 1 means a 64 bit size follows
+		if _, err := file.ReadAt(header[:8], offset); err != nil {
+			return nil
+		}
+		size, headerSize := int64(binary.BigEndian.Uint32(header)), int64(8)
+		if size == 1 {
+			if _, err := file.ReadAt(header[8:], offset+8); err != nil {
+				return nil
+			}
+			size, headerSize = int64(binary.BigEndian.Uint64(header[8:])), 16
+		}
+		if size < headerSize {
+			return nil // 0 runs to the end of the file
+		}
+		if string(header[4:8]) == "moov" {
+			if size > maxMovieHeader {
+				return nil
+			}
+			moov := make([]byte, size-headerSize)
+			if _, err := file.ReadAt(moov, offset+headerSize); err != nil {
+				return nil
+			}
+			return moov
+		}
+		offset += size
+	}
+}
+
+// iso6709 Matches the location phones store in movies, eg. +51.5007-000.1246+010.000/
+var iso6709 = regexp.MustCompile(`([+-]\d{2}\.\d+)([+-]\d{3}\.\d+)(?:[+-]\d+(?:\.\d+)?)?/`)
+
+// movieLocation Finds the location in the moov box of a movie, from either the ©xyz user data written by most
+// phones or the com.apple.quicktime.location.ISO6709 metadata written by iPhones
+func movieLocation(moov []byte) (*float64, *float64) {
+	matches := iso6709.FindSubmatch(moov)
+	if matches == nil {
+		return nil, nil
+	}
+	lat, latErr := strconv.ParseFloat(string(matches[1]), 64)
+	lon, lonErr := strconv.ParseFloat(string(matches[2]), 64)
+	if latErr != nil || lonErr != nil || math.Abs(lat) > 90 || math.Abs(lon) > 180 || (lat == 0 && lon == 0) {
+		return nil, nil
+	}
+	return &lat, &lon
+}
+
+// xmpNamespace Starts the APP1 segment holding XMP data in a jpeg
+const xmpNamespace = "http://ns.adobe.com/xap/1.0/\x00"
+
+// readXMP Gets the XMP packet embedded in a jpeg, empty if there is none
+func readXMP(reader io.Reader) []byte {
+	buffered := bufio.NewReader(reader)
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(buffered, header[:2]); err != nil || header[0] != 0xFF || header[1] != 0xD8 {
+		return nil
+	}
+	for {
+		// Each segment is a marker followed by a big endian length that includes itself
+		if _, err := io.ReadFull(buffered, header); err != nil || header[0] != 0xFF {
+			return nil
+		}
+		marker, length := header[1], int(binary.BigEndian.Uint16(header[2:]))-2
+		if marker == 0xDA || length < 0 {
+			return nil // the image data starts, metadata comes before it
+		}
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(buffered, segment); err != nil {
+			return nil
+		}
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte(xmpNamespace)) {
+			return segment[len(xmpNamespace):]
+		}
+	}
+}
+
+// faceRegionRegExp Matches face regions in the Metadata Working Group schema, as an attribute or element
+var faceRegionRegExp = regexp.MustCompile(`mwg-rs:Type(="Face"|>Face<)`)
+
+// xmpCaptionRegExp Matches the default language description, the caption set by photo managers
+var xmpCaptionRegExp = regexp.MustCompile(`(?s)<dc:description>\s*<rdf:Alt>\s*<rdf:li[^>]*>([^<]*)</rdf:li>`)
+
+// xmpSubjectRegExp Matches the keywords, each is a list item in the bag
+var xmpSubjectRegExp = regexp.MustCompile(`(?s)<dc:subject>(.*?)</dc:subject>`)
+
+var xmpListItemRegExp = regexp.MustCompile(`<rdf:li[^>]*>([^<]*)</rdf:li>`)
+
+// xmpRatingRegExp Matches the star rating, as an attribute or element
+var xmpRatingRegExp = regexp.MustCompile(`xmp:Rating(?:="|>)\s*(-?\d+)`)
+
+// xmpLabelRegExp Matches the colour label, as an attribute or element
+var xmpLabelRegExp = regexp.MustCompile(`xmp:Label(?:="([^"]*)"|>([^<]*)<)`)
+
+// applyXMP Sets the faces, caption, tags, rating and label found in an XMP packet, keeping what it doesn't have
+func applyXMP(info *PhotoInfo, xmp []byte) {
+	if faces := countFaceRegions(xmp); faces > 0 {
+		info.Faces = faces
+	}
+	if caption := xmpCaption(xmp); len(caption) > 0 {
+		info.Caption = caption
+	}
+	if tags := xmpTags(xmp); len(tags) > 0 {
+		info.Tags = tags
+	}
+	if matches := xmpRatingRegExp.FindSubmatch(xmp); matches != nil {
+		info.Rating, _ = strconv.Atoi(string(matches[1]))
+	}
+	if matches := xmpLabelRegExp.FindSubmatch(xmp); matches != nil {
+		if label := strings.TrimSpace(html.UnescapeString(string(matches[1]) + string(matches[2]))); len(label) > 0 {
+			info.Label = label
+		}
+	}
+}
+
+// xmpCaption Gets the caption from an XMP packet
+func xmpCaption(xmp []byte) string {
+	if matches := xmpCaptionRegExp.FindSubmatch(xmp); matches != nil {
+		return strings.TrimSpace(html.UnescapeString(string(matches[1])))
+	}
+	return ""
+}
+
+// xmpTags Gets the keywords from an XMP packet
+func xmpTags(xmp []byte) []string {
+	subject := xmpSubjectRegExp.FindSubmatch(xmp)
+	if subject == nil {
+		return nil
+	}
+	var tags []string
+	for _, item := range xmpListItemRegExp.FindAllSubmatch(subject[1], -1) {
+		if tag := strings.TrimSpace(html.UnescapeString(string(item[1]))); len(tag) > 0 {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// countFaceRegions Counts the faces tagged in an XMP packet by Lightroom, digiKam, Picasa and the like
+func countFaceRegions(xmp []byte) int {
+	return len(faceRegionRegExp.FindAll(xmp, -1))
+}
+
+// exifString Gets a text field, empty if it isn't set
+func exifString(data *exif.Exif, field exif.FieldName) string {
+	tag, err := data.Get(field)
+	if err != nil || tag.Format() != tiff.StringVal {
+		return ""
+	}
+	value, _ := tag.StringVal()
+	return strings.TrimSpace(strings.Trim(value, "\x00"))
+}
+
+// exifFloat Gets a rational field rounded to one decimal, 0 if it isn't set
+func exifFloat(data *exif.Exif, field exif.FieldName) float64 {
+	tag, err := data.Get(field)
+	if err != nil {
+		return 0
+	}
+	num, den, err := tag.Rat2(0)
+	if err != nil || den == 0 {
+		return 0
+	}
+	return math.Round(float64(num)/float64(den)*10) / 10
+}
+
+// formatExposure Formats a shutter speed the way cameras show it, 1/125 or 2.5 for long exposures
+func formatExposure(num, den int64) string {
+	if num >= den {
+		return strings.TrimSuffix(fmt.Sprintf("%.1f", float64(num)/float64(den)), ".0")
+	}
+	return fmt.Sprintf("1/%d", int64(math.Round(float64(den)/float64(num))))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	filepath "path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFormatExposure(t *testing.T) {
+	for _, test := range []struct {
+		num, den int64
+		expected string
+	}{
+		{1, 125, "1/125"},
+		{10, 1250, "1/125"},
+		{1, 3, "1/3"},
+		{1, 1, "1"},
+		{5, 2, "2.5"},
+		{30, 1, "30"},
+	} {
+		if exposure := formatExposure(test.num, test.den); exposure != test.expected {
+			t.Errorf("formatExposure(%d, %d) = %s, expected %s", test.num, test.den, exposure, test.expected)
+		}
+	}
+}
+
+func TestReadPhotoInfoWithoutExif(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "IMG_0001.jpg")
+	writeTestJPEG(t, fileName, day(2016, 5, 13))
+
+	info := ReadPhotoInfo(fileName)
+	if info.Taken != "2016-05-13T12:00:00" || info.Width != 64 || info.Height != 48 {
+		t.Errorf("unexpected info %+v", info)
+	}
+	if len(info.Camera) > 0 || info.Lat != nil {
+		t.Errorf("expected no camera or location without exif, got %+v", info)
+	}
+}
+
+func TestReadPhotoInfoFromSidecar(t *testing.T) {
+	inDir := t.TempDir()
+	fileName := filepath.Join(inDir, "IMG_0001.jpg")
+	writeTestJPEG(t, fileName, day(2016, 5, 13))
+	if FindSidecar(fileName) != "" {
+		t.Error("expected no sidecar")
+	}
+	// Lightroom names sidecars after the file without its extension and writes the rating as an attribute
+	os.WriteFile(filepath.Join(inDir, "IMG_0001.xmp"), []byte(`<rdf:Description xmp:Rating="4">
+		<xmp:Label>Red</xmp:Label>
+		<dc:description><rdf:Alt><rdf:li xml:lang="x-default">Sunset</rdf:li></rdf:Alt></dc:description>
+		<dc:subject><rdf:Bag><rdf:li>beach</rdf:li></rdf:Bag></dc:subject>
+	</rdf:Description>`), 0666)
+
+	info := ReadPhotoInfo(fileName)
+	if info.Rating != 4 || info.Label != "Red" || info.Caption != "Sunset" || strings.Join(info.Tags, ",") != "beach" {
+		t.Errorf("expected the sidecar fields, got %+v", info)
+	}
+
+	// darktable keeps the extension, which wins over the shared Lightroom sidecar
+	os.WriteFile(fileName+".xmp", []byte(`<rdf:Description xmp:Rating="-1"/>`), 0666)
+	if sidecar := FindSidecar(fileName); sidecar != fileName+".xmp" {
+		t.Errorf("expected the darktable sidecar, got %s", sidecar)
+	}
+	if info := ReadPhotoInfo(fileName); info.Rating != -1 || len(info.Caption) > 0 {
+		t.Errorf("expected a rejected photo, got %+v", info)
+	}
+}
+
+func TestProcessSidecarsAndMinRating(t *testing.T) {
+	fake := setupProcess(t)
+	cfg.Publish.MinRating = 3
+	inDir := t.TempDir()
+	createFixtures(t, inDir, []fixture{{"IMG_0001.jpg", day(2016, 5, 13)}, {"IMG_0002.jpg", day(2016, 5, 13)}})
+	os.WriteFile(filepath.Join(inDir, "IMG_0001.jpg.xmp"), []byte(`<xmp:Rating>3</xmp:Rating>`), 0666)
+	os.WriteFile(filepath.Join(inDir, "IMG_0002.jpg.xmp"), []byte(`<xmp:Rating>2</xmp:Rating>`), 0666)
+
+	process(fake, inDir, "", testBucket)
+
+	keys := strings.Join(fake.Keys(testBucket), "\n")
+	if !strings.Contains(keys, "\n2016/2016-05-13/IMG_0001.jpg.xmp") || strings.Contains(keys, "\n2016/2016-05-13/IMG_0002") {
+		t.Errorf("expected only the 3 star photo and its sidecar to be published, got\n%s", keys)
+	}
+	if !strings.Contains(keys, "originals/2016/2016-05-13/IMG_0002.jpg.xmp") {
+		t.Errorf("expected the 2 star photo and its sidecar to be archived privately, got\n%s", keys)
+	}
+	if acl := aclForKey("2016/2016-05-13/IMG_0001.jpg.xmp"); acl != "" {
+		t.Errorf("expected sidecars to be private, got %s", acl)
+	}
+	photos := string(fake.Object(testBucket, "2016/2016-05-13/photos.json"))
+	if !strings.Contains(photos, `"files" : ["IMG_0001.jpg"]`) || !strings.Contains(photos, `"rating":3`) {
+		t.Errorf("expected the rating in photos.json and no sidecar in the files, got %s", photos)
+	}
+}
@@ -10,82 +10,214 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path"
 	filepath "path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 )
 
 var awsSession *session.Session
-var overwrite = false
-var keepMoviesOriginal = false
+var cfg = DefaultProfile()
+
+var keyring *Keyring // set when originals are encrypted before uploading
+
+// displaySize Width of the plain copy of an encrypted photo published on the site
+const displaySize = 2048
 
 // TODO! Embed videos (http://stackoverflow.com/questions/10009918/how-can-i-embed-an-mpg-into-my-webpage)
 
-// Creates a file in the bucket to list the files
-func createJSONFile(bucketName, folderName string, objects []*s3.Object) string {
-	var json = `{"files" : [`
-	for idx, obj := range objects {
+// Gets the names of the photos and movies in a folder, skipping the generated files
+func getFileNames(svc s3iface.S3API, bucketName, folderName string, objects []*s3.Object) []string {
+	fileNames := []string{}
+	legacy := legacyThumbs(objects, knownOriginals(svc, bucketName, objects))
+	for _, obj := range objects {
 		fileName := strings.TrimPrefix(*obj.Key, folderName+"/")
-		if fileName != "index.html" && fileName != "photos.json" && !strings.Contains(fileName, "_thumb.jpg") {
-			if idx != 0 {
-				json += ", "
-			}
-			json += `"` + fileName + `"`
+		if _, ok := legacy[*obj.Key]; !ok && fileName != "index.html" && fileName != "photos.json" && !IsCompanion(fileName) {
+			fileNames = append(fileNames, fileName)
 		}
 	}
-	json += `]}`
+	return fileNames
+}
+
+// Creates a file in the bucket to list the files, urls holds presigned links for private buckets, thumbs the
+// thumbnail of each file and info the metadata shown in the viewer
+func createJSONFile(fileNames []string, urls, thumbs map[string]string, info map[string]PhotoInfo) string {
+	filesJSON, _ := json.Marshal(fileNames)
+	urlJSON, _ := json.Marshal(urls)
+	thumbsJSON, _ := json.Marshal(thumbs)
+	infoJSON, _ := json.Marshal(info)
+	var json = `{"files" : ` + string(filesJSON)
+	if len(urls) > 0 {
+		json += `, "urls" : ` + string(urlJSON)
+	}
+	if len(thumbs) > 0 {
+		json += `, "thumbs" : ` + string(thumbsJSON)
+	}
+	if len(info) > 0 {
+		json += `, "info" : ` + string(infoJSON)
+	}
+	json += `}`
 	return json
 }
 
-// Creates index.html to view photos
-func createWebsite(svc s3.S3, bucketName string, date time.Time) error {
-	folderName := date.Format("2006/2006-01-02")
-	test := strings.Replace(WebsiteTemplate, "<%Title%>", folderName, -1)
-	test = strings.Replace(test, "<%BACK%>", date.Format("../../2006/index.html"), -1)
-	test = strings.Replace(test, "<%YEAR%>", date.Format("2006"), -1)
-	test = strings.Replace(test, "<%DATE%>", date.Format("2006-01-02"), -1)
-	UploadToS3(svc, date.Format("2006/2006-01-02/index.html"), bucketName, []byte(test), int64(len(test)), true)
-	return nil
+// Gets the metadata for the files in a folder, from this run or else from the existing photos.json
+func getFolderInfo(svc s3iface.S3API, bucketName, folderName string, fileNames []string) map[string]PhotoInfo {
+	var existing struct {
+		Info map[string]PhotoInfo `json:"info"`
+	}
+	if reader := GetFromS3(svc, folderName+"/photos.json", bucketName); reader != nil {
+		json.NewDecoder(reader).Decode(&existing)
+	}
+
+	info := make(map[string]PhotoInfo)
+	for _, fileName := range fileNames {
+		if fileInfo, ok := photoInfo[folderName+"/"+fileName]; ok {
+			// Files already in the bucket don't get a new thumbnail, so keep the fingerprint from before
+			if old, ok := existing.Info[fileName]; ok && len(fileInfo.Hash) == 0 {
+				fileInfo.Hash, fileInfo.Sharpness = old.Hash, old.Sharpness
+			}
+			info[fileName] = fileInfo
+		} else if fileInfo, ok := existing.Info[fileName]; ok {
+			info[fileName] = fileInfo
+		}
+	}
+	return info
+}
+
+// Presigns all photos and thumbnails in a folder, keyed by file name
+func presignObjects(svc s3iface.S3API, bucketName, folderName string, objects []*s3.Object) map[string]string {
+	urls := make(map[string]string)
+	for _, obj := range objects {
+		fileName := strings.TrimPrefix(*obj.Key, folderName+"/")
+		if !IsIndexFile(fileName) {
+			urls[fileName] = PresignURL(svc, *obj.Key, bucketName, cfg.Expiry())
+		}
+	}
+	return urls
+}
+
+// Creates index.html to view photos, thumbs are relative to the page
+func createWebsite(svc s3iface.S3API, bucketName string, date time.Time, fileNames []string, urls, thumbs map[string]string) {
+	// Private buckets link to presigned urls, otherwise files are next to the page
+	url := func(fileName string) string {
+		if presigned, ok := urls[fileName]; ok {
+			return presigned
+		}
+		return fileName
+	}
+
+	data := pageData{
+		Page:   "day",
+		Title:  date.Format("2006/2006-01-02"),
+		Year:   date.Format("2006"),
+		Month:  date.Format("2006-01"),
+		Day:    date.Format("2006-01-02"),
+		Back:   date.Format("../2006-01/index.html"),
+		Assets: "../../" + assetsPrefix,
+	}
+	for _, fileName := range fileNames {
+		data.Items = append(data.Items, pageItem{Name: fileName, URL: url(fileName), Thumb: thumbs[fileName], Movie: IsMovie(fileName)})
+	}
+	uploadPage(svc, bucketName, date.Format("2006/2006-01-02/index.html"), data)
+}
+
+// Creates the index.html listing the months in a year
+func createYearWebsite(svc s3iface.S3API, bucketName, year string, dates []folderStruct) {
+	data := pageData{Page: "year", Title: year, Year: year, Back: "../index.html", Assets: "../" + assetsPrefix}
+	for _, month := range groupMonths(dates) {
+		data.Items = append(data.Items, pageItem{Name: month.Month, Caption: monthName(month.Month), Count: month.Count, URL: month.Month + "/index.html", Thumb: month.Thumb})
+	}
+	uploadPage(svc, bucketName, year+"/index.html", data)
+}
+
+// Creates the main index.html listing the years and albums
+func createMainWebsite(svc s3iface.S3API, bucketName string, years []yearSummary) {
+	data := pageData{Page: "main", Title: cfg.Title(), Assets: assetsPrefix}
+	for _, album := range readAlbums(svc, bucketName) {
+		data.Albums = append(data.Albums, pageItem{Name: album.ID, Caption: album.Name, Count: album.Count, URL: albumsPrefix + album.ID + "/index.html", Thumb: relativeLink("", album.Cover)})
+	}
+	for _, year := range years {
+		cover := year.Cover
+		if len(cover) == 0 {
+			cover = assetsPrefix + "folder.svg"
+		}
+		data.Items = append(data.Items, pageItem{Name: year.Year, Caption: year.Year, Count: year.Photos + year.Videos, URL: year.Year + "/index.html", Thumb: cover})
+	}
+	uploadPage(svc, bucketName, "index.html", data)
 }
 
 // processes all items in a bucket, creates an index and file.json
-func createJSONandWebsiteForFolder(svc s3.S3, bucketName string, folder time.Time) error {
+func createJSONandWebsiteForFolder(svc s3iface.S3API, bucketName string, folder time.Time) error {
 	folderName := folder.Format("2006/2006-01-02")
 	objects := GetObjectsFromBucket(svc, bucketName, folderName)
-	jsonFile := createJSONFile(bucketName, folderName, objects)
+
+	// Private buckets need presigned links to each photo and thumbnail
+	var urls map[string]string
+	if cfg.Access == AccessPresigned {
+		urls = presignObjects(svc, bucketName, folderName, objects)
+	}
+	fileNames := getFileNames(svc, bucketName, folderName, objects)
+	if len(fileNames) == 0 {
+		log.Info("Nothing published on ", folder.Format("2006-01-02"), ", leaving out its pages.")
+		return nil
+	}
+	info := getFolderInfo(svc, bucketName, folderName, fileNames)
+	stackBursts(fileNames, info)
+	renditions, thumbs := folderRenditions(svc, bucketName, folderName)
+	dayThumbs := make(map[string]string)
+	for fileName, thumb := range thumbs {
+		dayThumbs[fileName] = relativeLink("../..", thumb)
+	}
+	jsonFile := createJSONFile(fileNames, urls, dayThumbs, info)
 	// Upload photos.json
 	UploadToS3(svc, folderName+"/photos.json", bucketName, []byte(jsonFile), int64(len(jsonFile)), true)
 
 	// Creates the index.html
-	createWebsite(svc, bucketName, folder)
-
-	// Creates the thumbnail from the first thumbnail
-	thumbImg := "http://findicons.com/files/icons/2221/folder/128/normal_folder.png"
-	for _, obj := range objects {
-		fileName := strings.TrimPrefix(*obj.Key, folderName+"/")
-		if strings.HasSuffix(fileName, "_thumb.jpg") {
-			thumbImg = folder.Format("2006-01-02/") + fileName
-			break
+	createWebsite(svc, bucketName, folder, fileNames, urls, dayThumbs)
+	updateRenditions(svc, bucketName, folderName, fileNames, renditions)
+
+	// Pick the cover from the photos that have a thumbnail
+	entry := folderStruct{Date: folder.Format("2006-01-02"), Thumb: folderIcon, Count: len(fileNames)}
+	var candidates []coverCandidate
+	for _, fileName := range fileNames {
+		if IsMovie(fileName) {
+			entry.Videos++
+		}
+		if thumb, ok := thumbs[fileName]; ok {
+			candidates = append(candidates, coverCandidate{Name: fileName, Thumb: thumb, Faces: info[fileName].Faces})
 		}
 	}
+	if cover, ok := pickCover(candidates, pinnedCover(entry.Date)); ok {
+		entry.Thumb = relativeLink("..", cover.Thumb)
+		entry.Faces = cover.Faces
+	}
 
 	// Add's the date to the folder website .json file, also passes in a thumbnail
-	addDateToFolderWebsite(svc, bucketName, thumbImg, folder)
+	dates := addDateToFolderWebsite(svc, bucketName, entry, folder)
+
+	// The timeline loads a month at a time
+	createTimelineShard(svc, bucketName, folder)
+	updateGeo(svc, bucketName, folder, fileNames, info, thumbs)
+	updateSearch(svc, bucketName, folder, fileNames, info, thumbs)
 
 	// Finally update the main website
-	addYearToMainWebsite(svc, bucketName, folder)
+	addYearToMainWebsite(svc, bucketName, folder.Format("2006"), dates)
 	return nil
 }
 
 type folderStruct struct {
-	Date  string `json:"date"`
-	Thumb string `json:"thumb"`
+	Date   string `json:"date"`
+	Thumb  string `json:"thumb"`
+	Count  int    `json:"count,omitempty"` // photos and movies, missing in indexes created by older versions
+	Videos int    `json:"videos,omitempty"`
+	Faces  int    `json:"faces,omitempty"` // faces on the cover, used to pick the month and year covers
 }
 
 // NameSorter sorts planets by name.
@@ -95,7 +227,8 @@ func (a folderSorter) Len() int           { return len(a) }
 func (a folderSorter) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a folderSorter) Less(i, j int) bool { return a[i].Date < a[j].Date }
 
-func addDateToFolderWebsite(svc s3.S3, bucketName, thumb string, date time.Time) error {
+// Adds or updates the entry for a date in dates.json, returning all dates of the year
+func addDateToFolderWebsite(svc s3iface.S3API, bucketName string, entry folderStruct, date time.Time) []folderStruct {
 	// Create dates.json file
 	dateYear := date.Format("2006")
 	dateFull := date.Format("2006-01-02")
@@ -113,108 +246,149 @@ func addDateToFolderWebsite(svc s3.S3, bucketName, thumb string, date time.Time)
 
 	// Check if date exists in array
 	found := false
-	for _, dateF := range dateStruct["dates"] {
+	for idx, dateF := range dateStruct["dates"] {
 		if dateFull == dateF.Date {
 			found = true
+
+			// Covers change with the folder and presigned thumbnails expire, so keep them up to date
+			if dateF != entry {
+				dateStruct["dates"][idx] = entry
+				dateJSON, _ := json.Marshal(dateStruct)
+				UploadToS3(svc, datesFile, bucketName, dateJSON, int64(len(dateJSON)), true)
+				updateYear(svc, bucketName, dateYear, dateStruct["dates"], date.Format("2006-01"))
+			}
 		}
 	}
 
 	// Date doesn't exist in list
 	if !found {
 		// Insert the first item
-		s := folderStruct{dateFull, thumb}
-		dateStruct["dates"] = append(dateStruct["dates"], s)
+		dateStruct["dates"] = append(dateStruct["dates"], entry)
 		sort.Sort(folderSorter(dateStruct["dates"]))
 		dateJSON, _ := json.Marshal(dateStruct)
 		UploadToS3(svc, datesFile, bucketName, dateJSON, int64(len(dateJSON)), true)
 
-		// Create index.html file
-		test := strings.Replace(FolderTemplate, "<%TITLE%>", dateYear, -1)
-		UploadToS3(svc, dateYear+"/index.html", bucketName, []byte(test), int64(len(test)), overwrite)
+		// The pages list the dates too, so they are regenerated along with dates.json
+		updateYear(svc, bucketName, dateYear, dateStruct["dates"], date.Format("2006-01"))
 	}
-	return nil
+	return dateStruct["dates"]
 }
 
-func addYearToMainWebsite(svc s3.S3, bucketName string, date time.Time) error {
-	// Create dates.json file
-	dateYear := date.Format("2006")
-	datesFile := "years.json"
-
-	// Unmarshal into struct
-	var dateStruct map[string][]string
-	reader := GetFromS3(svc, datesFile, bucketName)
-	if reader == nil {
-		// file doesn't exist, create it
-		dateStruct = make(map[string][]string)
-	} else {
-		json.NewDecoder(reader).Decode(&dateStruct)
-	}
+// Adds or updates the summary of a year in years.json, regenerating the main page when it changed
+func addYearToMainWebsite(svc s3iface.S3API, bucketName, year string, dates []folderStruct) {
+	summary := summarizeYear(year, dates)
+	years := readYears(svc, bucketName)
 
-	// Check if date exists in array
 	found := false
-	for _, dateF := range dateStruct["years"] {
-		if dateYear == dateF {
+	for idx, yearF := range years {
+		if yearF.Year == year {
 			found = true
+			if yearF == summary {
+				return
+			}
+			years[idx] = summary
 		}
 	}
-
-	// Date doesn't exist in list
 	if !found {
-		// Insert the first item
-		dateStruct["years"] = append(dateStruct["years"], dateYear)
-		sort.Strings(dateStruct["years"])
-		dateJSON, _ := json.Marshal(dateStruct)
-		UploadToS3(svc, datesFile, bucketName, dateJSON, int64(len(dateJSON)), true)
+		years = append(years, summary)
+		sort.Slice(years, func(i, j int) bool { return years[i].Year < years[j].Year })
+	}
+	writeYears(svc, bucketName, years)
+}
 
-		// Create index.html file
-		test := strings.Replace(MainTemplate, "<%Title%>", bucketName, -1)
-		UploadToS3(svc, "index.html", bucketName, []byte(test), int64(len(test)), overwrite)
+// Uploads an untouched original to the private originals prefix, encrypting it if needed
+func uploadOriginal(svc s3iface.S3API, sourceFile, destName, bucketName string) error {
+	if keyring != nil {
+		_, err := uploadEncrypted(svc, sourceFile, destName, bucketName)
+		return err
+	}
+	buffer, err := os.ReadFile(sourceFile)
+	if err != nil {
+		return err
+	}
+	UploadToS3(svc, destName, bucketName, buffer, int64(len(buffer)), cfg.Overwrite)
+	if cfg.Move {
+		return VerifyUpload(svc, destName, bucketName, buffer)
 	}
 	return nil
 }
 
-// Uploads a single file to S3. This needs to create a thumbnail, create update
-//   the index.html for the folder and for the parent directory.
-func uploadFile(svc s3.S3, sourceFile, outPath, fileName, bucketName string) error {
+// uploadEncrypted Streams a file through the keyring into the bucket, so large movies never have to fit in
+// memory. The size is checked before the source can be removed, the checksum changes with every nonce.
+func uploadEncrypted(svc s3iface.S3API, sourceFile, destName, bucketName string) (bool, error) {
 	file, err := os.Open(sourceFile)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
 
-	fileInfo, _ := file.Stat()
-	size := fileInfo.Size()
-
-	buffer := make([]byte, size)
-
-	// read file content to buffer
-	file.Read(buffer)
+	encrypted := keyring.EncryptingReader(file)
+	defer encrypted.Close()
+	copied, err := StreamToS3(svc, destName, bucketName, encrypted, cfg.Overwrite)
+	if err != nil {
+		return false, err
+	}
+	if cfg.Move {
+		if _, err := VerifyUploadSize(svc, destName, bucketName, EncryptedSize(fileInfo.Size())); err != nil {
+			return false, err
+		}
+	}
+	return copied, nil
+}
 
+// Uploads a single file to S3. This needs to create a thumbnail, create update
+//
+//	the index.html for the folder and for the parent directory. Photos get a fingerprint
+//	from their thumbnail to find near-duplicates.
+func uploadFile(svc s3iface.S3API, sourceFile, outPath, fileName, bucketName string) (Fingerprint, error) {
+	var fingerprint Fingerprint
 	destName := outPath + "/" + fileName // AWS uses forward slashes so don't use filePath.Join
-	copied := UploadToS3(svc, destName, bucketName, buffer, size, overwrite)
+	buffer, err := os.ReadFile(sourceFile)
+	if err != nil {
+		return fingerprint, err
+	}
+	copied := UploadToS3(svc, destName, bucketName, buffer, int64(len(buffer)), cfg.Overwrite)
+
+	// Make sure the upload is complete before the source can be removed
+	if cfg.Move {
+		if err := VerifyUpload(svc, destName, bucketName, buffer); err != nil {
+			return fingerprint, err
+		}
+	}
 
 	if !copied {
 		// no need to upload thumbnail
-		return nil
+		return fingerprint, nil
 	}
 
-	// If this is a photo create a thumbnail
-	thumbFile := outPath + "/" + fileName[0:len(fileName)-4] + "_thumb.jpg"
+	// If this is a photo create a thumbnail, it is still needed for the fingerprint without thumbnails
+	thumbFile := thumbKey(outPath + "/" + fileName)
 	if IsJpeg(sourceFile) {
-		thumbBuf, thumbErr := CreateThumbNail(sourceFile, thumbNailSize)
+		thumbBuf, thumbFingerprint, thumbErr := CreateThumbNail(sourceFile, cfg.ThumbnailSize())
 		if thumbErr != nil {
-			log.Error("Error creating thumbnail: ", err.Error())
+			log.Error("Error creating thumbnail: ", thumbErr.Error())
+			return fingerprint, nil
+		}
+		fingerprint = thumbFingerprint
+		if !cfg.DisableThumbnails {
+			UploadToS3(svc, thumbFile, bucketName, thumbBuf, int64(len(thumbBuf)), cfg.Overwrite)
 		}
-		// Upload
-		// TODO! Get length of extension, this won;t work for .JPEG files
-		UploadToS3(svc, thumbFile, bucketName, thumbBuf, int64(len(thumbBuf)), overwrite)
-	} else if IsMovie(sourceFile) {
-		cmd := exec.Command("ffmpeg", "-i", sourceFile, "-vframes", "1", "-s", fmt.Sprintf("%dx%d", thumbNailSize, thumbNailSize/4*3), "-f", "singlejpeg", "-")
+	} else if IsMovie(sourceFile) && !IsLiveVideo(fileName) && !cfg.DisableThumbnails {
+		thumbSize := cfg.ThumbnailSize()
+		cmd := exec.Command("ffmpeg", "-i", sourceFile, "-vframes", "1", "-s", fmt.Sprintf("%dx%d", thumbSize, thumbSize/4*3), "-f", "image2pipe", "-vcodec", "mjpeg", "-")
 		var buffer bytes.Buffer
 		cmd.Stdout = &buffer
 		if cmd.Run() != nil {
 			log.Panic("Could not generate frame from movie ", sourceFile)
 		}
-		UploadToS3(svc, thumbFile, bucketName, buffer.Bytes(), int64(buffer.Len()), overwrite)
+		UploadToS3(svc, thumbFile, bucketName, buffer.Bytes(), int64(buffer.Len()), cfg.Overwrite)
 	}
 
-	return err
+	return fingerprint, err
 }
 
 // shrink a movie file
@@ -230,7 +404,8 @@ func shrinkMovie(sourceFile, tmpDir string, dateTaken time.Time) string {
 	}
 
 	// Run ffmpeg on the input file and save to output dir
-	cmd := exec.Command("ffmpeg", "-i", sourceFile, "-c:v", "libx264", "-preset", "medium", "-crf", "25", "-movflags", "+faststart", "-acodec", "aac", "-strict", "experimental", "-ab", "96k", destFile)
+	transcode := cfg.Transcode
+	cmd := exec.Command("ffmpeg", "-i", sourceFile, "-c:v", transcode.VideoCodec, "-preset", transcode.Preset, "-crf", strconv.Itoa(transcode.CRF), "-movflags", "+faststart", "-acodec", transcode.AudioCodec, "-strict", "experimental", "-ab", transcode.AudioBitrate, destFile)
 	if err := cmd.Run(); err != nil {
 		log.Error("Could not run ffmpeg on file: ", sourceFile, err, destFile)
 	}
@@ -242,7 +417,7 @@ func shrinkMovie(sourceFile, tmpDir string, dateTaken time.Time) string {
 	inSize := GetFileSize(sourceFile)
 	outSize := GetFileSize(destFile)
 	ratio := float64(outSize) / float64(inSize)
-	if ratio < 0.93 {
+	if ratio < transcode.MinRatio {
 		// new file is smaller, use that as the new destination
 		newRatio := (1 - ratio) * 100
 		log.Info("Using shrunk movie file (", fmt.Sprintf("%.2f", newRatio), "% reduction).")
@@ -252,14 +427,27 @@ func shrinkMovie(sourceFile, tmpDir string, dateTaken time.Time) string {
 	return sourceFile
 }
 
+// Gets the key a file is uploaded as, spaces are removed from the name
+func objectKey(sourceFile string, dateTaken time.Time) string {
+	// The movie of a Live Photo is named after the photo so the two stay together
+	if isLiveMovie(sourceFile) {
+		return dateTaken.Format("2006/2006-01-02/") + liveName(livePairs[sourceFile], sourceFile)
+	}
+	return dateTaken.Format("2006/2006-01-02/") + strings.Replace(filepath.Base(sourceFile), " ", "", -1)
+}
+
 // Processes a single photo file, copying it to the output dir and creating thumbnails etc. in S3
-func processFile(svc s3.S3, sourceFile, outDir, tmpDir, bucketName string, dateTaken time.Time) error {
+func processFile(svc s3iface.S3API, sourceFile, outDir, tmpDir, bucketName string, dateTaken time.Time) error {
 	outPath := dateTaken.Format("2006/2006-01-02")
-	fileName := strings.Replace(filepath.Base(sourceFile), " ", "", -1)
-	destPath := filepath.Join(outDir, outPath, fileName)
+	localPath := dateTaken.Format(cfg.Layout)
+	fileName := path.Base(objectKey(sourceFile, dateTaken))
+	destPath := filepath.Join(outDir, localPath, fileName)
+	originalFile := sourceFile // sourceFile changes to the shrunk movie
+	sidecar := FindSidecar(sourceFile)
+	kept := false // whether a verified copy of the untouched original exists, only then can the source go
 
 	// Shrink movie
-	if IsMovie(sourceFile) && !keepMoviesOriginal {
+	if IsMovie(sourceFile) && !cfg.KeepMoviesOriginal {
 
 		// Check if destination file doesn't exist
 		if _, err := os.Stat(destPath); os.IsNotExist(err) {
@@ -278,11 +466,12 @@ func processFile(svc s3.S3, sourceFile, outDir, tmpDir, bucketName string, dateT
 
 	// If we specified a output folder, organise files
 	if len(outDir) > 0 {
-		// Need to create each nested directory
-		CreateDir(filepath.Join(outDir, dateTaken.Format("2006")))
-		CreateDir(filepath.Join(outDir, dateTaken.Format("2006/2006-01-02"))) // Can't created nested directories in one go
+		if err := CreateDir(filepath.Dir(destPath)); err != nil {
+			return err
+		}
 
 		// Check if the output file already exists
+		copied := false
 		if destStat, err := os.Stat(destPath); !os.IsNotExist(err) {
 
 			// Might have different file sizes
@@ -302,60 +491,315 @@ func processFile(svc s3.S3, sourceFile, outDir, tmpDir, bucketName string, dateT
 				log.Info("Destination file exists but fileSizes differ for ", sourceFile, " and ", destPath, " will overwrite.")
 			} else {
 				log.Info("File ", destPath, " already exists.")
-				return nil
+				// When moving, still check the copy and upload before removing the source
+				if !cfg.Move {
+					return nil
+				}
+				copied = true
 			}
 		}
 
-		err := CopyFile(sourceFile, destPath)
-		if err != nil {
-			return err
+		if !copied {
+			err := CopyFile(sourceFile, destPath)
+			if err != nil {
+				return err
+			}
+			log.Info("Copied file: ", destPath)
+		}
+
+		// Make sure the copy is identical before the source can be removed
+		if cfg.Move {
+			if err := VerifyCopy(sourceFile, destPath); err != nil {
+				return err
+			}
+			kept = sourceFile == originalFile
 		}
 
-		log.Info("Copied file: ", destPath)
+		// Sidecars are kept next to their file, named after it so a movie and photo don't share one
+		if len(sidecar) > 0 {
+			if err := CopyFile(sidecar, destPath+".xmp"); err != nil {
+				return err
+			}
+			if cfg.Move {
+				if err := VerifyCopy(sidecar, destPath+".xmp"); err != nil {
+					return err
+				}
+			}
+		}
 	}
 
 	// If we passed in a bucket, upload to S3
 	if len(bucketName) > 0 {
-		err := uploadFile(svc, sourceFile, outPath, fileName, bucketName)
+		info := ReadPhotoInfo(originalFile)
+		if !isArchived(originalFile, dateTaken, info) {
+			log.Info("Not archiving ", originalFile, ", it doesn't match the archive rules.")
+			// Without an output directory the file only exists in the source, so it stays there
+			if cfg.Move {
+				return moveSource(originalFile, sidecar, kept)
+			}
+			return nil
+		}
+		// Encrypted movies can't be watched and there is no plain copy of them to publish, nor of photos when
+		// nothing unencrypted is to be uploaded
+		if isPublished(originalFile, dateTaken, info) && !(keyring != nil && (IsMovie(originalFile) || cfg.DisableThumbnails)) {
+			uploaded, err := publishFile(svc, originalFile, sourceFile, sidecar, tmpDir, outPath, fileName, bucketName, info)
+			if err != nil {
+				return err
+			}
+			kept = kept || uploaded
+		} else {
+			// The website lists the date folders, so files that aren't published are kept in the private prefix
+			if len(cfg.OriginalsPrefix) == 0 && isHeicOnly(originalFile) {
+				log.Warn("Not archiving ", originalFile, ", HEIC photos are only kept in the originals prefix, which is empty.")
+				return nil
+			}
+			if len(cfg.OriginalsPrefix) == 0 {
+				return fmt.Errorf("unable to archive %s without publishing it, the originals prefix is empty", originalFile)
+			}
+			destName := cfg.OriginalsPrefix + outPath + "/" + fileName
+			if err := uploadOriginal(svc, originalFile, destName, bucketName); err != nil {
+				return err
+			}
+			kept = true
+			if len(sidecar) > 0 {
+				if err := uploadOriginal(svc, sidecar, destName+".xmp", bucketName); err != nil {
+					return err
+				}
+			}
+			log.Info("Archived ", originalFile, " without publishing it.")
+		}
+	}
+
+	// Everything has been verified, so the source can go
+	if cfg.Move {
+		return moveSource(originalFile, sidecar, kept)
+	}
+	return nil
+}
+
+// moveSource Removes a source file and its sidecar once a verified copy of the untouched original exists, a
+// shrunk or stripped copy can't take its place
+func moveSource(originalFile, sidecar string, kept bool) error {
+	if !kept {
+		log.Warn("Keeping ", originalFile, ", there is no verified copy of the untouched original.")
+		return nil
+	}
+	return removeSource(originalFile, ownSidecar(originalFile, sidecar))
+}
+
+// publishFile Uploads a file to a date folder along with its thumbnail and sidecar, recording the metadata
+// photos.json lists for it. What the privacy policy strips is removed first. Returns whether the untouched
+// original, rather than a shrunk or stripped copy, was uploaded and verified when moving.
+func publishFile(svc s3iface.S3API, originalFile, sourceFile, sidecar, tmpDir, outPath, fileName, bucketName string, info PhotoInfo) (bool, error) {
+	if info.Lat != nil && info.Lon != nil {
+		info.Place = nearestPlace(gazetteerPlaces, *info.Lat, *info.Lon)
+	}
+	uploadName := sourceFile
+	kept := sourceFile == originalFile
+	policy := stripPolicy(info)
+	if keyring != nil {
+		// Encrypted originals can't be viewed, so they are kept privately and the site gets a plain copy the
+		// size of a screen, without any metadata
+		if err := uploadOriginal(svc, originalFile, cfg.OriginalsPrefix+outPath+"/"+fileName, bucketName); err != nil {
+			return false, err
+		}
+		kept = true
+		display, err := CreateDisplayCopy(sourceFile, tmpDir, displaySize)
 		if err != nil {
+			return false, err
+		}
+		defer os.Remove(display)
+		uploadName = display
+	} else if policy != PrivacyKeep {
+		// The untouched original is kept privately, the stripped copy takes its place on the site
+		kept = false
+		if len(cfg.OriginalsPrefix) > 0 {
+			if err := uploadOriginal(svc, originalFile, cfg.OriginalsPrefix+outPath+"/"+fileName, bucketName); err != nil {
+				return false, err
+			}
+			kept = true
+		}
+		stripped, err := stripFile(sourceFile, tmpDir, policy)
+		if err != nil {
+			return false, err
+		}
+		defer os.Remove(stripped)
+		uploadName = stripped
+	} else if !kept && cfg.Move && len(cfg.OriginalsPrefix) > 0 {
+		// Only the shrunk movie is published, so the one being removed is kept privately
+		if err := uploadOriginal(svc, originalFile, cfg.OriginalsPrefix+outPath+"/"+fileName, bucketName); err != nil {
+			return false, err
+		}
+		kept = true
+	}
+	fingerprint, err := uploadFile(svc, uploadName, outPath, fileName, bucketName)
+	if err != nil {
+		return false, err
+	}
+	info.Hash, info.Sharpness = fingerprint.Hash, fingerprint.Sharpness
+	if len(sidecar) > 0 {
+		sidecarName := outPath + "/" + fileName + ".xmp"
+		if keyring != nil {
+			sidecarName = cfg.OriginalsPrefix + sidecarName
+		}
+		if err := uploadOriginal(svc, sidecar, sidecarName, bucketName); err != nil {
+			return false, err
+		}
+	}
+	if IsLiveVideo(fileName) {
+		return kept, nil // listed with its photo
+	}
+	if movie, ok := livePairs[sourceFile]; ok && keyring == nil {
+		info.Live = liveName(sourceFile, movie)
+	} else if cfg.MotionPhotos && IsJpeg(sourceFile) && keyring == nil {
+		if info.Live, err = uploadMotionClip(svc, sourceFile, tmpDir, outPath, fileName, bucketName, policy); err != nil {
+			return false, err
+		}
+	}
+	photoInfo[outPath+"/"+fileName] = publishedInfo(info)
+	return kept, nil
+}
+
+// ownSidecar Gets the sidecar to remove along with a source file. A Lightroom sidecar such as IMG_0001.xmp
+// is shared by a photo and movie with the same name, so it stays until the last of them is imported.
+func ownSidecar(sourceFile, sidecar string) string {
+	if len(sidecar) == 0 || strings.EqualFold(sidecar, sourceFile+".xmp") {
+		return sidecar
+	}
+	matches, _ := filepath.Glob(strings.TrimSuffix(sidecar, filepath.Ext(sidecar)) + ".*")
+	for _, match := range matches {
+		if match != sourceFile && (IsJpeg(match) || IsHeic(match) || IsMovie(match)) {
+			return ""
+		}
+	}
+	return sidecar
+}
+
+// Deletes source files after importing, or moves them into a dated folder in the trash directory if one is set
+func removeSource(sourceFiles ...string) error {
+	for _, sourceFile := range sourceFiles {
+		if len(sourceFile) == 0 {
+			continue
+		}
+		if err := removeSourceFile(sourceFile); err != nil {
 			return err
 		}
 	}
+	return nil
+}
 
+// renameFile Moves a file, replaced in tests to act as if the trash directory is on another drive
+var renameFile = os.Rename
+
+// Deletes a single source file, or moves it into the trash directory
+func removeSourceFile(sourceFile string) error {
+	if len(cfg.TrashDir) == 0 {
+		if err := os.Remove(sourceFile); err != nil {
+			return err
+		}
+		log.Info("Removed source file: ", sourceFile)
+		return nil
+	}
+
+	// Don't overwrite files with the same name from another folder
+	trashDir := filepath.Join(cfg.TrashDir, "imported-"+time.Now().Format("2006-01-02"))
+	if err := CreateDir(trashDir); err != nil {
+		return err
+	}
+	fileName := filepath.Base(sourceFile)
+	fileExt := filepath.Ext(fileName)
+	trashFile := filepath.Join(trashDir, fileName)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(trashFile); os.IsNotExist(err) {
+			break
+		}
+		trashFile = filepath.Join(trashDir, fmt.Sprintf("%s_%d%s", strings.TrimSuffix(fileName, fileExt), i, fileExt))
+	}
+
+	// Renaming doesn't work across drives, eg. from a memory card, so fall back on copying
+	if err := renameFile(sourceFile, trashFile); err != nil {
+		if err := CopyFile(sourceFile, trashFile); err != nil {
+			return err
+		}
+		if err := VerifyCopy(sourceFile, trashFile); err != nil {
+			return err
+		}
+		if err := os.Remove(sourceFile); err != nil {
+			return err
+		}
+	}
+	log.Info("Moved source file ", sourceFile, " to ", trashFile)
 	return nil
 }
 
 // Gets all files in directory
 func addFilesToMap(inDirName string, fileMap map[string][]string) {
+	addFilesToMapIgnoring(inDirName, fileMap, photoIgnore{})
+}
+
+// Gets all files in directory, skipping the ones matched by the .photoignore files found on the way
+func addFilesToMapIgnoring(inDirName string, fileMap map[string][]string, rules photoIgnore) {
 	files, err := ioutil.ReadDir(inDirName)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
+	rules = loadPhotoIgnore(inDirName, rules)
+	var media []string
 
 	for _, f := range files {
+		if matchAny(rules.ignored, f.Name()) {
+			continue
+		}
 		if f.IsDir() {
 			dirName := f.Name()
-			if dirName[0] == '.' {
+			if dirName[0] == '.' || cfg.Excluded(dirName) {
 				continue
 			}
-			addFilesToMap(filepath.Join(inDirName, dirName), fileMap)
+			dirRules := rules
+			if matchAny(rules.private, dirName) {
+				// Everything in a private directory is private
+				dirRules.private = append(append([]string{}, rules.private...), "*")
+			}
+			addFilesToMapIgnoring(filepath.Join(inDirName, dirName), fileMap, dirRules)
 		} else {
-			if IsJpeg(f.Name()) || IsMovie(f.Name()) {
+			if (IsJpeg(f.Name()) || IsHeic(f.Name()) || IsMovie(f.Name())) && cfg.Included(f.Name()) {
 				fileName := filepath.Join(inDirName, f.Name())
-				dateTaken := GetDateTaken(fileName)
-				dateKey := dateTaken.Format("2006-01-02")
-				fileMap[dateKey] = append(fileMap[dateKey], fileName)
+				media = append(media, fileName)
+				if matchAny(rules.private, f.Name()) {
+					unpublishedFiles[fileName] = true
+				}
 			}
 		}
 	}
+
+	// The movie of a Live Photo goes in the same folder as its photo, even if its date is a little off
+	pairLivePhotos(media)
+	for _, fileName := range media {
+		if isHeicOnly(fileName) {
+			unpublishedFiles[fileName] = true
+		}
+		dateFile := fileName
+		if isLiveMovie(fileName) {
+			dateFile = livePairs[fileName]
+		}
+		dateKey := GetDateTaken(dateFile).Format("2006-01-02")
+		fileMap[dateKey] = append(fileMap[dateKey], fileName)
+	}
 }
 
 // Remove any files from map already existing in S3
-func removeExisting(svc s3.S3, bucketName string, fileMap map[string][]string) {
+func removeExisting(svc s3iface.S3API, bucketName string, fileMap map[string][]string) {
 	for dateKey, files := range fileMap {
 		date, _ := time.Parse("2006-01-02", dateKey)
 		folderName := date.Format("2006/2006-01-02")
 		s3Objs := GetObjectsFromBucket(svc, bucketName, folderName)
+		// Files archived without being published are only in the private prefix
+		if len(cfg.OriginalsPrefix) > 0 {
+			for _, obj := range GetObjectsFromBucket(svc, bucketName, cfg.OriginalsPrefix+folderName) {
+				key := strings.TrimPrefix(*obj.Key, cfg.OriginalsPrefix)
+				s3Objs = append(s3Objs, &s3.Object{Key: &key})
+			}
+		}
 		var newFiles []string
 
 		// Loop through files and S3 objects, if the file exists add it to a new array
@@ -363,7 +807,7 @@ func removeExisting(svc s3.S3, bucketName string, fileMap map[string][]string) {
 			found := false
 			for _, obj := range s3Objs {
 				s3FileName := strings.TrimPrefix(*obj.Key, folderName+"/")
-				if filepath.Base(fileName) == s3FileName {
+				if path.Base(objectKey(fileName, date)) == s3FileName {
 					found = true
 					log.Info("File ", fileName, " already exists on S3, skipping...")
 					break
@@ -385,18 +829,32 @@ func removeExisting(svc s3.S3, bucketName string, fileMap map[string][]string) {
 }
 
 // Loops through all files in a dir and processes them all
-func process(svc *s3.S3, inDirName, outDirName, bucketName string) {
+func process(svc s3iface.S3API, inDirName, outDirName, bucketName string) {
 	// Get all files in directory
 	fileMap := make(map[string][]string)
 	addFilesToMap(inDirName, fileMap)
-	if !overwrite {
-		removeExisting(*svc, bucketName, fileMap)
+	// Taken before files already in the bucket are dropped, so existing files are added to new albums too
+	var albumFiles map[string][]string
+	if cfg.FolderAlbums {
+		albumFiles = folderAlbums(inDirName, fileMap)
+	}
+	// When moving, files already in S3 still need to be checked so their source can be removed
+	if !cfg.Overwrite && !cfg.Move {
+		removeExisting(svc, bucketName, fileMap)
 	}
 
 	// Create temp dir and remember to clean up
 	tmpDir, _ := ioutil.TempDir("", "shrink-file")
 	defer os.RemoveAll(tmpDir) // clean up
 
+	if len(bucketName) > 0 {
+		uploadAssets(svc, bucketName)
+	}
+	var err error
+	if gazetteerPlaces, err = LoadGazetteer(cfg.Gazetteer); err != nil {
+		log.Fatal(err)
+	}
+
 	numDirs := len(fileMap)
 	var doneDirs = 0
 	for dateKey, files := range fileMap {
@@ -420,7 +878,7 @@ func process(svc *s3.S3, inDirName, outDirName, bucketName string) {
 				wg.Add(1)
 				go func(fileNameInner string, dateInner time.Time) {
 					sem <- 1 // Wait for active queue to drain.
-					err := processFile(*svc, fileNameInner, outDirName, tmpDir, bucketName, dateInner)
+					err := processFile(svc, fileNameInner, outDirName, tmpDir, bucketName, dateInner)
 					if err != nil {
 						log.Fatal(err.Error())
 					}
@@ -435,7 +893,7 @@ func process(svc *s3.S3, inDirName, outDirName, bucketName string) {
 
 		// Can't get goroutines working, not much of a speed improvement as the main bottleneck is AWS uploads.
 		for _, fileName := range files {
-			err := processFile(*svc, fileName, outDirName, tmpDir, bucketName, date)
+			err := processFile(svc, fileName, outDirName, tmpDir, bucketName, date)
 			if err != nil {
 				log.Fatal(err.Error())
 			}
@@ -444,7 +902,13 @@ func process(svc *s3.S3, inDirName, outDirName, bucketName string) {
 		doneDirs++
 		log.Info("Processed ", doneDirs, " of ", numDirs, " folders.")
 		if len(bucketName) > 0 {
-			createJSONandWebsiteForFolder(*svc, bucketName, date)
+			createJSONandWebsiteForFolder(svc, bucketName, date)
+		}
+	}
+
+	if len(bucketName) > 0 {
+		if err := refreshAlbums(svc, bucketName, albumFiles); err != nil {
+			log.Error(err)
 		}
 	}
 }
@@ -464,19 +928,303 @@ func main() {
 	outDirNamePtr := flag.String("o", "", "output directory")
 	bucketNamePtr := flag.String("n", "", "bucket name")
 	awsRegionNamePtr := flag.String("r", "us-east-1", "AWS region")
-	flag.BoolVar(&overwrite, "f", false, "overwrite")
-	flag.BoolVar(&keepMoviesOriginal, "k", false, "don't shrink movies")
+	endpointPtr := flag.String("endpoint", "", "S3 compatible endpoint to use instead of AWS, eg. http://localhost:9000")
+	pathStylePtr := flag.Bool("path-style", false, "use path style addressing (bucket name in the path), needed by most S3 compatible servers")
+	insecurePtr := flag.Bool("insecure", false, "don't verify TLS certificates of the endpoint")
+	accessKeyPtr := flag.String("access-key", "", "access key to use instead of the AWS credentials chain, the secret is read from $"+secretKeyEnv)
+	awsProfilePtr := flag.String("aws-profile", "", "named profile in the AWS credentials file")
+	configFilePtr := flag.String("c", DefaultConfigFile(), "config file (YAML or TOML)")
+	profileNamePtr := flag.String("p", "", "config profile to use")
+	siteTitlePtr := flag.String("t", "", "title of the main page (defaults to bucket name)")
+	themePtr := flag.String("theme", "", "directory with templates and assets overriding the built-in theme")
+	coverPtr := flag.String("cover", CoverFirst, "how covers are picked: first, random or faces")
+	mapTilesPtr := flag.String("map-tiles", "", "tile URL template for the map page, eg. https://tiles.example.com/{z}/{x}/{y}.png")
+	albumManifestPtr := flag.String("albums", "", "YAML or TOML file defining albums by dates or files")
+	folderAlbumsPtr := flag.Bool("folder-albums", false, "create an album for each subfolder of the input directory")
+	accessPtr := flag.String("a", AccessPublic, "access mode: public, presigned or cloudfront")
+	overwritePtr := flag.Bool("f", false, "overwrite")
+	keepMoviesOriginalPtr := flag.Bool("k", false, "don't shrink movies")
+	encryptPtr := flag.Bool("encrypt", false, "encrypt originals before uploading, the passphrase is read from $"+passphraseEnv)
+	keyFilePtr := flag.String("keyfile", "", "key file to use instead of a passphrase when encrypting")
+	privacyPtr := flag.String("privacy", PrivacyKeep, "metadata to remove from what is published: keep, strip-gps or strip-all")
+	stripOriginalsPtr := flag.Bool("strip-originals", false, "upload stripped copies in place of the originals, keeping the originals in a private prefix")
+	disableThumbnailsPtr := flag.Bool("no-thumbnails", false, "don't upload thumbnails")
+	motionPhotosPtr := flag.Bool("motion-photos", false, "extract the movies embedded in motion photos so the website can play them")
+	minRatingPtr := flag.Int("min-rating", 0, "only publish photos rated this many stars or more in a photo manager")
+	movePtr := flag.Bool("move", false, "remove source files once they have been copied and uploaded")
+	trashDirPtr := flag.String("trash", "", "move source files into this directory instead of deleting them when using -move")
 	// Parse command line arguments.
 	flag.Parse()
-	log.Info("Overwrite: ", overwrite)
-	if len(*inDirNamePtr) == 0 {
-		log.Fatal("Error, need to define an input directory.")
+
+	// Load the config file, flags override anything set in the profile
+	config, err := LoadConfig(*configFilePtr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg, err = config.GetProfile(*profileNamePtr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "n":
+			cfg.Bucket = *bucketNamePtr
+		case "r":
+			cfg.Region = *awsRegionNamePtr
+		case "endpoint":
+			cfg.Endpoint = *endpointPtr
+		case "path-style":
+			cfg.PathStyle = *pathStylePtr
+		case "insecure":
+			cfg.InsecureSkipVerify = *insecurePtr
+		case "access-key":
+			cfg.AccessKey = *accessKeyPtr
+			cfg.SecretKey = os.Getenv(secretKeyEnv)
+		case "aws-profile":
+			cfg.AWSProfile = *awsProfilePtr
+		case "t":
+			cfg.SiteTitle = *siteTitlePtr
+		case "theme":
+			cfg.Theme = *themePtr
+		case "cover":
+			cfg.Cover = *coverPtr
+		case "map-tiles":
+			cfg.MapTiles = *mapTilesPtr
+		case "albums":
+			cfg.AlbumManifest = *albumManifestPtr
+		case "folder-albums":
+			cfg.FolderAlbums = *folderAlbumsPtr
+		case "a":
+			cfg.Access = *accessPtr
+		case "f":
+			cfg.Overwrite = *overwritePtr
+		case "k":
+			cfg.KeepMoviesOriginal = *keepMoviesOriginalPtr
+		case "encrypt":
+			cfg.Encrypt = *encryptPtr
+		case "keyfile":
+			cfg.KeyFile = *keyFilePtr
+		case "privacy":
+			cfg.Privacy = *privacyPtr
+		case "strip-originals":
+			cfg.StripOriginals = *stripOriginalsPtr
+		case "no-thumbnails":
+			cfg.DisableThumbnails = *disableThumbnailsPtr
+		case "motion-photos":
+			cfg.MotionPhotos = *motionPhotosPtr
+		case "min-rating":
+			cfg.Publish.MinRating = *minRatingPtr
+		case "move":
+			cfg.Move = *movePtr
+		case "trash":
+			cfg.TrashDir = *trashDirPtr
+		}
+	})
+	if err := cfg.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Restoring always needs the key in case the files were encrypted
+	if cfg.Encrypt || flag.Arg(0) == "restore" {
+		keyring, err = NewKeyring(os.Getenv(passphraseEnv), cfg.KeyFile)
+		if err != nil && cfg.Encrypt {
+			log.Fatal(err)
+		}
 	}
 
 	// Create S3 service
-	awsSession = session.New(&aws.Config{Region: aws.String(*awsRegionNamePtr)})
+	awsSession, err = NewSession(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 	svc := s3.New(awsSession)
 
-	process(svc, *inDirNamePtr, *outDirNamePtr, *bucketNamePtr)
+	// Run commands
+	switch flag.Arg(0) {
+	case "":
+	case "config":
+		if flag.Arg(1) != "show" {
+			log.Fatal("Usage: config show")
+		}
+		if err := showConfig(*configFilePtr, config.ProfileName(*profileNamePtr), cfg); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "share":
+		shareFlags := flag.NewFlagSet("share", flag.ExitOnError)
+		refreshPtr := shareFlags.Bool("refresh", false, "regenerate the presigned links in the indexes instead of creating a share page")
+		expiresPtr := shareFlags.String("expires", "", "how long the share page is valid for (720h by default, 0 never expires), or the presigned links with -refresh (link_expiry by default)")
+		titlePtr := shareFlags.String("title", "", "title of the share page")
+		passwordPtr := shareFlags.String("password", "", "password needed to view the share page, better set $"+sharePasswordEnv+" so it doesn't show up in the process list")
+		shareFlags.Parse(flag.Args()[1:])
+		expiresSet := false
+		shareFlags.Visit(func(f *flag.Flag) {
+			expiresSet = expiresSet || f.Name == "expires"
+		})
+
+		if *refreshPtr {
+			if expiresSet {
+				cfg.LinkExpiry = *expiresPtr
+				if err := cfg.Validate(); err != nil {
+					log.Fatal(err)
+				}
+			}
+			if err := refreshLinks(svc, cfg.Bucket, shareFlags.Args()); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+
+		if shareFlags.NArg() != 1 {
+			log.Fatal("Usage: share [-title title] [-expires 720h] <date|year|from:to|album:name>, the password is read from $" + sharePasswordEnv)
+		}
+		expires := 720 * time.Hour
+		if expiresSet {
+			if expires, err = time.ParseDuration(*expiresPtr); err != nil {
+				log.Fatal(err)
+			}
+		}
+		password := os.Getenv(sharePasswordEnv)
+		if len(*passwordPtr) > 0 {
+			password = *passwordPtr
+		}
+		sharePage, err := createShare(svc, cfg.Bucket, shareFlags.Arg(0), *titlePtr, password, expires)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Info("Shared ", shareFlags.Arg(0), " as ", sharePage)
+		return
+	case "restore":
+		restoreFlags := flag.NewFlagSet("restore", flag.ExitOnError)
+		workersPtr := restoreFlags.Int("j", 4, "number of files to download at the same time")
+		restoreFlags.Parse(flag.Args()[1:])
+		if len(*outDirNamePtr) == 0 || *workersPtr < 1 {
+			log.Fatal("Usage: -o <output directory> restore [-j 4] [year|date|from:to ...]")
+		}
+		if err := restore(svc, cfg.Bucket, restoreFlags.Args(), *outDirNamePtr, *workersPtr); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "verify":
+		verifyFlags := flag.NewFlagSet("verify", flag.ExitOnError)
+		workersPtr := verifyFlags.Int("j", 8, "number of files to check at the same time")
+		quickPtr := verifyFlags.Bool("quick", false, "only compare sizes, don't calculate checksums")
+		fixPtr := verifyFlags.Bool("fix", false, "repair broken indexes")
+		jsonPtr := verifyFlags.String("json", "", "write the report as json to this file")
+		verifyFlags.Parse(flag.Args()[1:])
+		if *workersPtr < 1 {
+			log.Fatal("Usage: [-o <output directory>] verify [-j 8] [-quick] [-fix] [-json report.json]")
+		}
+
+		report, err := verify(svc, cfg.Bucket, *outDirNamePtr, !*quickPtr, *fixPtr, *workersPtr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		logReport(report)
+		if len(*jsonPtr) > 0 {
+			reportJSON, _ := json.MarshalIndent(report, "", "  ")
+			if err := os.WriteFile(*jsonPtr, reportJSON, 0666); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if report.Total() > 0 && !*fixPtr {
+			os.Exit(1)
+		}
+		return
+	case "dupes":
+		dupeFlags := flag.NewFlagSet("dupes", flag.ExitOnError)
+		window := 10 * time.Second // still reported when stacks are turned off
+		if options, ok := cfg.Bursts(); ok {
+			window = options.Window
+		}
+		windowPtr := dupeFlags.Duration("window", window, "photos taken further apart are never near-duplicates")
+		distancePtr := dupeFlags.Int("distance", cfg.BurstDistance, "most bits the perceptual hashes of near-duplicates differ in")
+		jsonPtr := dupeFlags.String("json", "", "write the groups as json to this file")
+		dupeFlags.Parse(flag.Args()[1:])
+		if *windowPtr <= 0 || *distancePtr < 0 {
+			log.Fatal("Usage: dupes [-window 10s] [-distance 10] [-json dupes.json] [year|date|from:to ...]")
+		}
+
+		days, err := findDupes(svc, cfg.Bucket, dupeFlags.Args(), burstOptions{Window: *windowPtr, Distance: *distancePtr})
+		if err != nil {
+			log.Fatal(err)
+		}
+		// One group per line, the sharpest photo first and marked with a *
+		fmt.Print(formatDupes(days))
+		if len(*jsonPtr) > 0 {
+			dupesJSON, _ := json.MarshalIndent(days, "", "  ")
+			if err := os.WriteFile(*jsonPtr, dupesJSON, 0666); err != nil {
+				log.Fatal(err)
+			}
+		}
+		return
+	case "migrate":
+		migrateFlags := flag.NewFlagSet("migrate", flag.ExitOnError)
+		dryRunPtr := migrateFlags.Bool("dry-run", false, "only log the thumbnails that would be moved")
+		migrateFlags.Parse(flag.Args()[1:])
+
+		moved, err := migrateThumbnails(svc, cfg.Bucket, migrateFlags.Args(), *dryRunPtr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *dryRunPtr {
+			log.Info("Found ", moved, " thumbnails to move to ", renditionsPrefix)
+		} else {
+			log.Info("Moved ", moved, " thumbnails to ", renditionsPrefix)
+		}
+		return
+	case "albums":
+		if len(cfg.AlbumManifest) == 0 {
+			log.Fatal("Usage: -albums <album manifest> albums")
+		}
+		if err := refreshAlbums(svc, cfg.Bucket, nil); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "events":
+		eventFlags := flag.NewFlagSet("events", flag.ExitOnError)
+		gapPtr := eventFlags.Duration("gap", 6*time.Hour, "a longer gap between photos starts a new event")
+		distancePtr := eventFlags.Float64("distance", 0, "km between photos that starts a new event, 0 ignores locations")
+		gazetteerPtr := eventFlags.String("gazetteer", cfg.Gazetteer, "tab separated file of places used to name events, eg. GeoNames cities15000.txt")
+		minPtr := eventFlags.Int("min", 1, "smallest number of files in an event")
+		dryRunPtr := eventFlags.Bool("dry-run", false, "only log the events, don't create albums")
+		eventFlags.Parse(flag.Args()[1:])
+		if len(*inDirNamePtr) == 0 || *gapPtr <= 0 || *distancePtr < 0 {
+			log.Fatal("Usage: -i <library directory> events [-gap 6h] [-distance 50] [-gazetteer cities15000.txt] [-min 1] [-dry-run]")
+		}
+		options := eventOptions{Gap: *gapPtr, Distance: *distancePtr, MinFiles: *minPtr}
+		if err := createEvents(svc, cfg.Bucket, *inDirNamePtr, *gazetteerPtr, options, *dryRunPtr); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "unshare":
+		unshareFlags := flag.NewFlagSet("unshare", flag.ExitOnError)
+		expiredPtr := unshareFlags.Bool("expired", false, "remove all expired share pages")
+		unshareFlags.Parse(flag.Args()[1:])
+		if *expiredPtr {
+			err = unshareExpired(svc, cfg.Bucket)
+		}
+		for _, id := range unshareFlags.Args() {
+			if err == nil {
+				err = unshare(svc, cfg.Bucket, id)
+			}
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	default:
+		log.Fatal("Unknown command: ", flag.Arg(0))
+	}
+
+	log.Info("Overwrite: ", cfg.Overwrite)
+	if len(*inDirNamePtr) == 0 {
+		log.Fatal("Error, need to define an input directory.")
+	}
+	if cfg.Move && len(*outDirNamePtr) == 0 && len(cfg.Bucket) == 0 {
+		log.Fatal("Error, -move needs an output directory or bucket to copy the files to.")
+	}
+
+	process(svc, *inDirNamePtr, *outDirNamePtr, cfg.Bucket)
 	log.Info("Done processing: ", *inDirNamePtr)
 }
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"os/exec"
+	filepath "path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata/golden")
+
+const testBucket = "photos"
+
+// fixture A file to create in the input directory and the date it was taken
+type fixture struct {
+	fileName string
+	date     time.Time
+}
+
+func day(year int, month time.Month, dayOfMonth int) time.Time {
+	return time.Date(year, month, dayOfMonth, 12, 0, 0, 0, time.Local)
+}
+
+var photoFixtures = []fixture{
+	{"IMG_0001.jpg", day(2016, time.May, 13)},
+	{"IMG_0002.JPG", day(2016, time.May, 13)},
+	{"holiday/IMG_0003.jpg", day(2016, time.May, 14)},
+	{"IMG_0006.jpeg", day(2016, time.May, 13)},
+	{"IMG_0004.jpg", day(2017, time.January, 1)},
+	{".hidden/IMG_0005.jpg", day(2017, time.January, 1)}, // dot folders are skipped
+	{"notes.txt", day(2017, time.January, 1)},            // not a photo or movie
+}
+
+// createFixtures Creates the input directory, photos are generated as mtimes can't be kept in git
+func createFixtures(t *testing.T, inDir string, fixtures []fixture) {
+	for _, f := range fixtures {
+		fileName := filepath.Join(inDir, filepath.FromSlash(f.fileName))
+		if err := os.MkdirAll(filepath.Dir(fileName), 0777); err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case IsJpeg(fileName):
+			writeTestJPEG(t, fileName, f.date)
+		case IsMovie(fileName):
+			cmd := exec.Command("ffmpeg", "-f", "lavfi", "-i", "testsrc=duration=1:size=64x48:rate=5", "-y", fileName)
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("unable to create %s: %v\n%s", fileName, err, out)
+			}
+			os.Chtimes(fileName, f.date, f.date)
+		default:
+			os.WriteFile(fileName, []byte("not a photo"), 0666)
+		}
+	}
+}
+
+// setupProcess Points the config at a fake bucket, restoring it once the test is done
+func setupProcess(t *testing.T) *fakeS3 {
+	old := cfg
+	t.Cleanup(func() { cfg = old })
+	cfg = DefaultProfile()
+	photoInfo = make(map[string]PhotoInfo)
+	unpublishedFiles = make(map[string]bool)
+	livePairs = make(map[string]string)
+	cfg.Bucket = testBucket
+	cfg.KeepMoviesOriginal = true // shrinking isn't reproducible across ffmpeg versions
+	return newFakeS3()
+}
+
+// checkGolden Compares the keys in the bucket and the generated indexes and pages with testdata/golden/name
+func checkGolden(t *testing.T, fake *fakeS3, name string) {
+	t.Helper()
+	goldenDir := filepath.Join("testdata", "golden", name)
+	keys := fake.Keys(testBucket)
+	files := map[string][]byte{"keys.txt": []byte(strings.Join(keys, "\n") + "\n")}
+	for _, key := range keys {
+		if IsIndexFile(key) {
+			files[key] = fake.Object(testBucket, key)
+		}
+	}
+
+	if *update {
+		os.RemoveAll(goldenDir)
+		for key, data := range files {
+			fileName := filepath.Join(goldenDir, filepath.FromSlash(key))
+			os.MkdirAll(filepath.Dir(fileName), 0777)
+			if err := os.WriteFile(fileName, data, 0666); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return
+	}
+
+	for key, data := range files {
+		expected, err := os.ReadFile(filepath.Join(goldenDir, filepath.FromSlash(key)))
+		if err != nil {
+			t.Errorf("%s: %v, run go test -update to create the golden files", key, err)
+			continue
+		}
+		if !bytes.Equal(expected, data) {
+			t.Errorf("%s differs from golden file:\n%s\nexpected:\n%s", key, data, expected)
+		}
+	}
+	filepath.Walk(goldenDir, func(fileName string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			key, _ := filepath.Rel(goldenDir, fileName)
+			if _, ok := files[filepath.ToSlash(key)]; !ok {
+				t.Errorf("%s is in the golden files but wasn't generated", key)
+			}
+		}
+		return nil
+	})
+}
+
+func TestProcessGolden(t *testing.T) {
+	fake := setupProcess(t)
+	inDir := t.TempDir()
+	createFixtures(t, inDir, photoFixtures)
+
+	process(fake, inDir, "", testBucket)
+	checkGolden(t, fake, "photos")
+
+	// Running again without -f shouldn't upload anything
+	fake.ResetPuts()
+	process(fake, inDir, "", testBucket)
+	if len(fake.puts) != 0 {
+		t.Errorf("expected nothing to be uploaded when running again, got %v", fake.puts)
+	}
+	checkGolden(t, fake, "photos")
+
+	// With -f everything is uploaded again, giving the same result
+	fake.ResetPuts()
+	cfg.Overwrite = true
+	process(fake, inDir, "", testBucket)
+	if !strings.Contains(strings.Join(fake.puts, " "), "2016/2016-05-13/IMG_0001.jpg") {
+		t.Errorf("expected originals to be uploaded again with overwrite, got %v", fake.puts)
+	}
+	checkGolden(t, fake, "photos")
+	cfg.Overwrite = false
+
+	// Adding a photo to an existing date only updates that date
+	createFixtures(t, inDir, []fixture{{"IMG_0006.jpg", day(2016, time.May, 13)}})
+	process(fake, inDir, "", testBucket)
+	checkGolden(t, fake, "photos-added")
+}
+
+func TestProcessMovies(t *testing.T) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		t.Skip("ffmpeg not installed")
+	}
+	fake := setupProcess(t)
+	inDir := t.TempDir()
+	createFixtures(t, inDir, []fixture{
+		{"IMG_0001.jpg", day(2016, time.May, 13)},
+		{"MOV_0001.mp4", day(2016, time.May, 13)},
+		{"MOV_0002.mov", day(2016, time.May, 14)},
+	})
+
+	process(fake, inDir, "", testBucket)
+
+	expected := []string{
+		"2016/2016-05-13/IMG_0001.jpg",
+		"2016/2016-05-13/MOV_0001.mp4",
+		"2016/2016-05-13/index.html",
+		"2016/2016-05-13/photos.json",
+		"2016/2016-05-14/MOV_0002.mov",
+		"2016/2016-05-14/index.html",
+		"2016/2016-05-14/photos.json",
+		"2016/dates.json",
+		"2016/index.html",
+		"_renditions/2016/2016-05-13/IMG_0001.jpg/thumb.jpg",
+		"_renditions/2016/2016-05-13/MOV_0001.mp4/thumb.jpg",
+		"_renditions/2016/2016-05-14/MOV_0002.mov/thumb.jpg",
+		"_renditions/manifest.json",
+		"index.html",
+		"years.json",
+	}
+	if keys := strings.Join(fake.Keys(testBucket), "\n"); keys != strings.Join(expected, "\n") {
+		t.Errorf("unexpected keys:\n%s\nexpected:\n%s", keys, strings.Join(expected, "\n"))
+	}
+	var photos struct {
+		Files []string             `json:"files"`
+		Info  map[string]PhotoInfo `json:"info"`
+	}
+	json.Unmarshal(fake.Object(testBucket, "2016/2016-05-13/photos.json"), &photos)
+	if strings.Join(photos.Files, ",") != "IMG_0001.jpg,MOV_0001.mp4" {
+		t.Errorf("unexpected files in photos.json: %v", photos.Files)
+	}
+	if photos.Info["MOV_0001.mp4"].Taken != "2016-05-13T12:00:00" {
+		t.Errorf("expected the movie's date taken in photos.json, got %v", photos.Info)
+	}
+}
+
+func TestMoveKeepsUntouched(t *testing.T) {
+	fake := setupProcess(t)
+	inDir := t.TempDir()
+	createFixtures(t, inDir, []fixture{{"IMG_0001.jpg", day(2016, time.May, 13)}})
+	cfg.Move = true
+	cfg.Privacy = PrivacyStripAll
+	cfg.StripOriginals = true
+	cfg.OriginalsPrefix = ""
+
+	// Only a stripped copy was uploaded, so the source is the only untouched original left
+	process(fake, inDir, "", testBucket)
+	if _, err := os.Stat(filepath.Join(inDir, "IMG_0001.jpg")); err != nil {
+		t.Errorf("expected the source to be kept: %v", err)
+	}
+
+	cfg.OriginalsPrefix = "originals/"
+	cfg.Overwrite = true
+	process(fake, inDir, "", testBucket)
+	if fake.Object(testBucket, "originals/2016/2016-05-13/IMG_0001.jpg") == nil {
+		t.Fatal("expected the untouched original to be uploaded")
+	}
+	if _, err := os.Stat(filepath.Join(inDir, "IMG_0001.jpg")); !os.IsNotExist(err) {
+		t.Errorf("expected the source to be removed once the original was uploaded: %v", err)
+	}
+}
+
+func TestMoveToTrash(t *testing.T) {
+	setupProcess(t)
+	inDir, trashDir := t.TempDir(), t.TempDir()
+	cfg.TrashDir = trashDir
+	importedDir := filepath.Join(trashDir, "imported-"+time.Now().Format("2006-01-02"))
+
+	// Files with the same name from different folders are kept apart
+	for i, dirName := range []string{"a", "b", "c"} {
+		sourceFile := filepath.Join(inDir, dirName, "IMG_0001.jpg")
+		os.MkdirAll(filepath.Dir(sourceFile), 0777)
+		os.WriteFile(sourceFile, []byte(dirName), 0666)
+		if err := removeSourceFile(sourceFile); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(sourceFile); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be moved: %v", sourceFile, err)
+		}
+		trashFile := filepath.Join(importedDir, []string{"IMG_0001.jpg", "IMG_0001_1.jpg", "IMG_0001_2.jpg"}[i])
+		if data, err := os.ReadFile(trashFile); err != nil || string(data) != dirName {
+			t.Errorf("expected %s in %s, got %q: %v", dirName, trashFile, data, err)
+		}
+	}
+
+	// Renaming fails across drives, so the file is copied and checked before the source goes
+	defer func(old func(string, string) error) { renameFile = old }(renameFile)
+	renameFile = func(string, string) error {
+		return &os.LinkError{Op: "rename", Err: errors.New("invalid cross-device link")}
+	}
+	sourceFile := filepath.Join(inDir, "IMG_0002.jpg")
+	os.WriteFile(sourceFile, []byte("card"), 0666)
+	mtime := day(2016, time.May, 13)
+	os.Chtimes(sourceFile, mtime, mtime)
+	if err := removeSourceFile(sourceFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(sourceFile); !os.IsNotExist(err) {
+		t.Errorf("expected the source to be removed after copying: %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(importedDir, "IMG_0002.jpg")); err != nil || !info.ModTime().Equal(mtime) {
+		t.Errorf("expected a copy with the same modification time in the trash: %v", err)
+	}
+
+	// Nothing is removed when the trash can't be written to
+	os.WriteFile(sourceFile, []byte("card"), 0666)
+	cfg.TrashDir = filepath.Join(inDir, "IMG_0002.jpg")
+	if err := removeSourceFile(sourceFile); err == nil {
+		t.Error("expected an error with a file as trash directory")
+	}
+	if _, err := os.Stat(sourceFile); err != nil {
+		t.Errorf("expected the source to be kept: %v", err)
+	}
+}
+
+func TestMoveToOutputDir(t *testing.T) {
+	fake := setupProcess(t)
+	inDir, outDir := t.TempDir(), t.TempDir()
+	createFixtures(t, inDir, []fixture{{"IMG_0001.jpg", day(2016, time.May, 13)}})
+	os.WriteFile(filepath.Join(inDir, "IMG_0001.jpg.xmp"), []byte("<x:xmpmeta/>"), 0666)
+	cfg.Move = true
+
+	process(fake, inDir, outDir, "")
+	for _, fileName := range []string{"IMG_0001.jpg", "IMG_0001.jpg.xmp"} {
+		if _, err := os.Stat(filepath.Join(inDir, fileName)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be moved: %v", fileName, err)
+		}
+		if _, err := os.Stat(filepath.Join(outDir, "2016", "2016-05-13", fileName)); err != nil {
+			t.Errorf("expected %s in the output directory: %v", fileName, err)
+		}
+	}
+
+	// A different file of the same size is already in the output directory
+	sourceFile := filepath.Join(inDir, "IMG_0002.jpg")
+	writeTestJPEG(t, sourceFile, day(2016, time.May, 13))
+	source, _ := os.ReadFile(sourceFile)
+	other := append([]byte{}, source...)
+	other[len(other)/2] ^= 0xff
+	os.WriteFile(filepath.Join(outDir, "2016", "2016-05-13", "IMG_0002.jpg"), other, 0666)
+	if err := processFile(fake, sourceFile, outDir, t.TempDir(), "", day(2016, time.May, 13)); err == nil {
+		t.Error("expected the copy to fail verification")
+	}
+	if data, err := os.ReadFile(sourceFile); err != nil || !bytes.Equal(data, source) {
+		t.Errorf("expected the source to be kept as the copy differs: %v", err)
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/exec"
+	filepath "path/filepath"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// Privacy policies for what is published about a photo
+const (
+	PrivacyKeep     = "keep"      // publish all metadata
+	PrivacyStripGPS = "strip-gps" // remove the location
+	PrivacyStripAll = "strip-all" // remove everything but the date taken and camera
+)
+
+// Geofence An area, eg. home, where the location of photos is always removed
+type Geofence struct {
+	Name   string  `yaml:"name" toml:"name"`
+	Lat    float64 `yaml:"lat" toml:"lat"`
+	Lon    float64 `yaml:"lon" toml:"lon"`
+	Radius float64 `yaml:"radius" toml:"radius"` // in metres
+}
+
+// inGeofence Checks whether a location is inside one of the configured geofences
+func inGeofence(lat, lon float64) bool {
+	for _, fence := range cfg.Geofences {
+		if distanceKm(lat, lon, fence.Lat, fence.Lon)*1000 <= fence.Radius {
+			return true
+		}
+	}
+	return false
+}
+
+// geofenced Checks whether a photo or movie was taken inside one of the configured geofences
+func geofenced(info PhotoInfo) bool {
+	return info.Lat != nil && info.Lon != nil && inGeofence(*info.Lat, *info.Lon)
+}
+
+// privacyPolicy Gets the policy for a photo, photos taken inside a geofence always lose their location
+func privacyPolicy(info PhotoInfo) string {
+	if cfg.Privacy == PrivacyKeep && geofenced(info) {
+		return PrivacyStripGPS
+	}
+	return cfg.Privacy
+}
+
+// stripPolicy Gets what to strip from the file published in the date folder. Only stripped originals lose
+// anything, except inside a geofence where the location would otherwise still be in the public file.
+func stripPolicy(info PhotoInfo) string {
+	if !cfg.StripOriginals && !geofenced(info) {
+		return PrivacyKeep
+	}
+	return privacyPolicy(info)
+}
+
+// publishedInfo Removes what the privacy policy strips from the metadata listed in photos.json and geo.json
+func publishedInfo(info PhotoInfo) PhotoInfo {
+	switch privacyPolicy(info) {
+	case PrivacyStripGPS:
+		info.Lat, info.Lon, info.Place = nil, nil, ""
+	case PrivacyStripAll:
+		// Faces is only a count, it is kept for picking covers
+		return PhotoInfo{Taken: info.Taken, Width: info.Width, Height: info.Height, Camera: info.Camera, Faces: info.Faces, Rating: info.Rating, Label: info.Label}
+	}
+	return info
+}
+
+// stripFile Writes a copy of a photo or movie without the metadata the policy removes into tmpDir,
+// returning the name of the copy
+func stripFile(sourceFile, tmpDir, policy string) (string, error) {
+	destFile := filepath.Join(tmpDir, "stripped-"+filepath.Base(sourceFile))
+	if IsMovie(sourceFile) {
+		// Remux without the container metadata, which is where phones keep the location
+		cmd := exec.Command("ffmpeg", "-y", "-i", sourceFile, "-map", "0", "-map_metadata", "-1", "-c", "copy", destFile)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return "", fmt.Errorf("unable to strip metadata from %s: %v\n%s", sourceFile, err, out)
+		}
+	} else {
+		data, err := os.ReadFile(sourceFile)
+		if err != nil {
+			return "", err
+		}
+		stripped, err := stripJPEG(data, policy)
+		if err != nil {
+			return "", fmt.Errorf("unable to strip metadata from %s: %v", sourceFile, err)
+		}
+		if err := os.WriteFile(destFile, stripped, 0666); err != nil {
+			return "", err
+		}
+	}
+	if stat, err := os.Stat(sourceFile); err == nil {
+		os.Chtimes(destFile, stat.ModTime(), stat.ModTime())
+	}
+	return destFile, nil
+}
+
+// JPEG markers
+const (
+	jpegSOI  = 0xD8
+	jpegEOI  = 0xD9
+	jpegSOS  = 0xDA
+	jpegAPP1 = 0xE1
+	jpegAPP2 = 0xE2
+	jpegCOM  = 0xFE
+)
+
+// stripJPEG Removes metadata from a jpeg without touching the image data. strip-gps blanks the GPS IFD in place so
+// the rest of the EXIF data stays valid and drops XMP packets with a location, strip-all replaces the EXIF data with
+// just the date taken, camera and orientation and drops every other metadata segment except colour profiles.
+func stripJPEG(data []byte, policy string) ([]byte, error) {
+	if policy == PrivacyKeep {
+		return data, nil
+	}
+	if len(data) < 4 || data[0] != 0xFF || data[1] != jpegSOI {
+		return nil, fmt.Errorf("not a jpeg")
+	}
+
+	var out bytes.Buffer
+	out.Write(data[:2])
+	var minimal []byte // written after the JFIF segment, which has to come first
+	if policy == PrivacyStripAll {
+		minimal = minimalExif(data)
+	}
+
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return nil, fmt.Errorf("invalid marker at %d", pos)
+		}
+		marker := data[pos+1]
+		if marker == 0xFF { // fill byte
+			pos++
+			continue
+		}
+		if marker == jpegEOI {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, fmt.Errorf("invalid segment length at %d", pos)
+		}
+		payload := data[pos+4 : end]
+
+		if marker == jpegSOS {
+			// Copy the entropy coded data up to the next marker, stuffed bytes and restarts are part of it
+			scanEnd := end
+			for scanEnd+1 < len(data) && !(data[scanEnd] == 0xFF && data[scanEnd+1] != 0 && (data[scanEnd+1] < 0xD0 || data[scanEnd+1] > 0xD7)) {
+				scanEnd++
+			}
+			if scanEnd+1 >= len(data) {
+				scanEnd = len(data)
+			}
+			out.Write(data[pos:scanEnd])
+			pos = scanEnd
+			continue
+		}
+
+		if minimal != nil && marker != 0xE0 {
+			writeSegment(&out, jpegAPP1, minimal)
+			minimal = nil
+		}
+
+		keep := true
+		switch {
+		case marker == jpegAPP1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")):
+			if policy == PrivacyStripAll {
+				keep = false
+			} else {
+				payload = append([]byte(nil), payload...)
+				blankGPS(payload[6:])
+			}
+		case marker == jpegAPP1:
+			// XMP, which can repeat the location
+			keep = policy != PrivacyStripAll && !bytes.Contains(payload, []byte("GPS"))
+		case marker == jpegAPP2 && bytes.HasPrefix(payload, []byte("MPF\x00")):
+			// Multi picture images carry their own EXIF data, only the primary image is kept
+			keep = false
+		case policy == PrivacyStripAll && (marker == jpegCOM || (marker >= 0xE3 && marker <= 0xEF)):
+			// Comments, IPTC and maker segments, JFIF (APP0) and ICC profiles (APP2) are kept
+			keep = marker == 0xEE // Adobe, needed to get the colours right for CMYK images
+		}
+		if keep {
+			writeSegment(&out, marker, payload)
+		}
+		pos = end
+	}
+	// Anything after the image, eg. the other pictures of an MPF file, is dropped
+	out.Write([]byte{0xFF, jpegEOI})
+	return out.Bytes(), nil
+}
+
+// writeSegment Writes a jpeg segment with its length
+func writeSegment(out *bytes.Buffer, marker byte, payload []byte) {
+	out.Write([]byte{0xFF, marker})
+	binary.Write(out, binary.BigEndian, uint16(len(payload)+2))
+	out.Write(payload)
+}
+
+// tiffTypeSizes Size in bytes of each TIFF field type
+var tiffTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+const exifGPSIFDTag = 0x8825
+
+// blankGPS Zeroes the entries and values of the GPS IFD in a TIFF header, leaving an empty IFD so every other offset
+// stays valid. Nothing is changed if the header can't be read.
+func blankGPS(tiff []byte) {
+	if len(tiff) < 8 {
+		return
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return
+	}
+	readIFD := func(offset int) (int, bool) {
+		if offset < 8 || offset+2 > len(tiff) {
+			return 0, false
+		}
+		count := int(order.Uint16(tiff[offset:]))
+		return count, offset+2+count*12 <= len(tiff)
+	}
+
+	ifd0 := int(order.Uint32(tiff[4:]))
+	count, ok := readIFD(ifd0)
+	if !ok {
+		return
+	}
+	for i := 0; i < count; i++ {
+		entry := tiff[ifd0+2+i*12:]
+		if order.Uint16(entry) != exifGPSIFDTag {
+			continue
+		}
+		gps := int(order.Uint32(entry[8:]))
+		gpsCount, ok := readIFD(gps)
+		if !ok {
+			return
+		}
+		for j := 0; j < gpsCount; j++ {
+			field := tiff[gps+2+j*12 : gps+2+j*12+12]
+			size := tiffTypeSizes[order.Uint16(field[2:])] * int(order.Uint32(field[4:]))
+			if size > 4 {
+				if offset := int(order.Uint32(field[8:])); offset >= 0 && offset+size <= len(tiff) {
+					zeroBytes(tiff[offset : offset+size])
+				}
+			}
+			zeroBytes(field)
+		}
+		order.PutUint16(tiff[gps:], 0)
+		if next := gps + 2 + gpsCount*12; next+4 <= len(tiff) {
+			zeroBytes(tiff[next : next+4])
+		}
+	}
+}
+
+// zeroBytes Overwrites data with zeros
+func zeroBytes(data []byte) {
+	for i := range data {
+		data[i] = 0
+	}
+}
+
+// tiffEntry A field to write into a TIFF header
+type tiffEntry struct {
+	tag  uint16
+	typ  uint16
+	data []byte
+}
+
+// asciiEntry A NUL terminated string field
+func asciiEntry(tag uint16, value string) tiffEntry {
+	return tiffEntry{tag, 2, append([]byte(value), 0)}
+}
+
+// minimalExif Builds the EXIF segment kept by strip-all, with the camera, orientation and date taken of the photo.
+// Returns nil if the photo has none of these.
+func minimalExif(data []byte) []byte {
+	x, err := exif.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	var ifd0, exifIFD []tiffEntry
+	if value := exifString(x, exif.Make); len(value) > 0 {
+		ifd0 = append(ifd0, asciiEntry(0x010F, value))
+	}
+	if value := exifString(x, exif.Model); len(value) > 0 {
+		ifd0 = append(ifd0, asciiEntry(0x0110, value))
+	}
+	if tag, err := x.Get(exif.Orientation); err == nil {
+		if orientation, err := tag.Int(0); err == nil {
+			value := make([]byte, 2)
+			binary.BigEndian.PutUint16(value, uint16(orientation))
+			ifd0 = append(ifd0, tiffEntry{0x0112, 3, value})
+		}
+	}
+	if value := exifString(x, exif.DateTimeOriginal); len(value) > 0 {
+		exifIFD = append(exifIFD, asciiEntry(0x9003, value))
+	}
+	if len(ifd0) == 0 && len(exifIFD) == 0 {
+		return nil
+	}
+	if len(exifIFD) > 0 {
+		ifd0 = append(ifd0, tiffEntry{0x8769, 4, make([]byte, 4)}) // filled in once the offset is known
+	}
+
+	var tiff bytes.Buffer
+	tiff.WriteString("MM\x00\x2a")
+	binary.Write(&tiff, binary.BigEndian, uint32(8))
+	exifOffset := 8 + ifdSize(ifd0)
+	if len(exifIFD) > 0 {
+		binary.BigEndian.PutUint32(ifd0[len(ifd0)-1].data, uint32(exifOffset))
+	}
+	writeIFD(&tiff, ifd0)
+	if len(exifIFD) > 0 {
+		writeIFD(&tiff, exifIFD)
+	}
+	return append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+}
+
+// ifdSize Size of an IFD including the values that don't fit in its entries
+func ifdSize(entries []tiffEntry) int {
+	size := 2 + len(entries)*12 + 4
+	for _, entry := range entries {
+		if len(entry.data) > 4 {
+			size += len(entry.data) + len(entry.data)%2
+		}
+	}
+	return size
+}
+
+// writeIFD Writes big endian IFD entries followed by their values, the IFD starts at the current length of tiff.
+// Entries must be sorted by tag.
+func writeIFD(tiff *bytes.Buffer, entries []tiffEntry) {
+	dataOffset := tiff.Len() + 2 + len(entries)*12 + 4
+	var values bytes.Buffer
+	binary.Write(tiff, binary.BigEndian, uint16(len(entries)))
+	for _, entry := range entries {
+		binary.Write(tiff, binary.BigEndian, entry.tag)
+		binary.Write(tiff, binary.BigEndian, entry.typ)
+		binary.Write(tiff, binary.BigEndian, uint32(len(entry.data)/tiffTypeSizes[entry.typ]))
+		if len(entry.data) <= 4 {
+			tiff.Write(append(append([]byte(nil), entry.data...), make([]byte, 4-len(entry.data))...))
+			continue
+		}
+		binary.Write(tiff, binary.BigEndian, uint32(dataOffset+values.Len()))
+		values.Write(entry.data)
+		if len(entry.data)%2 == 1 {
+			values.WriteByte(0) // values start on a word boundary
+		}
+	}
+	binary.Write(tiff, binary.BigEndian, uint32(0)) // no next IFD
+	tiff.Write(values.Bytes())
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"os"
+	filepath "path/filepath"
+	"testing"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// rationals Encodes TIFF rationals
+func rationals(values ...uint32) []byte {
+	data := make([]byte, 4*len(values))
+	for i, value := range values {
+		binary.BigEndian.PutUint32(data[i*4:], value)
+	}
+	return data
+}
+
+// testJPEGWithGPS Creates a jpeg taken in Kyoto, with the location in both the EXIF and XMP data and a comment
+func testJPEGWithGPS(t *testing.T) []byte {
+	var img bytes.Buffer
+	if err := jpeg.Encode(&img, image.NewRGBA(image.Rect(0, 0, 32, 24)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	gps := []tiffEntry{
+		{0x0001, 2, []byte("N\x00")},
+		{0x0002, 5, rationals(35, 1, 0, 1, 4176, 100)},
+		{0x0003, 2, []byte("E\x00")},
+		{0x0004, 5, rationals(135, 1, 46, 1, 520, 100)},
+	}
+	ifd0 := []tiffEntry{asciiEntry(0x010F, "Canon"), asciiEntry(0x0110, "EOS 5D"), {0x8769, 4, make([]byte, 4)}, {0x8825, 4, make([]byte, 4)}}
+	exifIFD := []tiffEntry{asciiEntry(0x9003, "2016:05:13 09:30:00")}
+	exifOffset := 8 + ifdSize(ifd0)
+	binary.BigEndian.PutUint32(ifd0[2].data, uint32(exifOffset))
+	binary.BigEndian.PutUint32(ifd0[3].data, uint32(exifOffset+ifdSize(exifIFD)))
+	var tiff bytes.Buffer
+	tiff.WriteString("MM\x00\x2a\x00\x00\x00\x08")
+	writeIFD(&tiff, ifd0)
+	writeIFD(&tiff, exifIFD)
+	writeIFD(&tiff, gps)
+
+	var out bytes.Buffer
+	out.Write(img.Bytes()[:2])
+	writeSegment(&out, jpegAPP1, append([]byte("Exif\x00\x00"), tiff.Bytes()...))
+	writeSegment(&out, jpegAPP1, []byte(xmpNamespace+`<x:xmpmeta><rdf:Description exif:GPSLatitude="35,0.696N"/></x:xmpmeta>`))
+	writeSegment(&out, jpegCOM, []byte("taken at home"))
+	out.Write(img.Bytes()[2:])
+	return out.Bytes()
+}
+
+func TestStripJPEG(t *testing.T) {
+	original := testJPEGWithGPS(t)
+	if x, err := exif.Decode(bytes.NewReader(original)); err != nil {
+		t.Fatal(err)
+	} else if lat, lon, err := x.LatLong(); err != nil || int(lat) != 35 || int(lon) != 135 {
+		t.Fatalf("test photo should have a location, got %v, %v: %v", lat, lon, err)
+	}
+
+	if kept, _ := stripJPEG(original, PrivacyKeep); !bytes.Equal(kept, original) {
+		t.Error("expected keep to leave the photo alone")
+	}
+
+	for _, policy := range []string{PrivacyStripGPS, PrivacyStripAll} {
+		stripped, err := stripJPEG(original, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(stripped)); err != nil {
+			t.Errorf("%s: stripped photo doesn't decode: %v", policy, err)
+		}
+		x, err := exif.Decode(bytes.NewReader(stripped))
+		if err != nil {
+			t.Fatalf("%s: %v", policy, err)
+		}
+		if _, _, err := x.LatLong(); err == nil {
+			t.Errorf("%s: expected the location to be removed", policy)
+		}
+		if exifString(x, exif.Model) != "EOS 5D" || exifString(x, exif.DateTimeOriginal) != "2016:05:13 09:30:00" {
+			t.Errorf("%s: expected the camera and date taken to be kept", policy)
+		}
+		if bytes.Contains(stripped, []byte("GPSLatitude")) || bytes.Contains(stripped, rationals(135, 1, 46, 1, 520, 100)) {
+			t.Errorf("%s: the location is still in the file", policy)
+		}
+		if hasComment := bytes.Contains(stripped, []byte("taken at home")); hasComment != (policy == PrivacyStripGPS) {
+			t.Errorf("%s: unexpected comment in the file", policy)
+		}
+	}
+}
+
+func TestPublishedInfo(t *testing.T) {
+	setupProcess(t)
+	homeLat, homeLon := 51.5007, -0.1246
+	awayLat, awayLon := 35.0116, 135.7681
+	home := PhotoInfo{Camera: "Canon EOS 5D", Lens: "EF 50mm", Lat: &homeLat, Lon: &homeLon}
+	away := PhotoInfo{Camera: "Canon EOS 5D", Lens: "EF 50mm", Lat: &awayLat, Lon: &awayLon}
+
+	if info := publishedInfo(home); info.Lat == nil {
+		t.Error("expected locations to be kept by default")
+	}
+	cfg.Geofences = []Geofence{{Name: "home", Lat: 51.5, Lon: -0.125, Radius: 500}}
+	if info := publishedInfo(home); info.Lat != nil || info.Lens != "EF 50mm" {
+		t.Errorf("expected only the location to be removed inside the geofence, got %+v", info)
+	}
+	if info := publishedInfo(away); info.Lat == nil {
+		t.Error("expected the location to be kept outside the geofence")
+	}
+	cfg.Privacy = PrivacyStripAll
+	if info := publishedInfo(away); info.Lat != nil || info.Lens != "" || info.Camera != "Canon EOS 5D" {
+		t.Errorf("expected only the camera to be kept, got %+v", info)
+	}
+}
+
+func TestProcessStripsOriginals(t *testing.T) {
+	fake := setupProcess(t)
+	cfg.Privacy = PrivacyStripGPS
+	cfg.StripOriginals = true
+	cfg.OriginalsStorage = "DEEP_ARCHIVE"
+	inDir := t.TempDir()
+	original := testJPEGWithGPS(t)
+	os.WriteFile(filepath.Join(inDir, "IMG_0001.jpg"), original, 0666)
+
+	process(fake, inDir, "", testBucket)
+
+	if !bytes.Equal(fake.Object(testBucket, "originals/2016/2016-05-13/IMG_0001.jpg"), original) {
+		t.Error("expected the untouched original in the originals prefix")
+	}
+	published := fake.Object(testBucket, "2016/2016-05-13/IMG_0001.jpg")
+	if x, err := exif.Decode(bytes.NewReader(published)); err != nil {
+		t.Errorf("expected the published copy to keep its EXIF data: %v", err)
+	} else if _, _, err := x.LatLong(); err == nil {
+		t.Error("expected the location to be removed from the published copy")
+	}
+	if bytes.Contains(fake.Object(testBucket, "2016/2016-05-13/photos.json"), []byte(`"lat"`)) {
+		t.Error("expected the location to be left out of photos.json")
+	}
+	if acl := aclForKey("originals/2016/2016-05-13/IMG_0001.jpg"); acl != "" {
+		t.Errorf("expected untouched originals to be private, got %s", acl)
+	}
+
+	// Restoring gets the untouched original back
+	jobs, err := getRestoreJobs(fake, testBucket, []string{"2016"}, t.TempDir())
+	if err != nil || len(jobs) != 1 || *jobs[0].obj.Key != "originals/2016/2016-05-13/IMG_0001.jpg" {
+		t.Errorf("expected to restore the untouched original, got %v: %v", jobs, err)
+	}
+}
+
+func TestProcessGeofenced(t *testing.T) {
+	fake := setupProcess(t)
+	cfg.Geofences = []Geofence{{Name: "kyoto", Lat: 35.0116, Lon: 135.7681, Radius: 500}}
+	inDir := t.TempDir()
+	original := testJPEGWithGPS(t)
+	os.WriteFile(filepath.Join(inDir, "IMG_0001.jpg"), original, 0666)
+
+	// Without -strip-originals the published copy still loses the location inside a geofence
+	process(fake, inDir, "", testBucket)
+
+	if !bytes.Equal(fake.Object(testBucket, "originals/2016/2016-05-13/IMG_0001.jpg"), original) {
+		t.Error("expected the untouched original in the originals prefix")
+	}
+	published := fake.Object(testBucket, "2016/2016-05-13/IMG_0001.jpg")
+	if x, err := exif.Decode(bytes.NewReader(published)); err != nil {
+		t.Errorf("expected the published copy to keep its EXIF data: %v", err)
+	} else if _, _, err := x.LatLong(); err == nil {
+		t.Error("expected the location to be removed from the published copy")
+	}
+}
+
+func TestMovieLocation(t *testing.T) {
+	box := func(name string, content []byte) []byte {
+		data := make([]byte, 8, 8+len(content))
+		binary.BigEndian.PutUint32(data, uint32(8+len(content)))
+		copy(data[4:], name)
+		return append(data, content...)
+	}
+	xyz := append([]byte{0, 18, 0x15, 0xc7}, "+51.5007-000.1246/"...)
+	movie := append(box("ftyp", []byte("qt  \x00\x00\x00\x00")), box("mdat", make([]byte, 100))...)
+	movie = append(movie, box("moov", box("udta", box("\xa9xyz", xyz)))...)
+	fileName := filepath.Join(t.TempDir(), "MOV_0001.mov")
+	os.WriteFile(fileName, movie, 0666)
+
+	info := readFileInfo(fileName)
+	if info.Lat == nil || info.Lon == nil || *info.Lat != 51.5007 || *info.Lon != -0.1246 {
+		t.Fatalf("expected the movie's location, got %+v", info)
+	}
+
+	setupProcess(t)
+	cfg.Geofences = []Geofence{{Name: "home", Lat: 51.5, Lon: -0.125, Radius: 500}}
+	if policy := stripPolicy(info); policy != PrivacyStripGPS {
+		t.Errorf("expected movies inside a geofence to be stripped, got %s", policy)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// renditionsPrefix Where thumbnails and other files generated from the originals are kept, as
+// _renditions/<key of the original>/<size>.jpg, so they can never collide with an original
+const renditionsPrefix = "_renditions/"
+
+// renditionsManifest Lists the renditions of every original, keyed by the original
+const renditionsManifest = renditionsPrefix + "manifest.json"
+
+// thumbSize Name of the thumbnail rendition, cfg.ThumbnailSize() pixels wide
+const thumbSize = "thumb"
+
+// legacyThumbSuffix Older versions stored thumbnails next to the originals, eg. IMG_0001_thumb.jpg
+const legacyThumbSuffix = "_thumb.jpg"
+
+// renditionKey Gets the key of a rendition of an original
+func renditionKey(key, size string) string {
+	return renditionsPrefix + key + "/" + size + ".jpg"
+}
+
+// thumbKey Gets the thumbnail key for an original, the same way the website does
+func thumbKey(key string) string {
+	return renditionKey(key, thumbSize)
+}
+
+// IsRendition Checks whether a key is a thumbnail or other rendition generated from an original
+func IsRendition(key string) bool {
+	return strings.HasPrefix(key, renditionsPrefix) && key != renditionsManifest
+}
+
+// renditionOf Splits a rendition key into the key of its original and the size
+func renditionOf(key string) (string, string, bool) {
+	if !IsRendition(key) || path.Ext(key) != ".jpg" {
+		return "", "", false
+	}
+	original, size := path.Split(strings.TrimPrefix(key, renditionsPrefix))
+	if len(original) == 0 {
+		return "", "", false
+	}
+	return strings.TrimSuffix(original, "/"), strings.TrimSuffix(size, ".jpg"), true
+}
+
+// legacyThumbs Finds the thumbnails older versions stored next to the originals, mapped to their originals.
+// An X_thumb.jpg only counts as a thumbnail when there is an original X next to it and neither of them is a
+// known original (see knownOriginals), as this version gives X its renditions and uploads photos named like
+// thumbnails as they are.
+func legacyThumbs(objects []*s3.Object, known map[string]bool) map[string]string {
+	stems := make(map[string]string)
+	for _, obj := range objects {
+		if !strings.HasSuffix(*obj.Key, legacyThumbSuffix) && !IsIndexFile(*obj.Key) {
+			stems[strings.TrimSuffix(*obj.Key, path.Ext(*obj.Key))] = *obj.Key
+		}
+		if original, _, ok := renditionOf(*obj.Key); ok && known != nil {
+			known[original] = true
+		}
+	}
+	thumbs := make(map[string]string)
+	for _, obj := range objects {
+		if !strings.HasSuffix(*obj.Key, legacyThumbSuffix) || known[*obj.Key] {
+			continue
+		}
+		if original, ok := stems[strings.TrimSuffix(*obj.Key, legacyThumbSuffix)]; ok && !known[original] {
+			thumbs[*obj.Key] = original
+		}
+	}
+	return thumbs
+}
+
+// knownOriginals Collects the keys known to be originals rather than legacy thumbnails: those with renditions
+// in the manifest, those published in this run and files named like thumbnails that photos.json lists. Only
+// read when the objects include something named like a thumbnail.
+func knownOriginals(svc s3iface.S3API, bucketName string, objects []*s3.Object) map[string]bool {
+	known := make(map[string]bool)
+	listed := make(map[string]bool)
+	for _, obj := range objects {
+		folderName := path.Dir(*obj.Key)
+		if !strings.HasSuffix(*obj.Key, legacyThumbSuffix) || !dayKeyRegExp.MatchString(*obj.Key) || listed[folderName] {
+			continue
+		}
+		listed[folderName] = true
+		var photos struct {
+			Files []string `json:"files"`
+		}
+		if reader := GetFromS3(svc, folderName+"/photos.json", bucketName); reader != nil {
+			json.NewDecoder(reader).Decode(&photos)
+		}
+		for _, fileName := range photos.Files {
+			if strings.HasSuffix(fileName, legacyThumbSuffix) {
+				known[folderName+"/"+fileName] = true
+			}
+		}
+	}
+	if len(listed) == 0 {
+		return known
+	}
+
+	var manifest renditionManifest
+	if reader := GetFromS3(svc, renditionsManifest, bucketName); reader != nil {
+		json.NewDecoder(reader).Decode(&manifest)
+	}
+	for key := range manifest.Renditions {
+		known[key] = true
+	}
+	for key := range photoInfo {
+		known[key] = true
+	}
+	return known
+}
+
+// folderRenditions Lists the renditions of the files in a folder, keyed by file name. Thumbnails are also
+// returned as links relative to the root of the bucket, or presigned for private buckets.
+func folderRenditions(svc s3iface.S3API, bucketName, folderName string) (map[string][]string, map[string]string) {
+	renditions := make(map[string][]string)
+	thumbs := make(map[string]string)
+	for _, obj := range GetObjectsFromBucket(svc, bucketName, renditionsPrefix+folderName+"/") {
+		original, size, ok := renditionOf(*obj.Key)
+		if !ok || path.Dir(original) != folderName {
+			continue
+		}
+		fileName := path.Base(original)
+		renditions[fileName] = append(renditions[fileName], size)
+		if size == thumbSize {
+			thumbs[fileName] = *obj.Key
+			if cfg.Access == AccessPresigned {
+				thumbs[fileName] = PresignURL(svc, *obj.Key, bucketName, cfg.Expiry())
+			}
+		}
+	}
+	return renditions, thumbs
+}
+
+// existingThumbs Lists the thumbnails in the folders of the keys, so pages only link to the ones that exist
+func existingThumbs(svc s3iface.S3API, bucketName string, keys []string) map[string]bool {
+	thumbs := make(map[string]bool)
+	listed := make(map[string]bool)
+	for _, key := range keys {
+		if folderName := path.Dir(key); !listed[folderName] {
+			listed[folderName] = true
+			for _, obj := range GetObjectsFromBucket(svc, bucketName, renditionsPrefix+folderName+"/") {
+				thumbs[*obj.Key] = true
+			}
+		}
+	}
+	return thumbs
+}
+
+// renditionManifest Contents of _renditions/manifest.json
+type renditionManifest struct {
+	Renditions map[string][]string `json:"renditions"` // sizes of each original, eg. thumb
+}
+
+// updateRenditions Replaces the renditions of a folder's files in the manifest
+func updateRenditions(svc s3iface.S3API, bucketName, folderName string, fileNames []string, renditions map[string][]string) {
+	manifest := renditionManifest{Renditions: make(map[string][]string)}
+	var oldJSON []byte
+	if reader := GetFromS3(svc, renditionsManifest, bucketName); reader != nil {
+		json.NewDecoder(reader).Decode(&manifest)
+		oldJSON, _ = json.Marshal(manifest)
+	}
+	if manifest.Renditions == nil {
+		manifest.Renditions = make(map[string][]string)
+	}
+
+	for key := range manifest.Renditions {
+		if path.Dir(key) == folderName {
+			delete(manifest.Renditions, key)
+		}
+	}
+	for _, fileName := range fileNames {
+		if sizes := renditions[fileName]; len(sizes) > 0 {
+			sort.Strings(sizes)
+			manifest.Renditions[folderName+"/"+fileName] = sizes
+		}
+	}
+
+	manifestJSON, _ := json.Marshal(manifest)
+	if string(manifestJSON) == string(oldJSON) {
+		return
+	}
+	UploadToS3(svc, renditionsManifest, bucketName, manifestJSON, int64(len(manifestJSON)), true)
+}
+
+// migrateThumbnails Moves the thumbnails older versions stored next to the originals into the renditions
+// prefix, then regenerates the indexes and pages of the dates that had any and of every album. Returns the
+// number of thumbnails moved, or that would be moved when it is a dry run.
+func migrateThumbnails(svc s3iface.S3API, bucketName string, targets []string, dryRun bool) (int, error) {
+	if len(targets) == 0 {
+		targets = []string{""}
+	}
+	moved := 0
+	var folders []time.Time
+	seen := make(map[string]bool)
+	for _, target := range targets {
+		dates, err := parseDateRange(target)
+		if err != nil {
+			return moved, err
+		}
+		objects := GetObjectsFromBucket(svc, bucketName, dates.prefix)
+		thumbs := legacyThumbs(objects, knownOriginals(svc, bucketName, objects))
+		for _, obj := range objects {
+			original, ok := thumbs[*obj.Key]
+			matches := dayKeyRegExp.FindStringSubmatch(*obj.Key)
+			if !ok || matches == nil {
+				continue
+			}
+			date, err := time.Parse("2006-01-02", matches[1])
+			if err != nil || !dates.Contains(date) {
+				continue
+			}
+			if dryRun {
+				log.Info("Would move ", *obj.Key, " to ", thumbKey(original))
+				moved++
+				continue
+			}
+			if err := moveObject(svc, bucketName, *obj.Key, thumbKey(original)); err != nil {
+				return moved, err
+			}
+			moved++
+			if folderName := path.Dir(*obj.Key); !seen[folderName] {
+				seen[folderName] = true
+				folders = append(folders, date)
+			}
+		}
+	}
+	if dryRun || moved == 0 {
+		return moved, nil
+	}
+
+	sort.Slice(folders, func(i, j int) bool { return folders[i].Before(folders[j]) })
+	for _, folder := range folders {
+		if err := createJSONandWebsiteForFolder(svc, bucketName, folder); err != nil {
+			return moved, err
+		}
+	}
+	var albums []Album
+	for _, summary := range readAlbums(svc, bucketName) {
+		if album := readAlbum(svc, bucketName, summary.ID); album != nil {
+			albums = append(albums, *album)
+		}
+	}
+	if len(albums) > 0 {
+		updateAlbums(svc, bucketName, albums)
+	}
+	return moved, nil
+}
+
+// moveObject Copies an object to a new key and removes the old one once the copy has been checked. A newer
+// object already at the new key is kept, and so is the old one as nothing was copied from it.
+func moveObject(svc s3iface.S3API, bucketName, from, to string) error {
+	reader := GetFromS3(svc, from, bucketName)
+	if reader == nil {
+		return nil // already gone
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	if !UploadToS3(svc, to, bucketName, data, int64(len(data)), false) {
+		log.Info("Keeping ", from, ", ", to, " already exists.")
+		return nil
+	}
+	if err := VerifyUpload(svc, to, bucketName, data); err != nil {
+		return err
+	}
+	return DeleteFromS3(svc, from, bucketName)
+}
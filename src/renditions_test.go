@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestRenditionKeys(t *testing.T) {
+	// Stems and extensions that used to collide get thumbnails of their own
+	for _, keys := range [][2]string{
+		{"2016/2016-05-13/a.jpg", "2016/2016-05-13/a.mp4"},
+		{"2016/2016-05-13/a.jpg", "2016/2016-05-13/a.jpeg"},
+		{"2016/2016-05-13/a.jpg", "2016/2016-05-13/a_thumb.jpg"},
+	} {
+		if thumbKey(keys[0]) == thumbKey(keys[1]) || thumbKey(keys[0]) == keys[1] {
+			t.Errorf("expected %s and %s to have their own thumbnails", keys[0], keys[1])
+		}
+	}
+	if key, size, ok := renditionOf(thumbKey("2016/2016-05-13/IMG_0001.jpeg")); !ok || key != "2016/2016-05-13/IMG_0001.jpeg" || size != thumbSize {
+		t.Errorf("unexpected original %s of size %s", key, size)
+	}
+	if _, _, ok := renditionOf(renditionsManifest); ok {
+		t.Error("expected the manifest not to be a rendition")
+	}
+
+	var objects []*s3.Object
+	for _, key := range []string{"2016/2016-05-13/IMG_0001.JPEG", "2016/2016-05-13/IMG_0001_thumb.jpg", "2016/2016-05-13/IMG_0002_thumb.jpg", "2016/2016-05-13/photos.json"} {
+		objects = append(objects, &s3.Object{Key: aws.String(key)})
+	}
+	if thumbs := legacyThumbs(objects, map[string]bool{}); len(thumbs) != 1 || thumbs["2016/2016-05-13/IMG_0001_thumb.jpg"] != "2016/2016-05-13/IMG_0001.JPEG" {
+		t.Errorf("expected only the thumbnail of IMG_0001.JPEG, got %v", thumbs)
+	}
+}
+
+func TestMigrateThumbnails(t *testing.T) {
+	fake := setupProcess(t)
+	inDir := t.TempDir()
+	createFixtures(t, inDir, append(photoFixtures, fixture{"IMG_0009_thumb.jpg", day(2016, 5, 13)},
+		fixture{"IMG_0010.jpg", day(2016, 5, 13)}, fixture{"IMG_0010_thumb.jpg", day(2016, 5, 13)}))
+	process(fake, inDir, "", testBucket)
+
+	// A photo named like the thumbnail of another one is listed when it is uploaded
+	if index := string(fake.Object(testBucket, "2016/2016-05-13/photos.json")); !strings.Contains(index, `"IMG_0010_thumb.jpg"`) {
+		t.Errorf("expected IMG_0010_thumb.jpg to be listed, got %s", index)
+	}
+
+	// Put the thumbnails back where older versions kept them, without renditions in the manifest
+	var manifest renditionManifest
+	json.NewDecoder(GetFromS3(fake, renditionsManifest, testBucket)).Decode(&manifest)
+	for _, key := range []string{"2016/2016-05-13/IMG_0001.jpg", "2016/2016-05-13/IMG_0002.JPG", "2016/2016-05-14/IMG_0003.jpg"} {
+		thumb := fake.Object(testBucket, thumbKey(key))
+		UploadToS3(fake, strings.TrimSuffix(key, path.Ext(key))+legacyThumbSuffix, testBucket, thumb, int64(len(thumb)), true)
+		DeleteFromS3(fake, thumbKey(key), testBucket)
+		delete(manifest.Renditions, key)
+	}
+	manifestJSON, _ := json.Marshal(manifest)
+	UploadToS3(fake, renditionsManifest, testBucket, manifestJSON, int64(len(manifestJSON)), true)
+	photoInfo = make(map[string]PhotoInfo)
+
+	if moved, err := migrateThumbnails(fake, testBucket, []string{"2016-05-13"}, true); err != nil || moved != 2 {
+		t.Fatalf("expected a dry run to find 2 thumbnails, got %d: %v", moved, err)
+	}
+	if fake.Object(testBucket, "2016/2016-05-13/IMG_0001_thumb.jpg") == nil {
+		t.Fatal("expected a dry run to leave the thumbnails alone")
+	}
+	moved, err := migrateThumbnails(fake, testBucket, nil, false)
+	if err != nil || moved != 3 {
+		t.Fatalf("expected 3 thumbnails to be moved, got %d: %v", moved, err)
+	}
+
+	keys := strings.Join(fake.Keys(testBucket), "\n")
+	if strings.Contains(keys, "IMG_0001_thumb.jpg") || !strings.Contains(keys, thumbKey("2016/2016-05-14/IMG_0003.jpg")) || !strings.Contains(keys, "2016/2016-05-13/IMG_0010_thumb.jpg\n") {
+		t.Errorf("expected the thumbnails to be moved, got\n%s", keys)
+	}
+	var photos struct {
+		Files  []string          `json:"files"`
+		Thumbs map[string]string `json:"thumbs"`
+	}
+	json.Unmarshal(fake.Object(testBucket, "2016/2016-05-13/photos.json"), &photos)
+	if strings.Join(photos.Files, ",") != "IMG_0001.jpg,IMG_0002.JPG,IMG_0006.jpeg,IMG_0009_thumb.jpg,IMG_0010.jpg,IMG_0010_thumb.jpg" || photos.Thumbs["IMG_0001.jpg"] != "../../"+thumbKey("2016/2016-05-13/IMG_0001.jpg") {
+		t.Errorf("expected the original named like a thumbnail to be listed and the new thumbnails used, got %+v", photos)
+	}
+	manifest = renditionManifest{}
+	json.NewDecoder(GetFromS3(fake, renditionsManifest, testBucket)).Decode(&manifest)
+	if len(manifest.Renditions) != 8 {
+		t.Errorf("expected a thumbnail for each original in the manifest, got %v", manifest.Renditions)
+	}
+}
+
+func TestMoveObjectKeepsSource(t *testing.T) {
+	fake := setupProcess(t)
+	UploadToS3(fake, "2016/2016-05-13/IMG_0001_thumb.jpg", testBucket, []byte("old"), 3, true)
+	UploadToS3(fake, thumbKey("2016/2016-05-13/IMG_0001.jpg"), testBucket, []byte("new"), 3, true)
+
+	// Nothing was copied, so nothing is deleted
+	if err := moveObject(fake, testBucket, "2016/2016-05-13/IMG_0001_thumb.jpg", thumbKey("2016/2016-05-13/IMG_0001.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	if string(fake.Object(testBucket, "2016/2016-05-13/IMG_0001_thumb.jpg")) != "old" || string(fake.Object(testBucket, thumbKey("2016/2016-05-13/IMG_0001.jpg"))) != "new" {
+		t.Error("expected both objects to be kept")
+	}
+}
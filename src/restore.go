@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	filepath "path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// Originals are stored as 2006/2006-01-02/fileName
+var dayKeyRegExp = regexp.MustCompile(`^\d{4}/(\d{4}-\d{2}-\d{2})/([^/]+)$`)
+
+// IsGenerated Checks whether a key is an index, page, album, asset, thumbnail or motion photo movie created by the
+// uploader rather than an original
+func IsGenerated(key string) bool {
+	return IsIndexFile(key) || IsRendition(key) || strings.HasPrefix(key, sharePrefix) || strings.HasPrefix(key, assetsPrefix) ||
+		strings.HasPrefix(key, albumsPrefix) || IsMotionClip(key)
+}
+
+// dateRange A prefix to list and the dates to keep, both inclusive
+type dateRange struct {
+	prefix string
+	from   time.Time
+	to     time.Time
+}
+
+// parseDateRange Parses a year (2016), date (2016-05-13) or range (2016-05-13:2016-05-20), empty means everything
+func parseDateRange(target string) (dateRange, error) {
+	if len(target) == 0 {
+		return dateRange{to: time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)}, nil
+	}
+	if year, err := time.Parse("2006", target); err == nil {
+		return dateRange{prefix: target + "/", from: year, to: year.AddDate(1, 0, -1)}, nil
+	}
+
+	parts := strings.Split(target, ":")
+	if len(parts) > 2 {
+		return dateRange{}, fmt.Errorf("expected a year, date or date range like 2016-05-13:2016-05-20, got %s", target)
+	}
+	from, err := time.Parse("2006-01-02", parts[0])
+	if err != nil {
+		return dateRange{}, err
+	}
+	to := from
+	if len(parts) == 2 {
+		if to, err = time.Parse("2006-01-02", parts[1]); err != nil {
+			return dateRange{}, err
+		}
+		if to.Before(from) {
+			return dateRange{}, fmt.Errorf("the date range %s ends before it starts", target)
+		}
+	}
+
+	// Narrow down the listing when the range is within a single year or day
+	prefix := ""
+	if from.Equal(to) {
+		prefix = from.Format("2006/2006-01-02/")
+	} else if from.Year() == to.Year() {
+		prefix = from.Format("2006/")
+	}
+	return dateRange{prefix: prefix, from: from, to: to}, nil
+}
+
+// Contains Checks whether a date falls in the range
+func (r dateRange) Contains(date time.Time) bool {
+	return !date.Before(r.from) && !date.After(r.to)
+}
+
+// restoreJob An original to download and where to put it
+type restoreJob struct {
+	obj      *s3.Object
+	date     time.Time
+	destFile string
+}
+
+// getRestoreJobs Lists the originals in the bucket for each target, skipping generated files
+func getRestoreJobs(svc s3iface.S3API, bucketName string, targets []string, outDir string) ([]restoreJob, error) {
+	if len(targets) == 0 {
+		targets = []string{""}
+	}
+
+	var jobs []restoreJob
+	seen := make(map[string]bool)
+	for _, target := range targets {
+		dates, err := parseDateRange(target)
+		if err != nil {
+			return nil, err
+		}
+		// Untouched originals are restored instead of the stripped copies on the site
+		untouched := make(map[string]*s3.Object)
+		if len(cfg.OriginalsPrefix) > 0 {
+			for _, obj := range GetObjectsFromBucket(svc, bucketName, cfg.OriginalsPrefix+dates.prefix) {
+				untouched[strings.TrimPrefix(*obj.Key, cfg.OriginalsPrefix)] = obj
+			}
+		}
+		objects := GetObjectsFromBucket(svc, bucketName, dates.prefix)
+		legacy := legacyThumbs(objects, knownOriginals(svc, bucketName, objects))
+		for _, obj := range objects {
+			matches := dayKeyRegExp.FindStringSubmatch(*obj.Key)
+			if _, ok := legacy[*obj.Key]; matches == nil || ok || IsGenerated(*obj.Key) || seen[*obj.Key] {
+				continue
+			}
+			date, err := time.Parse("2006-01-02", matches[1])
+			if err != nil || !dates.Contains(date) {
+				continue
+			}
+			seen[*obj.Key] = true
+
+			// Restore into the same layout processFile uses for the output directory
+			destFile := filepath.Join(outDir, date.Format(cfg.Layout), matches[2])
+			if original, ok := untouched[*obj.Key]; ok {
+				obj = original
+			}
+			jobs = append(jobs, restoreJob{obj, date, destFile})
+		}
+		// Files archived without being published are only in the private prefix
+		for key, obj := range untouched {
+			matches := dayKeyRegExp.FindStringSubmatch(key)
+			if matches == nil || seen[key] {
+				continue
+			}
+			date, err := time.Parse("2006-01-02", matches[1])
+			if err != nil || !dates.Contains(date) {
+				continue
+			}
+			seen[key] = true
+			jobs = append(jobs, restoreJob{obj, date, filepath.Join(outDir, date.Format(cfg.Layout), matches[2])})
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].destFile < jobs[j].destFile })
+	return jobs, nil
+}
+
+// restoreFile Downloads a single object, verifying its checksum and decrypting it if it was encrypted.
+// The file is written next to the destination and only renamed once complete, so an interrupted restore
+// never leaves a partial file behind.
+func restoreFile(svc s3iface.S3API, bucketName string, job restoreJob) error {
+	resp, err := DownloadFromS3(svc, *job.obj.Key, bucketName)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := os.MkdirAll(filepath.Dir(job.destFile), 0777); err != nil {
+		return err
+	}
+	tmpFile := job.destFile + ".part"
+	out, err := os.Create(tmpFile)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile) // no-op once renamed
+	defer out.Close()
+
+	// Hash what was downloaded, the ETag is the MD5 of the object as stored
+	hash := md5.New()
+	counter := &countingWriter{}
+	buffered := bufio.NewReader(io.TeeReader(resp.Body, io.MultiWriter(hash, counter)))
+
+	// Peek at the header to see if the file needs decrypting
+	header, _ := buffered.Peek(len(encryptMagic))
+	if IsEncrypted(header) {
+		if keyring == nil {
+			return ErrNoKey
+		}
+		err = keyring.Decrypt(out, buffered)
+	} else {
+		_, err = io.Copy(out, buffered)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.Discard, buffered); err != nil {
+		return err
+	}
+
+	if job.obj.Size != nil && counter.size != *job.obj.Size {
+		return fmt.Errorf("size mismatch for %s, expected %d bytes but got %d", *job.obj.Key, *job.obj.Size, counter.size)
+	}
+	if resp.ETag != nil {
+		// ETags of multipart uploads aren't a plain MD5 so they can't be checked
+		etag := strings.Trim(*resp.ETag, `"`)
+		if !strings.Contains(etag, "-") && etag != hex.EncodeToString(hash.Sum(nil)) {
+			return fmt.Errorf("checksum mismatch for %s", *job.obj.Key)
+		}
+	}
+
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	// Use the folder date as mtime, as that is what GetFileModTime falls back on when importing again
+	if err := os.Chtimes(tmpFile, job.date, job.date); err != nil {
+		log.Error(err)
+	}
+	return os.Rename(tmpFile, job.destFile)
+}
+
+// countingWriter Counts the bytes written to it
+type countingWriter struct {
+	size int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.size += int64(len(p))
+	return len(p), nil
+}
+
+// restore Downloads all originals for the targets (years, dates or date ranges, or the whole bucket if none are
+// given) into the output directory. Files that have already been restored are skipped, so an interrupted
+// restore can simply be run again.
+func restore(svc s3iface.S3API, bucketName string, targets []string, outDir string, workers int) error {
+	jobs, err := getRestoreJobs(svc, bucketName, targets, outDir)
+	if err != nil {
+		return err
+	}
+	log.Info("Found ", len(jobs), " files to restore.")
+
+	jobChan := make(chan restoreJob)
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	done, failed := 0, 0
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobChan {
+				err := restoreFile(svc, bucketName, job)
+
+				lock.Lock()
+				done++
+				if err != nil {
+					failed++
+					log.Error("Unable to restore ", *job.obj.Key, ": ", err)
+				} else {
+					log.Info("Restored file ", job.destFile, " (", done, " of ", len(jobs), ")")
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+
+	for _, job := range jobs {
+		if _, err := os.Stat(job.destFile); err == nil && !cfg.Overwrite {
+			log.Info("File ", job.destFile, " already exists.")
+			continue
+		}
+		jobChan <- job
+	}
+	close(jobChan)
+	wg.Wait()
+
+	if failed > 0 {
+		return fmt.Errorf("%d files could not be restored, run restore again to retry", failed)
+	}
+	return nil
+}
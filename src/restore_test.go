@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	filepath "path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestParseDateRange(t *testing.T) {
+	for target, expected := range map[string]string{
+		"2016":                  "2016/ 2016-01-01 2016-12-31",
+		"2016-05-13":            "2016/2016-05-13/ 2016-05-13 2016-05-13",
+		"2016-05-13:2016-05-20": "2016/ 2016-05-13 2016-05-20",
+		"2016-12-30:2017-01-02": " 2016-12-30 2017-01-02",
+	} {
+		dates, err := parseDateRange(target)
+		if err != nil {
+			t.Errorf("%s: %v", target, err)
+			continue
+		}
+		if got := dates.prefix + " " + dates.from.Format("2006-01-02") + " " + dates.to.Format("2006-01-02"); got != expected {
+			t.Errorf("%s: expected %q, got %q", target, expected, got)
+		}
+	}
+
+	for _, target := range []string{"2016-05-20:2016-05-13", "2016-05-13:2016-05-20:2016-05-27", "May 2016"} {
+		if _, err := parseDateRange(target); err == nil {
+			t.Errorf("%s: expected an error", target)
+		}
+	}
+}
+
+// listedObject Returns the object as listed in the fake bucket, like getRestoreJobs gets it
+func listedObject(t *testing.T, fake *fakeS3, key string) *s3.Object {
+	t.Helper()
+	for _, obj := range GetObjectsFromBucket(fake, testBucket, key) {
+		if *obj.Key == key {
+			return obj
+		}
+	}
+	t.Fatalf("%s isn't in the bucket", key)
+	return nil
+}
+
+func TestRestore(t *testing.T) {
+	fake := setupProcess(t)
+	putKey(fake, "2016/2016-05-13/IMG_0001.jpg", []byte("stripped"))
+	putKey(fake, "originals/2016/2016-05-13/IMG_0001.jpg", []byte("original"))
+	putKey(fake, "originals/2016/2016-05-14/IMG_0002.jpg", []byte("archived")) // not published
+	putKey(fake, "2017/2017-01-01/IMG_0003.jpg", []byte("plain"))
+	putKey(fake, "2016/2016-05-13/photos.json", []byte("{}"))
+	putKey(fake, thumbKey("2016/2016-05-13/IMG_0001.jpg"), []byte("thumbnail"))
+
+	outDir := t.TempDir()
+	if err := restore(fake, testBucket, []string{"2016"}, outDir, 2); err != nil {
+		t.Fatal(err)
+	}
+	local := func(key string) string { return filepath.Join(outDir, filepath.FromSlash(key)) }
+	for key, expected := range map[string]string{"2016/2016-05-13/IMG_0001.jpg": "original", "2016/2016-05-14/IMG_0002.jpg": "archived"} {
+		if data, err := os.ReadFile(local(key)); err != nil || string(data) != expected {
+			t.Errorf("%s: expected %q, got %q: %v", key, expected, data, err)
+		}
+	}
+	if info, err := os.Stat(local("2016/2016-05-14/IMG_0002.jpg")); err != nil || !info.ModTime().Equal(time.Date(2016, time.May, 14, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the folder date as modification time: %v", err)
+	}
+	for _, key := range []string{"2016/2016-05-13/photos.json", "2017/2017-01-01/IMG_0003.jpg"} {
+		if _, err := os.Stat(local(key)); !os.IsNotExist(err) {
+			t.Errorf("expected %s not to be restored: %v", key, err)
+		}
+	}
+
+	// Running again skips what was restored, unless overwriting
+	os.WriteFile(local("2016/2016-05-13/IMG_0001.jpg"), []byte("kept"), 0666)
+	if err := restore(fake, testBucket, nil, outDir, 2); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(local("2016/2016-05-13/IMG_0001.jpg")); string(data) != "kept" {
+		t.Errorf("expected the restored file to be skipped, got %q", data)
+	}
+	if data, _ := os.ReadFile(local("2017/2017-01-01/IMG_0003.jpg")); string(data) != "plain" {
+		t.Errorf("expected the rest of the bucket to be restored, got %q", data)
+	}
+	cfg.Overwrite = true
+	if err := restore(fake, testBucket, []string{"2016-05-13"}, outDir, 1); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(local("2016/2016-05-13/IMG_0001.jpg")); string(data) != "original" {
+		t.Errorf("expected the file to be restored again, got %q", data)
+	}
+}
+
+func TestRestoreFileMismatch(t *testing.T) {
+	fake := setupProcess(t)
+	putKey(fake, "2016/2016-05-13/IMG_0001.jpg", []byte("original"))
+	destFile := filepath.Join(t.TempDir(), "IMG_0001.jpg")
+	job := restoreJob{listedObject(t, fake, "2016/2016-05-13/IMG_0001.jpg"), day(2016, time.May, 13), destFile}
+
+	// A failed download leaves neither the file nor the partial download behind
+	checkNothingLeft := func(name string) {
+		t.Helper()
+		for _, fileName := range []string{destFile, destFile + ".part"} {
+			if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+				t.Errorf("%s: expected no %s: %v", name, filepath.Base(fileName), err)
+			}
+		}
+	}
+
+	fake.SetETag(testBucket, *job.obj.Key, "0123456789abcdef0123456789abcdef")
+	if err := restoreFile(fake, testBucket, job); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("expected a checksum mismatch, got %v", err)
+	}
+	checkNothingLeft("checksum")
+
+	// The ETag of a multipart upload can't be checked
+	fake.SetETag(testBucket, *job.obj.Key, "0123456789abcdef0123456789abcdef-2")
+	if err := restoreFile(fake, testBucket, job); err != nil {
+		t.Errorf("expected the multipart upload to be restored: %v", err)
+	}
+	os.Remove(destFile)
+
+	// Changed since it was listed
+	putKey(fake, "2016/2016-05-13/IMG_0001.jpg", []byte("truncated"))
+	if err := restoreFile(fake, testBucket, job); err == nil || !strings.Contains(err.Error(), "size mismatch") {
+		t.Errorf("expected a size mismatch, got %v", err)
+	}
+	checkNothingLeft("size")
+
+	// An earlier restore isn't replaced by a broken one
+	os.WriteFile(destFile, []byte("earlier"), 0666)
+	fake.SetETag(testBucket, *job.obj.Key, "0123456789abcdef0123456789abcdef")
+	job.obj = listedObject(t, fake, *job.obj.Key)
+	if err := restoreFile(fake, testBucket, job); err == nil {
+		t.Error("expected a checksum mismatch")
+	}
+	if data, _ := os.ReadFile(destFile); string(data) != "earlier" {
+		t.Errorf("expected the earlier file to be kept, got %q", data)
+	}
+	if _, err := os.Stat(destFile + ".part"); !os.IsNotExist(err) {
+		t.Errorf("expected the partial download to be removed: %v", err)
+	}
+}
+
+func TestRestoreEncrypted(t *testing.T) {
+	fake := setupProcess(t)
+	defer func(old *Keyring) { keyring = old }(keyring)
+	var err error
+	if keyring, err = NewKeyring("secret", ""); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Encrypt = true
+	inDir, outDir := t.TempDir(), t.TempDir()
+	createFixtures(t, inDir, []fixture{{"IMG_0001.jpg", day(2016, time.May, 13)}})
+	original, _ := os.ReadFile(filepath.Join(inDir, "IMG_0001.jpg"))
+	process(fake, inDir, "", testBucket)
+
+	// The encrypted original is restored, not the copy on the site
+	if err := restore(fake, testBucket, nil, outDir, 1); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := os.ReadFile(filepath.Join(outDir, "2016", "2016-05-13", "IMG_0001.jpg"))
+	if err != nil || !bytes.Equal(restored, original) {
+		t.Errorf("expected the decrypted original: %v", err)
+	}
+
+	keyring = nil
+	job := restoreJob{&s3.Object{Key: aws.String("originals/2016/2016-05-13/IMG_0001.jpg")}, day(2016, time.May, 13), filepath.Join(outDir, "IMG_0001.jpg")}
+	if err := restoreFile(fake, testBucket, job); err != ErrNoKey {
+		t.Errorf("expected %v without a key, got %v", ErrNoKey, err)
+	}
+}
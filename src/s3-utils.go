@@ -4,17 +4,54 @@ import (
 	//	"errors"
 
 	"bytes"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"path"
+	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 )
 
+// NewSession creates an AWS session for the profile, which can point at an S3 compatible endpoint such as MinIO
+func NewSession(profile Profile) (*session.Session, error) {
+	config := aws.NewConfig().WithRegion(profile.Region)
+	if len(profile.Endpoint) > 0 {
+		config = config.WithEndpoint(profile.Endpoint)
+	}
+	if profile.PathStyle {
+		// Most self hosted servers don't support bucket names as sub domains
+		config = config.WithS3ForcePathStyle(true)
+	}
+	if profile.InsecureSkipVerify {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		config = config.WithHTTPClient(&http.Client{Transport: transport})
+	}
+	if len(profile.AccessKey) > 0 {
+		config = config.WithCredentials(credentials.NewStaticCredentials(profile.AccessKey, profile.SecretKey, ""))
+	}
+
+	return session.NewSessionWithOptions(session.Options{
+		Config:            *config,
+		Profile:           profile.AWSProfile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+}
+
 // UploadToS3 uploads a buffer to S3
-func UploadToS3(svc s3.S3, destName, bucketName string, buffer []byte, size int64, overwrite bool) bool {
+func UploadToS3(svc s3iface.S3API, destName, bucketName string, buffer []byte, size int64, overwrite bool) bool {
 	if overwrite == false {
 		objects := GetObjectsFromBucket(svc, bucketName, destName)
 		if len(objects) > 0 {
@@ -26,11 +63,16 @@ func UploadToS3(svc s3.S3, destName, bucketName string, buffer []byte, size int6
 	fileBytes := bytes.NewReader(buffer) // convert to io.ReadSeeker type
 
 	fileType := http.DetectContentType(buffer)
+	if strings.HasPrefix(destName, assetsPrefix) {
+		// Sniffing can't tell scripts and stylesheets from plain text, browsers refuse to run those
+		if extType := mime.TypeByExtension(path.Ext(destName)); len(extType) > 0 {
+			fileType = extType
+		}
+	}
 
 	params := &s3.PutObjectInput{
-		Bucket:        aws.String(bucketName),    // required
-		Key:           aws.String(destName),      // required
-		ACL:           aws.String("public-read"), // Needed to allow anonymous access
+		Bucket:        aws.String(bucketName), // required
+		Key:           aws.String(destName),   // required
 		Body:          fileBytes,
 		ContentLength: aws.Int64(size),
 		ContentType:   aws.String(fileType),
@@ -39,6 +81,12 @@ func UploadToS3(svc s3.S3, destName, bucketName string, buffer []byte, size int6
 		},
 		// see more at http://godoc.org/github.com/aws/aws-sdk-go/service/s3#S3.PutObject
 	}
+	if acl := aclForKey(destName); len(acl) > 0 {
+		params.ACL = aws.String(acl) // public-read is needed to allow anonymous access
+	}
+	if IsPrivateOriginal(destName) && len(cfg.OriginalsStorage) > 0 {
+		params.StorageClass = aws.String(cfg.OriginalsStorage)
+	}
 
 	_, err := svc.PutObject(params)
 	if err != nil {
@@ -60,8 +108,132 @@ func UploadToS3(svc s3.S3, destName, bucketName string, buffer []byte, size int6
 	return true
 }
 
+// uploadPartSize Size of the parts large files are streamed to S3 in, only one part is held in memory at a time
+var uploadPartSize = 8 << 20
+
+// StreamToS3 uploads what is read from body to S3 without holding all of it in memory, anything smaller than a
+// part is uploaded in one go. Returns false when the object already exists and isn't overwritten.
+func StreamToS3(svc s3iface.S3API, destName, bucketName string, body io.Reader, overwrite bool) (bool, error) {
+	if overwrite == false {
+		objects := GetObjectsFromBucket(svc, bucketName, destName)
+		if len(objects) > 0 {
+			log.Info("File already exists, skipping. ", destName)
+			return false, nil
+		}
+	}
+
+	part := make([]byte, uploadPartSize)
+	n, err := io.ReadFull(body, part)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		if !UploadToS3(svc, destName, bucketName, part[:n], int64(n), true) {
+			return false, fmt.Errorf("unable to upload %s to bucket %s", destName, bucketName)
+		}
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	params := &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(bucketName),
+		Key:         aws.String(destName),
+		ContentType: aws.String("application/octet-stream"),
+	}
+	if acl := aclForKey(destName); len(acl) > 0 {
+		params.ACL = aws.String(acl)
+	}
+	if IsPrivateOriginal(destName) && len(cfg.OriginalsStorage) > 0 {
+		params.StorageClass = aws.String(cfg.OriginalsStorage)
+	}
+	upload, err := svc.CreateMultipartUpload(params)
+	if err != nil {
+		return false, fmt.Errorf("unable to start upload of %s: %v", destName, err)
+	}
+
+	var parts []*s3.CompletedPart
+	for n > 0 {
+		resp, err := svc.UploadPart(&s3.UploadPartInput{
+			Bucket:     aws.String(bucketName),
+			Key:        aws.String(destName),
+			UploadId:   upload.UploadId,
+			PartNumber: aws.Int64(int64(len(parts) + 1)),
+			Body:       bytes.NewReader(part[:n]),
+		})
+		if err == nil {
+			parts = append(parts, &s3.CompletedPart{ETag: resp.ETag, PartNumber: aws.Int64(int64(len(parts) + 1))})
+			n, err = io.ReadFull(body, part)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = nil
+			}
+		}
+		if err != nil {
+			svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{Bucket: aws.String(bucketName), Key: aws.String(destName), UploadId: upload.UploadId})
+			return false, fmt.Errorf("unable to upload %s: %v", destName, err)
+		}
+	}
+
+	_, err = svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucketName),
+		Key:             aws.String(destName),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return false, fmt.Errorf("unable to finish upload of %s: %v", destName, err)
+	}
+	log.Info("Uploaded file ", destName, " to bucket: ", bucketName)
+	return true, nil
+}
+
+// aclForKey Returns the canned ACL for an object depending on the access mode, private objects get none.
+// Sidecars are never public as they can hold locations, the site gets their fields from photos.json.
+func aclForKey(destName string) string {
+	if IsPrivateOriginal(destName) || IsSidecar(destName) {
+		return ""
+	}
+	switch cfg.Access {
+	case AccessCloudFront:
+		return ""
+	case AccessPresigned:
+		// Only the generated pages, indexes and frontend are readable, they link to photos with presigned URLs.
+		// With private pages only share pages under unguessable ids are the way in.
+		if cfg.PrivatePages && !strings.HasPrefix(destName, assetsPrefix) && !strings.HasPrefix(destName, sharePrefix) {
+			return ""
+		}
+		if !IsIndexFile(destName) && !strings.HasPrefix(destName, assetsPrefix) {
+			return ""
+		}
+	}
+	return cfg.ACL
+}
+
+// IsPrivateOriginal Checks whether a key is an untouched original kept next to a stripped copy
+func IsPrivateOriginal(destName string) bool {
+	return len(cfg.OriginalsPrefix) > 0 && strings.HasPrefix(destName, cfg.OriginalsPrefix)
+}
+
+// IsIndexFile Checks whether a key is one of the generated html or json files
+func IsIndexFile(destName string) bool {
+	fileExt := strings.ToLower(path.Ext(destName))
+	return fileExt == ".html" || fileExt == ".json"
+}
+
+// PresignURL Returns a time limited URL to download an object from a private bucket
+func PresignURL(svc s3iface.S3API, sourceName, bucketName string, expires time.Duration) string {
+	req, _ := svc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(sourceName),
+	})
+	url, err := req.Presign(expires)
+	if err != nil {
+		log.Error("Unable to presign ", sourceName, ": ", err)
+		return ""
+	}
+	return url
+}
+
 // GetFromS3 gets an object from S3
-func GetFromS3(svc s3.S3, sourceName, bucketName string) io.Reader {
+func GetFromS3(svc s3iface.S3API, sourceName, bucketName string) io.Reader {
 	params := &s3.GetObjectInput{
 		Bucket: aws.String(bucketName), // required
 		Key:    aws.String(sourceName), // required
@@ -93,12 +265,76 @@ func GetFromS3(svc s3.S3, sourceName, bucketName string) io.Reader {
 }
 
 // GetObjectsFromBucket gets a list of all objects in a a S3 bucket
-func GetObjectsFromBucket(svc s3.S3, bucketName, prefix string) []*s3.Object {
+func GetObjectsFromBucket(svc s3iface.S3API, bucketName, prefix string) []*s3.Object {
 	params := &s3.ListObjectsInput{
 		Bucket: aws.String(bucketName),
 		Prefix: aws.String(prefix),
 	}
 
-	resp, _ := svc.ListObjects(params)
-	return resp.Contents
+	// Only 1000 objects are returned at a time, so keep fetching pages
+	var objects []*s3.Object
+	err := svc.ListObjectsPages(params, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		objects = append(objects, page.Contents...)
+		return true
+	})
+	if err != nil {
+		log.Error("Unable to list objects in bucket ", bucketName, ": ", err)
+	}
+	return objects
+}
+
+// DownloadFromS3 gets an object from S3 along with its size and ETag, the caller needs to close the body
+func DownloadFromS3(svc s3iface.S3API, sourceName, bucketName string) (*s3.GetObjectOutput, error) {
+	params := &s3.GetObjectInput{
+		Bucket: aws.String(bucketName), // required
+		Key:    aws.String(sourceName), // required
+	}
+	return svc.GetObject(params)
+}
+
+// VerifyUploadSize checks that an object in S3 has the size of what was uploaded
+func VerifyUploadSize(svc s3iface.S3API, destName, bucketName string, size int64) (*s3.HeadObjectOutput, error) {
+	resp, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(destName),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to verify upload of %s: %v", destName, err)
+	}
+	if resp.ContentLength == nil || *resp.ContentLength != size {
+		return nil, fmt.Errorf("size of %s in bucket %s differs from the source", destName, bucketName)
+	}
+	return resp, nil
+}
+
+// VerifyUpload checks that an object in S3 matches what was uploaded
+func VerifyUpload(svc s3iface.S3API, destName, bucketName string, buffer []byte) error {
+	resp, err := VerifyUploadSize(svc, destName, bucketName, int64(len(buffer)))
+	if err != nil {
+		return err
+	}
+
+	// Encrypting uses a new nonce each time, so an existing object won't have the same checksum
+	etag := strings.Trim(aws.StringValue(resp.ETag), `"`)
+	sum := md5.Sum(buffer)
+	if !IsEncrypted(buffer) && !strings.Contains(etag, "-") && etag != hex.EncodeToString(sum[:]) {
+		return fmt.Errorf("checksum of %s in bucket %s differs from the source", destName, bucketName)
+	}
+	return nil
+}
+
+// DeleteFromS3 deletes an object from S3
+func DeleteFromS3(svc s3iface.S3API, destName, bucketName string) error {
+	params := &s3.DeleteObjectInput{
+		Bucket: aws.String(bucketName), // required
+		Key:    aws.String(destName),   // required
+	}
+
+	_, err := svc.DeleteObject(params)
+	if err != nil {
+		log.Error("Unable to delete ", destName, " from bucket ", bucketName, ": ", err)
+		return err
+	}
+	log.Info("Deleted file ", destName, " from bucket: ", bucketName)
+	return nil
 }
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http/httptest"
+	"os"
+	filepath "path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// writeTestJPEG Writes a small jpeg without exif data, so the modification time is used as date taken
+func writeTestJPEG(t *testing.T, fileName string, date time.Time) {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 48; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 5), uint8(date.Day()), 255})
+		}
+	}
+	file, err := os.Create(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := jpeg.Encode(file, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if err := os.Chtimes(fileName, date, date); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProcessAgainstEndpoint(t *testing.T) {
+	// The SDK's own requests go through the in-memory bucket's HTTP front
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	defer func(old Profile) { cfg = old }(cfg)
+	cfg = DefaultProfile()
+	cfg.Endpoint = server.URL
+	cfg.PathStyle = true
+	cfg.AccessKey = "minio"
+	cfg.SecretKey = "minio123"
+	cfg.Bucket = "photos"
+
+	sess, err := NewSession(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := s3.New(sess)
+
+	inDir := t.TempDir()
+	outDir := t.TempDir()
+	date := time.Date(2016, time.May, 13, 18, 16, 56, 0, time.Local)
+	writeTestJPEG(t, filepath.Join(inDir, "IMG_0001.jpg"), date)
+	writeTestJPEG(t, filepath.Join(inDir, "IMG_0002.jpg"), date.AddDate(0, 0, 1))
+
+	process(svc, inDir, outDir, cfg.Bucket)
+
+	for _, key := range []string{
+		"index.html",
+		"years.json",
+		"2016/index.html",
+		"2016/dates.json",
+		"2016/2016-05-13/IMG_0001.jpg",
+		"_renditions/2016/2016-05-13/IMG_0001.jpg/thumb.jpg",
+		"2016/2016-05-13/photos.json",
+		"2016/2016-05-13/index.html",
+		"2016/2016-05-14/IMG_0002.jpg",
+		"_renditions/2016/2016-05-14/IMG_0002.jpg/thumb.jpg",
+	} {
+		if fake.Object(cfg.Bucket, key) == nil {
+			t.Errorf("expected %s to be uploaded", key)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "2016", "2016-05-13", "IMG_0001.jpg")); err != nil {
+		t.Errorf("expected file to be copied to the output directory: %v", err)
+	}
+
+	// Running again shouldn't upload anything new
+	count := len(fake.Keys(cfg.Bucket))
+	process(svc, inDir, outDir, cfg.Bucket)
+	if len(fake.Keys(cfg.Bucket)) != count {
+		t.Errorf("expected %d objects after running again, got %d", count, len(fake.Keys(cfg.Bucket)))
+	}
+}
+
+func TestPresignedACL(t *testing.T) {
+	defer func(old Profile) { cfg = old }(cfg)
+	cfg = DefaultProfile()
+	cfg.Access = AccessPresigned
+	for _, key := range []string{"2016/2016-05-13/photos.json", "2016/2016-05-13/index.html", "assets/app.js", "shares/0123456789abcdef/share.json"} {
+		if acl := aclForKey(key); acl != cfg.ACL {
+			t.Errorf("expected %s to be readable, got %q", key, acl)
+		}
+	}
+	if acl := aclForKey("2016/2016-05-13/IMG_0001.jpg"); acl != "" {
+		t.Errorf("expected photos to be private, got %s", acl)
+	}
+
+	// Day indexes are easy to guess and list presigned links to every photo
+	cfg.PrivatePages = true
+	for _, key := range []string{"2016/2016-05-13/photos.json", "2016/2016-05-13/index.html", "years.json", "2016/2016-05-13/IMG_0001.jpg"} {
+		if acl := aclForKey(key); acl != "" {
+			t.Errorf("expected %s to be private, got %s", key, acl)
+		}
+	}
+	for _, key := range []string{"assets/app.js", "shares/0123456789abcdef/share.json"} {
+		if acl := aclForKey(key); acl != cfg.ACL {
+			t.Errorf("expected %s to be readable, got %q", key, acl)
+		}
+	}
+}
+
+func TestStreamEncrypted(t *testing.T) {
+	defer func(old Profile, oldKeyring *Keyring, oldPartSize int) {
+		cfg, keyring, uploadPartSize = old, oldKeyring, oldPartSize
+	}(cfg, keyring, uploadPartSize)
+	cfg = DefaultProfile()
+	cfg.Move = true
+	uploadPartSize = 1000 // so the file takes several parts
+
+	var err error
+	if keyring, err = NewKeyring("secret", ""); err != nil {
+		t.Fatal(err)
+	}
+	plain := make([]byte, 4500)
+	for i := range plain {
+		plain[i] = byte(i)
+	}
+	sourceFile := filepath.Join(t.TempDir(), "movie.mov")
+	os.WriteFile(sourceFile, plain, 0666)
+
+	fake := newFakeS3()
+	if err := uploadOriginal(fake, sourceFile, cfg.OriginalsPrefix+"2016/2016-05-13/movie.mov", testBucket); err != nil {
+		t.Fatal(err)
+	}
+	encrypted := fake.Object(testBucket, cfg.OriginalsPrefix+"2016/2016-05-13/movie.mov")
+	if int64(len(encrypted)) != EncryptedSize(int64(len(plain))) || !IsEncrypted(encrypted) {
+		t.Fatalf("expected %d encrypted bytes, got %d", EncryptedSize(int64(len(plain))), len(encrypted))
+	}
+	var decrypted bytes.Buffer
+	if err := keyring.Decrypt(&decrypted, bytes.NewReader(encrypted)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted.Bytes(), plain) {
+		t.Error("decrypted upload differs from the source")
+	}
+}
+
+func TestProcessEncrypted(t *testing.T) {
+	fake := setupProcess(t)
+	defer func(old *Keyring) { keyring = old }(keyring)
+	var err error
+	if keyring, err = NewKeyring("secret", ""); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Encrypt = true
+	inDir := t.TempDir()
+	createFixtures(t, inDir, []fixture{{"IMG_0001.jpg", day(2016, time.May, 13)}})
+	original, _ := os.ReadFile(filepath.Join(inDir, "IMG_0001.jpg"))
+
+	process(fake, inDir, "", testBucket)
+
+	// The original is only kept encrypted, in the private prefix
+	encrypted := fake.Object(testBucket, "originals/2016/2016-05-13/IMG_0001.jpg")
+	var decrypted bytes.Buffer
+	if !IsEncrypted(encrypted) || keyring.Decrypt(&decrypted, bytes.NewReader(encrypted)) != nil || !bytes.Equal(decrypted.Bytes(), original) {
+		t.Error("expected the encrypted original in the originals prefix")
+	}
+	if acl := aclForKey("originals/2016/2016-05-13/IMG_0001.jpg"); acl != "" {
+		t.Errorf("expected encrypted originals to be private, got %s", acl)
+	}
+
+	// The site links to a plain copy it can show
+	published := fake.Object(testBucket, "2016/2016-05-13/IMG_0001.jpg")
+	if IsEncrypted(published) {
+		t.Fatal("expected the published copy not to be encrypted")
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(published)); err != nil {
+		t.Errorf("expected the published copy to be a jpeg: %v", err)
+	}
+	if index := string(fake.Object(testBucket, "2016/2016-05-13/photos.json")); !strings.Contains(index, `"IMG_0001.jpg"`) {
+		t.Errorf("expected the photo to be listed, got %s", index)
+	}
+	if fake.Object(testBucket, thumbKey("2016/2016-05-13/IMG_0001.jpg")) == nil {
+		t.Error("expected a thumbnail")
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// searchIndex Contents of search.json, searched by the frontend without a server
+type searchIndex struct {
+	Albums []albumSummary `json:"albums"`
+	Photos [][]string     `json:"photos"` // key, the words it is found by and a presigned thumbnail in private buckets
+}
+
+// searchWords Splits text into lower case words, keeping the first occurrence of each
+func searchWords(words []string, seen map[string]bool, text string) []string {
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if !seen[word] {
+			seen[word] = true
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// photoSearchWords Gets the words a photo can be found by: its name, date, camera, place, caption, label and tags
+func photoSearchWords(fileName string, date time.Time, info PhotoInfo) string {
+	seen := make(map[string]bool)
+	words := searchWords(nil, seen, strings.TrimSuffix(fileName, path.Ext(fileName)))
+	words = searchWords(words, seen, date.Format("2006-01-02 January"))
+	for _, text := range append([]string{info.Camera, info.Place, info.Caption, info.Label}, info.Tags...) {
+		words = searchWords(words, seen, text)
+	}
+	return strings.Join(words, " ")
+}
+
+// readSearchIndex Reads search.json, along with the json to tell whether it changed
+func readSearchIndex(svc s3iface.S3API, bucketName string) (searchIndex, string) {
+	index := searchIndex{Albums: []albumSummary{}, Photos: [][]string{}}
+	reader := GetFromS3(svc, "search.json", bucketName)
+	if reader == nil {
+		return index, ""
+	}
+	json.NewDecoder(reader).Decode(&index)
+	oldJSON, _ := json.Marshal(index)
+	return index, string(oldJSON)
+}
+
+// writeSearchIndex Uploads search.json and the search page, unless nothing changed
+func writeSearchIndex(svc s3iface.S3API, bucketName string, index searchIndex, oldJSON string) {
+	indexJSON, _ := json.Marshal(index)
+	if string(indexJSON) == oldJSON {
+		return
+	}
+	UploadToS3(svc, "search.json", bucketName, indexJSON, int64(len(indexJSON)), true)
+	uploadPage(svc, bucketName, "search.html", pageData{Page: "search", Title: cfg.Title(), Back: "index.html", Assets: assetsPrefix})
+}
+
+// updateSearch Replaces the photos of a date in the search index
+func updateSearch(svc s3iface.S3API, bucketName string, date time.Time, fileNames []string, info map[string]PhotoInfo, thumbs map[string]string) {
+	index, oldJSON := readSearchIndex(svc, bucketName)
+	folderName := date.Format("2006/2006-01-02/")
+	photos := [][]string{}
+	for _, photo := range index.Photos {
+		if len(photo) > 0 && !strings.HasPrefix(photo[0], folderName) {
+			photos = append(photos, photo)
+		}
+	}
+	for _, fileName := range fileNames {
+		photo := []string{folderName + fileName, photoSearchWords(fileName, date, info[fileName])}
+		// The search page works out the thumbnails of public buckets itself
+		if thumb, ok := thumbs[fileName]; ok && cfg.Access == AccessPresigned {
+			photo = append(photo, thumb)
+		}
+		photos = append(photos, photo)
+	}
+	sort.SliceStable(photos, func(i, j int) bool { return photos[i][0] < photos[j][0] })
+	index.Photos = photos
+	writeSearchIndex(svc, bucketName, index, oldJSON)
+}
+
+// updateSearchAlbums Replaces the albums in the search index
+func updateSearchAlbums(svc s3iface.S3API, bucketName string, albums []albumSummary) {
+	index, oldJSON := readSearchIndex(svc, bucketName)
+	index.Albums = albums
+	writeSearchIndex(svc, bucketName, index, oldJSON)
+}
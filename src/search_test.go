@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPhotoSearchWords(t *testing.T) {
+	info := PhotoInfo{Camera: "Canon EOS 5D", Place: "Kyoto", Caption: "Fushimi Inari, early morning", Tags: []string{"Temples", "Family"}}
+	words := photoSearchWords("IMG_0001.jpg", day(2016, time.May, 13), info)
+	if words != "img 0001 2016 05 13 may canon eos 5d kyoto fushimi inari early morning temples family" {
+		t.Errorf("unexpected words: %s", words)
+	}
+}
+
+func TestXMPCaptionAndTags(t *testing.T) {
+	xmp := []byte(`<rdf:Description>
+		<dc:description><rdf:Alt><rdf:li xml:lang="x-default">Tom &amp; Anna at the beach</rdf:li></rdf:Alt></dc:description>
+		<dc:subject><rdf:Bag><rdf:li>beach</rdf:li><rdf:li> summer </rdf:li></rdf:Bag></dc:subject>
+	</rdf:Description>`)
+	if caption := xmpCaption(xmp); caption != "Tom & Anna at the beach" {
+		t.Errorf("unexpected caption: %q", caption)
+	}
+	if tags := xmpTags(xmp); strings.Join(tags, ",") != "beach,summer" {
+		t.Errorf("unexpected tags: %v", tags)
+	}
+	if xmpCaption(nil) != "" || xmpTags(nil) != nil {
+		t.Error("expected no caption or tags without XMP")
+	}
+}
+
+func TestUpdateSearch(t *testing.T) {
+	fake := setupProcess(t)
+	info := map[string]PhotoInfo{"IMG_0001.jpg": {Caption: "Beach"}}
+	updateSearch(fake, testBucket, day(2016, time.May, 13), []string{"IMG_0001.jpg", "IMG_0002.jpg"}, info, nil)
+	updateSearch(fake, testBucket, day(2016, time.May, 14), []string{"IMG_0003.jpg"}, nil, nil)
+	updateSearch(fake, testBucket, day(2016, time.May, 13), []string{"IMG_0002.jpg"}, nil, nil)
+	updateSearchAlbums(fake, testBucket, []albumSummary{{ID: "beach", Name: "Beach"}})
+
+	var index searchIndex
+	json.Unmarshal(fake.Object(testBucket, "search.json"), &index)
+	var keys []string
+	for _, photo := range index.Photos {
+		keys = append(keys, photo[0])
+	}
+	if strings.Join(keys, ",") != "2016/2016-05-13/IMG_0002.jpg,2016/2016-05-14/IMG_0003.jpg" {
+		t.Errorf("expected the photos of a date to be replaced, got %v", keys)
+	}
+	if len(index.Albums) != 1 || index.Albums[0].Name != "Beach" {
+		t.Errorf("unexpected albums: %v", index.Albums)
+	}
+	if fake.Object(testBucket, "search.html") == nil {
+		t.Error("expected the search page to be uploaded")
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// GetYears Reads the list of years from years.json
+func GetYears(svc s3iface.S3API, bucketName string) []string {
+	var years []string
+	for _, year := range readYears(svc, bucketName) {
+		years = append(years, year.Year)
+	}
+	return years
+}
+
+// GetDates Reads the list of dates in a year from dates.json
+func GetDates(svc s3iface.S3API, bucketName, year string) []time.Time {
+	var dateStruct map[string][]folderStruct
+	reader := GetFromS3(svc, year+"/dates.json", bucketName)
+	if reader == nil {
+		return nil
+	}
+	json.NewDecoder(reader).Decode(&dateStruct)
+
+	var dates []time.Time
+	for _, dateF := range dateStruct["dates"] {
+		date, err := time.Parse("2006-01-02", dateF.Date)
+		if err != nil {
+			log.Error("Error parsing date: ", dateF.Date)
+			continue
+		}
+		dates = append(dates, date)
+	}
+	return dates
+}
+
+// getFolders Turns a list of years (2016) and dates (2016-05-13) into folder dates, no targets means the whole bucket
+func getFolders(svc s3iface.S3API, bucketName string, targets []string) ([]time.Time, error) {
+	if len(targets) == 0 {
+		targets = GetYears(svc, bucketName)
+	}
+
+	var folders []time.Time
+	for _, target := range targets {
+		if len(target) == 4 {
+			folders = append(folders, GetDates(svc, bucketName, target)...)
+			continue
+		}
+		date, err := time.Parse("2006-01-02", target)
+		if err != nil {
+			return nil, fmt.Errorf("expected a year (2006) or date (2006-01-02), got %s", target)
+		}
+		folders = append(folders, date)
+	}
+	return folders, nil
+}
+
+// refreshLinks Regenerates the indexes of the given years or dates so the presigned links in them are valid again
+func refreshLinks(svc s3iface.S3API, bucketName string, targets []string) error {
+	if cfg.Access != AccessPresigned {
+		return fmt.Errorf("links only expire when access mode is %s", AccessPresigned)
+	}
+
+	folders, err := getFolders(svc, bucketName, targets)
+	if err != nil {
+		return err
+	}
+	for _, folder := range folders {
+		if err := createJSONandWebsiteForFolder(svc, bucketName, folder); err != nil {
+			return err
+		}
+		log.Info("Refreshed links for ", folder.Format("2006-01-02"), ", valid for ", cfg.Expiry())
+	}
+	return nil
+}
+
+// shareFile A photo or movie on a share page, urls are relative to the share page unless presigned
+type shareFile struct {
+	Name  string `json:"name"`
+	URL   string `json:"url"`
+	Thumb string `json:"thumb,omitempty"` // left out for files without a thumbnail
+}
+
+// shareManifest Contents of share.json, when a password is set the files are encrypted into Data
+type shareManifest struct {
+	Title      string      `json:"title"`
+	Expires    string      `json:"expires,omitempty"`
+	Files      []shareFile `json:"files,omitempty"`
+	Salt       []byte      `json:"salt,omitempty"`
+	IV         []byte      `json:"iv,omitempty"`
+	Iterations int         `json:"iterations,omitempty"`
+	Data       []byte      `json:"data,omitempty"`
+}
+
+const sharePrefix = "shares/"
+const sharePasswordIterations = 200000
+
+// getShareFolders Gets the folders for a date (2016-05-13), year (2016) or range (2016-05-13:2016-05-20)
+func getShareFolders(svc s3iface.S3API, bucketName, target string) ([]time.Time, error) {
+	dates, err := parseDateRange(target)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only dates listed in dates.json have photos
+	var folders []time.Time
+	for year := dates.from.Year(); year <= dates.to.Year(); year++ {
+		for _, date := range GetDates(svc, bucketName, strconv.Itoa(year)) {
+			if dates.Contains(date) {
+				folders = append(folders, date)
+			}
+		}
+	}
+	return folders, nil
+}
+
+// getShareKeys Lists the photos in the folders
+func getShareKeys(svc s3iface.S3API, bucketName string, folders []time.Time) []string {
+	var keys []string
+	for _, folder := range folders {
+		folderName := folder.Format("2006/2006-01-02")
+		objects := GetObjectsFromBucket(svc, bucketName, folderName)
+		for _, fileName := range getFileNames(svc, bucketName, folderName, objects) {
+			keys = append(keys, folderName+"/"+fileName)
+		}
+	}
+	return keys
+}
+
+// getShareFiles Links to the existing objects rather than copying them, thumbnails are only linked if they exist
+func getShareFiles(svc s3iface.S3API, bucketName string, keys []string, expires time.Duration) []shareFile {
+	thumbs := existingThumbs(svc, bucketName, keys)
+	files := []shareFile{}
+	for _, key := range keys {
+		file := shareFile{Name: path.Base(key), URL: "../../" + key}
+		if thumbs[thumbKey(key)] {
+			file.Thumb = "../../" + thumbKey(key)
+		}
+		if cfg.Access == AccessPresigned {
+			file.URL = PresignURL(svc, key, bucketName, expires)
+			if thumbs[thumbKey(key)] {
+				file.Thumb = PresignURL(svc, thumbKey(key), bucketName, expires)
+			}
+		}
+		files = append(files, file)
+	}
+	return files
+}
+
+// albumSharePrefix Shares an album instead of dates, eg. album:japan-trip-2016
+const albumSharePrefix = "album:"
+
+// getShareTarget Lists the keys to share for a target and the title to use by default
+func getShareTarget(svc s3iface.S3API, bucketName, target string) ([]string, string, error) {
+	if strings.HasPrefix(target, albumSharePrefix) {
+		album := readAlbum(svc, bucketName, AlbumID(strings.TrimPrefix(target, albumSharePrefix)))
+		if album == nil {
+			return nil, "", fmt.Errorf("album %s not found", strings.TrimPrefix(target, albumSharePrefix))
+		}
+		return album.Files, album.Name, nil
+	}
+	folders, err := getShareFolders(svc, bucketName, target)
+	if err != nil {
+		return nil, "", err
+	}
+	return getShareKeys(svc, bucketName, folders), target, nil
+}
+
+// encryptManifest Encrypts the file list with AES-GCM using a key derived from the password with PBKDF2,
+// so the share page can decrypt it in the browser using WebCrypto
+func encryptManifest(manifest *shareManifest, password string) error {
+	plainText, err := json.Marshal(manifest.Files)
+	if err != nil {
+		return err
+	}
+
+	manifest.Salt = make([]byte, 16)
+	manifest.IV = make([]byte, 12)
+	if _, err := rand.Read(manifest.Salt); err != nil {
+		return err
+	}
+	if _, err := rand.Read(manifest.IV); err != nil {
+		return err
+	}
+	manifest.Iterations = sharePasswordIterations
+
+	key := pbkdf2.Key([]byte(password), manifest.Salt, manifest.Iterations, 32, sha256.New)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	manifest.Data = gcm.Seal(nil, manifest.IV, plainText, nil)
+	manifest.Files = nil
+	return nil
+}
+
+// createShare Creates a standalone share page under an unguessable prefix, returns the key of the page
+func createShare(svc s3iface.S3API, bucketName, target, title, password string, expires time.Duration) (string, error) {
+	keys, defaultTitle, err := getShareTarget(svc, bucketName, target)
+	if err != nil {
+		return "", err
+	}
+	if len(keys) == 0 {
+		return "", fmt.Errorf("nothing to share for %s", target)
+	}
+
+	// Presigned links can't outlive what S3 allows
+	linkExpiry := expires
+	if cfg.Access == AccessPresigned && (linkExpiry <= 0 || linkExpiry > 7*24*time.Hour) {
+		linkExpiry = 7 * 24 * time.Hour
+		log.Info("Presigned links on the share page will expire after ", linkExpiry)
+	}
+
+	if len(title) == 0 {
+		title = defaultTitle
+	}
+	manifest := shareManifest{Title: title, Files: getShareFiles(svc, bucketName, keys, linkExpiry)}
+	if expires > 0 {
+		manifest.Expires = time.Now().Add(expires).UTC().Format(time.RFC3339)
+	}
+	if len(password) > 0 {
+		if err := encryptManifest(&manifest, password); err != nil {
+			return "", err
+		}
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	shareName := sharePrefix + hex.EncodeToString(id)
+
+	manifestJSON, _ := json.Marshal(manifest)
+	UploadToS3(svc, shareName+"/share.json", bucketName, manifestJSON, int64(len(manifestJSON)), true)
+	uploadPage(svc, bucketName, shareName+"/index.html", pageData{Page: "share", Title: title, Assets: "../../" + assetsPrefix})
+	uploadAssets(svc, bucketName) // buckets created by older versions won't have the frontend yet
+	return shareName + "/index.html", nil
+}
+
+// unshare Removes a share page, the shared photos themselves are left alone
+func unshare(svc s3iface.S3API, bucketName, id string) error {
+	shareName := sharePrefix + strings.TrimSuffix(strings.TrimPrefix(id, sharePrefix), "/") + "/"
+	objects := GetObjectsFromBucket(svc, bucketName, shareName)
+	if len(objects) == 0 {
+		return fmt.Errorf("share %s not found", id)
+	}
+	for _, obj := range objects {
+		if err := DeleteFromS3(svc, *obj.Key, bucketName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unshareExpired Removes all share pages that have expired
+func unshareExpired(svc s3iface.S3API, bucketName string) error {
+	for _, obj := range GetObjectsFromBucket(svc, bucketName, sharePrefix) {
+		if path.Base(*obj.Key) != "share.json" {
+			continue
+		}
+		reader := GetFromS3(svc, *obj.Key, bucketName)
+		if reader == nil {
+			continue
+		}
+		var manifest shareManifest
+		if err := json.NewDecoder(reader).Decode(&manifest); err != nil {
+			log.Error("Unable to read ", *obj.Key, ": ", err)
+			continue
+		}
+		expires, err := time.Parse(time.RFC3339, manifest.Expires)
+		if err != nil || expires.After(time.Now()) {
+			continue
+		}
+		if err := unshare(svc, bucketName, path.Dir(*obj.Key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
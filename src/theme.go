@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"embed"
+	"encoding/hex"
+	"html/template"
+	"io/fs"
+	"os"
+	"path"
+	filepath "path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// builtinTheme The default templates and the frontend they load. A theme directory can override any of
+// these files by using the same relative path, e.g. templates/day.html or assets/app.css.
+//
+//go:embed theme
+var builtinTheme embed.FS
+
+// assetsPrefix Where the theme assets are uploaded, pages link to them relative to their own folder
+const assetsPrefix = "assets/"
+
+// folderIcon Default thumbnail for dates without photos, relative to the year folder
+const folderIcon = "../" + assetsPrefix + "folder.svg"
+
+// siteData Settings shared by every page
+type siteData struct {
+	Title          string
+	MapTiles       string // tile URL template for the map page, eg. https://tiles.example.com/{z}/{x}/{y}.png
+	MapAttribution string // shown in the corner of the map
+}
+
+// pageItem A photo or movie on a day or album page, a date on a month page, a month on a year page or a year
+// or album on the main page
+type pageItem struct {
+	Name    string // file name, date, month or year
+	Caption string // shown under the thumbnail, empty for photos
+	Count   int    // photos and movies in a month or day
+	URL     string // the photo or page to open, relative to the page
+	Thumb   string // thumbnail, relative to the page
+	Movie   bool
+}
+
+// pageData The data model templates are executed with
+type pageData struct {
+	Page   string // main, year, month, day, timeline, map, search, album or share, also the name of the template
+	Site   siteData
+	Title  string // page title
+	Year   string // set on year, month and day pages
+	Month  string // set on month and day pages, formatted as 2006-01
+	Day    string // set on day pages, formatted as 2006-01-02
+	Back   string // link to the parent page
+	Assets string // relative path from the page to the uploaded assets
+	Items  []pageItem
+	Albums []pageItem // set on the main page
+}
+
+// themeFile Reads a file from the theme directory, falling back on the built-in theme
+func themeFile(name string) ([]byte, error) {
+	if len(cfg.Theme) > 0 {
+		data, err := os.ReadFile(filepath.Join(cfg.Theme, filepath.FromSlash(name)))
+		if err == nil || !os.IsNotExist(err) {
+			return data, err
+		}
+	}
+	return builtinTheme.ReadFile(path.Join("theme", name))
+}
+
+// renderPage Executes the template for a page, templates/layout.html holds the parts shared by all pages
+func renderPage(data pageData) ([]byte, error) {
+	tmpl := template.New(data.Page)
+	for _, name := range []string{"templates/layout.html", "templates/" + data.Page + ".html"} {
+		text, err := themeFile(name)
+		if err != nil {
+			return nil, err
+		}
+		if tmpl, err = tmpl.Parse(string(text)); err != nil {
+			return nil, err
+		}
+	}
+	data.Site = siteData{Title: cfg.Title(), MapTiles: cfg.MapTiles, MapAttribution: cfg.MapAttribution}
+	var buffer bytes.Buffer
+	if err := tmpl.Execute(&buffer, data); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// uploadPage Renders a page and uploads it
+func uploadPage(svc s3iface.S3API, bucketName, destName string, data pageData) {
+	page, err := renderPage(data)
+	if err != nil {
+		log.Error("Unable to render ", destName, ": ", err)
+		return
+	}
+	UploadToS3(svc, destName, bucketName, page, int64(len(page)), true)
+}
+
+// themeAssets Gets the assets to upload keyed by name, the theme directory can replace or add to the built-in ones
+func themeAssets() map[string][]byte {
+	assets := make(map[string][]byte)
+	fs.WalkDir(builtinTheme, "theme/assets", func(fileName string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			assets[strings.TrimPrefix(fileName, "theme/assets/")], err = builtinTheme.ReadFile(fileName)
+		}
+		return err
+	})
+	if len(cfg.Theme) == 0 {
+		return assets
+	}
+
+	assetsDir := filepath.Join(cfg.Theme, "assets")
+	filepath.Walk(assetsDir, func(fileName string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		data, err := os.ReadFile(fileName)
+		if err != nil {
+			log.Error(err)
+			return nil
+		}
+		name, _ := filepath.Rel(assetsDir, fileName)
+		assets[filepath.ToSlash(name)] = data
+		return nil
+	})
+	return assets
+}
+
+// uploadAssets Uploads the theme assets to the bucket, skipping files that haven't changed
+func uploadAssets(svc s3iface.S3API, bucketName string) {
+	etags := make(map[string]string)
+	for _, obj := range GetObjectsFromBucket(svc, bucketName, assetsPrefix) {
+		if obj.ETag != nil {
+			etags[*obj.Key] = strings.Trim(*obj.ETag, `"`)
+		}
+	}
+
+	for name, data := range themeAssets() {
+		key := assetsPrefix + name
+		sum := md5.Sum(data)
+		if etags[key] != hex.EncodeToString(sum[:]) {
+			UploadToS3(svc, key, bucketName, data, int64(len(data)), true)
+		}
+	}
+}
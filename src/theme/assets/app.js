@@ -0,0 +1,812 @@
+// Photo gallery frontend, renders the json indexes written by the uploader.
+// Plain JavaScript without dependencies so the pages make no requests outside the bucket.
+(function () {
+	"use strict";
+
+	function $(tag, attrs, children) {
+		var el = document.createElement(tag);
+		Object.keys(attrs || {}).forEach(function (name) {
+			if (name === "text") {
+				el.textContent = attrs[name];
+			} else {
+				el.setAttribute(name, attrs[name]);
+			}
+		});
+		(children || []).forEach(function (child) { el.appendChild(child); });
+		return el;
+	}
+
+	function getJSON(url) {
+		return fetch(url, { cache: "no-cache" }).then(function (response) {
+			if (!response.ok) {
+				throw new Error("Unable to load " + url + ": " + response.status);
+			}
+			return response.json();
+		});
+	}
+
+	function showMessage(text, isError) {
+		var main = document.querySelector("main");
+		main.textContent = "";
+		main.appendChild($("p", { "class": "message" + (isError ? " error" : ""), text: text }));
+	}
+
+	var albumsPrefix = "albums/";
+
+	function isMovie(fileName) {
+		return /\.(mov|mp4|m4v|avi|mkv|3gp|mts|webm)$/i.test(fileName);
+	}
+
+	// thumbKey Gets the key of the thumbnail the uploader creates for a photo or movie
+	function thumbKey(key) {
+		return "_renditions/" + key + "/thumb.jpg";
+	}
+
+	// encodeKey Turns a key into a link relative to the root of the bucket
+	function encodeKey(key) {
+		return key.split("/").map(encodeURIComponent).join("/");
+	}
+
+	// encodeLink Encodes a relative link, presigned links are left alone
+	function encodeLink(link) {
+		return link.indexOf("://") >= 0 ? link : encodeKey(link);
+	}
+
+	// tile Creates a thumbnail linking to href with an optional caption and count
+	function tile(href, thumb, caption, alt, count) {
+		// Files without a thumbnail, such as movies uploaded with -no-thumbnails, get a blank square
+		var children = [thumb ? $("img", { src: thumb, alt: alt || caption || "", loading: "lazy", decoding: "async" }) : $("div", { "class": "blank", title: alt || caption || "" })];
+		if (caption) {
+			var span = $("span", { text: caption });
+			if (count) {
+				span.appendChild(document.createTextNode(" "));
+				span.appendChild($("small", { text: count }));
+			}
+			children.push(span);
+		}
+		return $("a", { "class": "tile", href: href }, children);
+	}
+
+	// relativeLink Makes a link relative to a parent folder, presigned links are left alone
+	function relativeLink(parent, link) {
+		return link.indexOf("://") >= 0 ? link : parent + link;
+	}
+
+	function monthName(month) {
+		return new Date(month + "-01T00:00:00").toLocaleString(undefined, { month: "long" });
+	}
+
+	function gallery(tiles) {
+		var main = document.querySelector("main");
+		main.textContent = "";
+		main.appendChild($("div", { "class": "gallery" }, tiles));
+	}
+
+	// infoRows Describes the metadata recorded when the photo was processed, as [label, value] pairs
+	function infoRows(item) {
+		var info = item.info || {};
+		var rows = [];
+		if (info.caption) {
+			rows.push(["Caption", info.caption]);
+		}
+		if (info.tags && info.tags.length > 0) {
+			rows.push(["Tags", info.tags.join(", ")]);
+		}
+		if (info.rating) {
+			rows.push(["Rating", info.rating < 0 ? "Rejected" : new Array(info.rating + 1).join("\u2605")]);
+		}
+		if (info.label) {
+			rows.push(["Label", info.label]);
+		}
+		if (info.taken) {
+			rows.push(["Date", new Date(info.taken).toLocaleString()]);
+		}
+		if (info.camera) {
+			rows.push(["Camera", info.camera]);
+		}
+		if (info.lens) {
+			rows.push(["Lens", info.lens]);
+		}
+		var exposure = [];
+		if (info.exposure) {
+			exposure.push(info.exposure + "s");
+		}
+		if (info.aperture) {
+			exposure.push("f/" + info.aperture);
+		}
+		if (info.iso) {
+			exposure.push("ISO " + info.iso);
+		}
+		if (info.focal_length) {
+			exposure.push(info.focal_length + "mm");
+		}
+		if (exposure.length > 0) {
+			rows.push(["Exposure", exposure.join(" · ")]);
+		}
+		if (info.width && info.height) {
+			rows.push(["Size", info.width + " × " + info.height]);
+		}
+		if (info.lat !== undefined && info.lon !== undefined) {
+			rows.push(["Location", (info.place ? info.place + " · " : "") + info.lat.toFixed(5) + ", " + info.lon.toFixed(5)]);
+		}
+		return rows;
+	}
+
+	// preload Starts downloading a photo so it shows straight away when navigating to it
+	function preload(item) {
+		if (item && !isMovie(item.name)) {
+			new Image().src = item.url;
+		}
+	}
+
+	// livePhoto Plays the movie of a Live Photo or motion photo over it while the pointer rests on it,
+	// or while it is held down on touch screens
+	function livePhoto(img, url) {
+		var video = $("video", { src: url, muted: "", loop: "", playsinline: "", preload: "none", hidden: "" });
+		video.muted = true;
+		function play() {
+			video.hidden = false;
+			video.play().catch(function () { video.hidden = true; });
+		}
+		function stop() {
+			video.pause();
+			video.currentTime = 0;
+			video.hidden = true;
+		}
+		var el = $("div", { "class": "live" }, [img, video, $("span", { "class": "live-badge", text: "LIVE" })]);
+		el.addEventListener("mouseenter", play);
+		el.addEventListener("mouseleave", stop);
+		el.addEventListener("touchstart", play, { passive: true });
+		el.addEventListener("touchend", stop);
+		return el;
+	}
+
+	// Lightbox shows one item at a time, items are {name, url, info}. The open item is kept in the
+	// location hash so it can be linked to, eg. index.html#IMG_1234.jpg
+	var lightbox = {
+		items: [],
+		index: -1,
+
+		init: function () {
+			var box = $("div", { "class": "lightbox", hidden: "", role: "dialog", "aria-modal": "true" }, [
+				$("div", { "class": "media" }),
+				$("div", { "class": "caption" }),
+				$("dl", { "class": "info", hidden: "" }),
+				$("button", { "class": "prev", "aria-label": "Previous", text: "‹" }),
+				$("button", { "class": "next", "aria-label": "Next", text: "›" }),
+				$("button", { "class": "toggle-info", "aria-label": "Info", title: "Info (i)", text: "ⓘ" }),
+				$("button", { "class": "close", "aria-label": "Close", text: "×" })
+			]);
+			document.body.appendChild(box);
+			this.box = box;
+
+			box.querySelector(".prev").addEventListener("click", this.move.bind(this, -1));
+			box.querySelector(".next").addEventListener("click", this.move.bind(this, 1));
+			box.querySelector(".toggle-info").addEventListener("click", this.toggleInfo.bind(this));
+			box.querySelector(".close").addEventListener("click", this.close.bind(this));
+			box.addEventListener("click", function (e) {
+				if (e.target === box || e.target.classList.contains("media")) {
+					lightbox.close();
+				}
+			});
+			document.addEventListener("keydown", function (e) {
+				if (box.hidden) {
+					return;
+				}
+				if (e.key === "ArrowLeft") {
+					lightbox.move(-1);
+				} else if (e.key === "ArrowRight") {
+					lightbox.move(1);
+				} else if (e.key === "Escape") {
+					lightbox.close();
+				} else if (e.key === "i") {
+					lightbox.toggleInfo();
+				}
+			});
+
+			// Horizontal swipes move between items on touch screens
+			var startX = null, startY = null;
+			box.addEventListener("touchstart", function (e) {
+				startX = e.touches[0].clientX;
+				startY = e.touches[0].clientY;
+			}, { passive: true });
+			box.addEventListener("touchend", function (e) {
+				if (startX === null) {
+					return;
+				}
+				var dx = e.changedTouches[0].clientX - startX;
+				var dy = e.changedTouches[0].clientY - startY;
+				startX = null;
+				if (Math.abs(dx) > 50 && Math.abs(dx) > Math.abs(dy)) {
+					lightbox.move(dx < 0 ? 1 : -1);
+				}
+			});
+		},
+
+		open: function (items, index) {
+			if (!this.box) {
+				this.init();
+			}
+			this.items = items;
+			this.show(index);
+			this.box.hidden = false;
+			document.body.style.overflow = "hidden";
+		},
+
+		show: function (index) {
+			var item = this.items[index];
+			this.index = index;
+			var media = this.box.querySelector(".media");
+			media.textContent = "";
+			if (isMovie(item.name)) {
+				media.appendChild($("video", { src: item.url, controls: "", autoplay: "", playsinline: "" }));
+			} else {
+				var img = $("img", { src: item.url, alt: item.name });
+				media.appendChild(item.live ? livePhoto(img, item.live) : img);
+			}
+			var caption = this.box.querySelector(".caption");
+			caption.textContent = "";
+			caption.appendChild($("a", { href: item.url, text: item.name }));
+			caption.appendChild(document.createTextNode(" (" + (index + 1) + " of " + this.items.length + ")"));
+			this.box.querySelector(".prev").hidden = index === 0;
+			this.box.querySelector(".next").hidden = index === this.items.length - 1;
+
+			var rows = infoRows(item);
+			var info = this.box.querySelector(".info");
+			info.textContent = "";
+			rows.forEach(function (row) {
+				info.appendChild($("dt", { text: row[0] }));
+				info.appendChild($("dd", { text: row[1] }));
+			});
+			this.box.querySelector(".toggle-info").hidden = rows.length === 0;
+
+			preload(this.items[index + 1]);
+			preload(this.items[index - 1]);
+			if (this.linkable) {
+				history.replaceState(null, "", "#" + encodeURIComponent(item.name));
+			}
+		},
+
+		toggleInfo: function () {
+			var info = this.box.querySelector(".info");
+			info.hidden = !info.hidden;
+		},
+
+		move: function (step) {
+			var index = this.index + step;
+			if (index >= 0 && index < this.items.length) {
+				this.show(index);
+			}
+		},
+
+		close: function () {
+			if (this.box.hidden) {
+				return;
+			}
+			this.box.hidden = true;
+			this.box.querySelector(".media").textContent = "";
+			document.body.style.overflow = "";
+			if (this.linkable) {
+				history.replaceState(null, "", location.pathname + location.search);
+			}
+		},
+
+		// openHash Opens the item named in the location hash, or closes the lightbox if there is none
+		openHash: function (items) {
+			var name = decodeURIComponent(location.hash.slice(1));
+			for (var i = 0; i < items.length; i++) {
+				if (items[i].name === name) {
+					this.open(items, i);
+					return;
+				}
+			}
+			if (this.box) {
+				this.close();
+			}
+		}
+	};
+
+	// showItems Renders thumbnails that open in the lightbox, items are {name, url, thumb}
+	function showItems(items) {
+		if (items.length === 0) {
+			showMessage("No photos yet.");
+			return;
+		}
+		gallery(itemTiles(items));
+	}
+
+	function itemTiles(items) {
+		return items.map(function (item, index) {
+			var el = tile(item.url, item.thumb, "", item.name);
+			if (isMovie(item.name)) {
+				el.classList.add("movie");
+			} else if (item.live) {
+				el.classList.add("live");
+			}
+			el.addEventListener("click", function (e) {
+				if (e.ctrlKey || e.metaKey || e.shiftKey) {
+					return; // let the browser open it in a new tab
+				}
+				e.preventDefault();
+				lightbox.open(items, index);
+			});
+			return el;
+		});
+	}
+
+	// stackTiles Only shows the cover of each burst, with the number of frames behind it. The viewer still
+	// steps through every frame.
+	function stackTiles(items, tiles) {
+		var counts = {};
+		items.forEach(function (item) {
+			var stack = item.info && item.info.stack;
+			if (stack) {
+				counts[stack] = (counts[stack] || 0) + 1;
+			}
+		});
+		return tiles.filter(function (el, index) {
+			var stack = items[index].info && items[index].info.stack;
+			if (!stack) {
+				return true;
+			}
+			if (stack !== items[index].name) {
+				return false;
+			}
+			el.classList.add("stack");
+			el.setAttribute("data-count", counts[stack]);
+			el.title = counts[stack] + " similar photos";
+			return true;
+		});
+	}
+
+	function mainPage() {
+		return getJSON("years.json").then(function (data) {
+			gallery((data.years || []).map(function (year) {
+				// Older versions only listed the years
+				if (typeof year === "string") {
+					year = { year: year };
+				}
+				var count = (year.photos || 0) + (year.videos || 0);
+				var el = tile(year.year + "/index.html", year.cover || "assets/folder.svg", year.year, year.year, count);
+				if (year.from && year.to) {
+					el.title = year.from + " to " + year.to + " · " + (year.photos || 0) + " photos, " + (year.videos || 0) + " videos";
+				}
+				return el;
+			}));
+		});
+	}
+
+	// yearPage Shows the months of a year, the cover is the first date with a thumbnail
+	function yearPage() {
+		return getJSON("dates.json").then(function (data) {
+			var months = [];
+			(data.dates || []).forEach(function (date) {
+				var month = date.date.slice(0, 7);
+				var last = months[months.length - 1];
+				if (!last || last.month !== month) {
+					last = { month: month, count: 0, thumb: "" };
+					months.push(last);
+				}
+				last.count += date.count || 0;
+			});
+			// The page lists the months with the covers picked when it was generated, only the counts are updated
+			var covers = {};
+			document.querySelectorAll(".gallery .tile").forEach(function (el) {
+				covers[el.getAttribute("href")] = el.querySelector("img").getAttribute("src");
+			});
+			gallery(months.map(function (month) {
+				var href = month.month + "/index.html";
+				return tile(href, covers[href] || "../assets/folder.svg", monthName(month.month), month.month, month.count);
+			}));
+		});
+	}
+
+	function monthPage() {
+		var month = document.body.getAttribute("data-month");
+		return getJSON("../dates.json").then(function (data) {
+			gallery((data.dates || []).filter(function (date) {
+				return date.date.indexOf(month) === 0;
+			}).map(function (date) {
+				return tile("../" + date.date + "/index.html", relativeLink("../", date.thumb), date.date, date.date, date.count);
+			}));
+		});
+	}
+
+	// timelinePage Shows every photo newest first, loading a month at a time while scrolling. The hash
+	// can name a year or month to start from, eg. timeline.html#2016-05
+	function timelinePage() {
+		return getJSON("timeline.json").then(function (data) {
+			var months = (data.months || []).map(function (month) { return month.month; }).reverse();
+			var start = decodeURIComponent(location.hash.slice(1));
+			if (start) {
+				var from = months.findIndex(function (month) { return month.indexOf(start) === 0 || month < start; });
+				months = from < 0 ? [] : months.slice(from);
+			}
+			var main = document.querySelector("main");
+			main.textContent = "";
+			if (months.length === 0) {
+				showMessage("No photos yet.");
+				return;
+			}
+
+			var sentinel = $("p", { "class": "message", text: "Loading…" });
+			main.appendChild(sentinel);
+			var loading = false;
+
+			function loadNext() {
+				if (loading || months.length === 0) {
+					return;
+				}
+				loading = true;
+				var month = months.shift();
+				getJSON(month.slice(0, 4) + "/" + month + "/timeline.json").then(function (shard) {
+					var items = [];
+					(shard.days || []).slice().reverse().forEach(function (day) {
+						var folder = month.slice(0, 4) + "/" + day.date + "/";
+						var urls = day.urls || {};
+						day.files.forEach(function (fileName) {
+							// Older shards don't list the thumbnails, which were linked whether they existed or not
+							var thumb = urls[thumbKey(folder + fileName)] || encodeKey(thumbKey(folder + fileName));
+							if (day.thumbs) {
+								thumb = day.thumbs[fileName] ? encodeLink(day.thumbs[fileName]) : "";
+							}
+							items.push({
+								name: fileName,
+								url: urls[fileName] || folder + encodeURIComponent(fileName),
+								thumb: thumb
+							});
+						});
+					});
+					var title = $("a", { href: month.slice(0, 4) + "/" + month + "/index.html", text: monthName(month) + " " + month.slice(0, 4) });
+					main.insertBefore($("section", { "class": "month" }, [$("h2", {}, [title]), $("div", { "class": "gallery" }, itemTiles(items))]), sentinel);
+				}).catch(function (err) {
+					main.insertBefore($("p", { "class": "message error", text: err.message }), sentinel);
+				}).then(function () {
+					loading = false;
+					if (months.length === 0) {
+						sentinel.remove();
+					} else if (sentinel.getBoundingClientRect().top < window.innerHeight * 2) {
+						loadNext(); // keep going until the page can scroll
+					}
+				});
+			}
+
+			new IntersectionObserver(function (entries) {
+				if (entries[0].isIntersecting) {
+					loadNext();
+				}
+			}, { rootMargin: "100% 0px" }).observe(sentinel);
+			loadNext();
+		});
+	}
+
+	function dayPage() {
+		return getJSON("photos.json").then(function (data) {
+			// Private buckets list a presigned url for each file
+			var urls = data.urls || {};
+			function url(fileName) {
+				return urls[fileName] || encodeURIComponent(fileName);
+			}
+			var info = data.info || {};
+			var thumbs = data.thumbs || {};
+			var items = (data.files || []).map(function (fileName) {
+				var live = info[fileName] && info[fileName].live;
+				return { name: fileName, url: url(fileName), thumb: thumbs[fileName] ? encodeLink(thumbs[fileName]) : "", info: info[fileName], live: live ? url(live) : "" };
+			});
+			if (items.length === 0) {
+				showMessage("No photos yet.");
+			} else {
+				gallery(stackTiles(items, itemTiles(items)));
+			}
+
+			// Day pages can link straight to a photo
+			lightbox.linkable = true;
+			lightbox.openHash(items);
+			window.addEventListener("hashchange", function () { lightbox.openHash(items); });
+		});
+	}
+
+	// albumPage Shows the photos of an album, which link to the originals in the date folders
+	function albumPage() {
+		return getJSON("album.json").then(function (album) {
+			var urls = album.urls || {};
+			function url(key) {
+				return urls[key] || "../../" + encodeKey(key);
+			}
+			showItems((album.files || []).map(function (key) {
+				// Older albums don't list the thumbnails, which were linked whether they existed or not
+				var thumb = url(thumbKey(key));
+				if (album.thumbs) {
+					thumb = album.thumbs[key] ? encodeLink(album.thumbs[key]) : "";
+				}
+				return { name: key.slice(key.lastIndexOf("/") + 1), url: url(key), thumb: thumb };
+			}));
+		});
+	}
+
+	// searchTerms Splits a query the same way the uploader splits the indexed text
+	function searchTerms(text) {
+		return text.toLowerCase().split(/[^\p{L}\p{N}]+/u).filter(function (term) { return term; });
+	}
+
+	// searchPage Finds albums and photos in search.json whose words start with every term of the query,
+	// the query is kept in the address, eg. search.html?q=kyoto+2016
+	function searchPage() {
+		var input = document.querySelector(".search input");
+		input.value = new URLSearchParams(location.search).get("q") || "";
+		return getJSON("search.json").then(function (index) {
+			var photos = (index.photos || []).map(function (photo) {
+				return { key: photo[0], words: photo[1].split(" "), thumb: photo[2] };
+			});
+			var limit = 200;
+
+			function matches(words, terms) {
+				return terms.every(function (term) {
+					return words.some(function (word) { return word.indexOf(term) === 0; });
+				});
+			}
+
+			function search() {
+				var terms = searchTerms(input.value);
+				history.replaceState(null, "", input.value ? "?q=" + encodeURIComponent(input.value) : location.pathname);
+				var main = document.querySelector("main");
+				main.textContent = "";
+				if (terms.length === 0) {
+					return;
+				}
+				var albums = (index.albums || []).filter(function (album) { return matches(searchTerms(album.name), terms); });
+				var found = photos.filter(function (photo) { return matches(photo.words, terms); });
+				if (albums.length === 0 && found.length === 0) {
+					showMessage("Nothing found.");
+					return;
+				}
+				if (albums.length > 0) {
+					main.appendChild($("section", { "class": "albums" }, [$("h2", { text: "Albums" }), $("div", { "class": "gallery" }, albums.map(function (album) {
+						return tile(albumsPrefix + album.id + "/index.html", album.cover || "assets/folder.svg", album.name, album.id, album.count);
+					}))]));
+				}
+				if (found.length > 0) {
+					var heading = found.length > limit ? "Photos (first " + limit + " of " + found.length + ")" : "Photos (" + found.length + ")";
+					main.appendChild($("section", { "class": "albums" }, [$("h2", { text: heading }), $("div", { "class": "gallery" }, found.slice(0, limit).map(function (photo) {
+						var slash = photo.key.lastIndexOf("/");
+						var folder = photo.key.slice(0, slash + 1), name = photo.key.slice(slash + 1);
+						var el = tile(folder + "index.html#" + encodeURIComponent(name), photo.thumb || encodeKey(thumbKey(photo.key)), folder.slice(5, 15), name);
+						if (isMovie(name)) {
+							el.classList.add("movie");
+						}
+						return el;
+					}))]));
+				}
+			}
+
+			var timer = null;
+			input.addEventListener("input", function () {
+				clearTimeout(timer);
+				timer = setTimeout(search, 200);
+			});
+			input.form.addEventListener("submit", function (e) {
+				e.preventDefault();
+				search();
+			});
+			search();
+		});
+	}
+
+	// Map tiles use the usual web mercator scheme, the world is tileSize pixels wide at zoom 0
+	var tileSize = 256, maxZoom = 18, clusterSize = 64;
+
+	// project Gets the pixel position of a point at a zoom level
+	function project(lon, lat, zoom) {
+		var scale = tileSize * Math.pow(2, zoom);
+		var sin = Math.max(Math.min(Math.sin(lat * Math.PI / 180), 0.9999), -0.9999);
+		return { x: (lon + 180) / 360 * scale, y: (0.5 - Math.log((1 + sin) / (1 - sin)) / (4 * Math.PI)) * scale };
+	}
+
+	// clusterPoints Groups the photos in the same clusterSize square at a zoom level
+	function clusterPoints(features, zoom) {
+		var cells = {}, clusters = [];
+		features.forEach(function (feature) {
+			var point = project(feature.geometry.coordinates[0], feature.geometry.coordinates[1], zoom);
+			var cell = Math.floor(point.x / clusterSize) + "," + Math.floor(point.y / clusterSize);
+			if (!cells[cell]) {
+				cells[cell] = { x: 0, y: 0, features: [] };
+				clusters.push(cells[cell]);
+			}
+			cells[cell].x += point.x;
+			cells[cell].y += point.y;
+			cells[cell].features.push(feature);
+		});
+		clusters.forEach(function (cluster) {
+			cluster.x /= cluster.features.length;
+			cluster.y /= cluster.features.length;
+		});
+		return clusters;
+	}
+
+	// mapPage Shows the photos in geo.json clustered on a map, tiles come from the configured tile URL
+	// so no third party is involved unless one is configured
+	function mapPage() {
+		var tiles = document.body.getAttribute("data-tiles");
+		var attribution = document.body.getAttribute("data-attribution");
+		return getJSON("geo.json").then(function (data) {
+			var features = data.features || [];
+			if (features.length === 0) {
+				showMessage("No photos with a location yet.");
+				return;
+			}
+			var layer = $("div", { "class": "layer" });
+			var zoomIn = $("button", { "aria-label": "Zoom in", text: "+" });
+			var zoomOut = $("button", { "aria-label": "Zoom out", text: "−" });
+			var map = $("div", { "class": "map" }, [layer, $("div", { "class": "controls" }, [zoomIn, zoomOut])]);
+			if (attribution) {
+				map.appendChild($("div", { "class": "attribution", text: attribution }));
+			}
+			var photos = $("div", { "class": "gallery" });
+			var main = document.querySelector("main");
+			main.textContent = "";
+			main.appendChild(map);
+			main.appendChild(photos);
+
+			// Start at the closest zoom showing every photo
+			var width = map.clientWidth, height = map.clientHeight;
+			var zoom, center;
+			for (zoom = maxZoom; zoom >= 0; zoom--) {
+				var points = features.map(function (f) { return project(f.geometry.coordinates[0], f.geometry.coordinates[1], zoom); });
+				var xs = points.map(function (p) { return p.x; }), ys = points.map(function (p) { return p.y; });
+				var minX = Math.min.apply(null, xs), maxX = Math.max.apply(null, xs);
+				var minY = Math.min.apply(null, ys), maxY = Math.max.apply(null, ys);
+				center = { x: (minX + maxX) / 2, y: (minY + maxY) / 2 };
+				if (zoom === 0 || (maxX - minX < width - 80 && maxY - minY < height - 80)) {
+					break;
+				}
+			}
+
+			function showPhotos(cluster) {
+				photos.textContent = "";
+				cluster.features.forEach(function (feature) {
+					var props = feature.properties;
+					photos.appendChild(tile(props.page, props.thumb || "assets/folder.svg", props.date, props.name));
+				});
+			}
+
+			function render() {
+				layer.style.transform = "";
+				layer.textContent = "";
+				var left = center.x - width / 2, top = center.y - height / 2;
+				if (tiles) {
+					var count = Math.pow(2, zoom);
+					for (var tx = Math.floor(left / tileSize); tx * tileSize < left + width; tx++) {
+						for (var ty = Math.max(0, Math.floor(top / tileSize)); ty * tileSize < top + height && ty < count; ty++) {
+							var src = tiles.replace("{z}", zoom).replace("{x}", ((tx % count) + count) % count).replace("{y}", ty);
+							layer.appendChild($("img", { "class": "map-tile", alt: "", src: src, style: "left:" + (tx * tileSize - left) + "px;top:" + (ty * tileSize - top) + "px" }));
+						}
+					}
+				}
+				clusterPoints(features, zoom).forEach(function (cluster) {
+					var style = "left:" + (cluster.x - left) + "px;top:" + (cluster.y - top) + "px";
+					var props = cluster.features[0].properties;
+					if (cluster.features.length === 1) {
+						layer.appendChild($("a", { "class": "marker" + (props.thumb ? " photo" : ""), href: props.page, title: props.date + " " + props.name, style: style },
+							props.thumb ? [$("img", { src: props.thumb, alt: props.name })] : []));
+						return;
+					}
+					var marker = $("button", { "class": "marker", title: cluster.features.length + " photos", style: style, text: cluster.features.length });
+					marker.addEventListener("click", function () {
+						showPhotos(cluster);
+						center = { x: cluster.x, y: cluster.y };
+						zoomAround(zoom + 2, 0, 0);
+					});
+					layer.appendChild(marker);
+				});
+			}
+
+			// zoomAround Zooms keeping the point at offset x, y from the centre in the same place
+			function zoomAround(newZoom, x, y) {
+				newZoom = Math.max(0, Math.min(maxZoom, newZoom));
+				var scale = Math.pow(2, newZoom - zoom);
+				center = { x: (center.x + x) * scale - x, y: (center.y + y) * scale - y };
+				zoom = newZoom;
+				render();
+			}
+
+			function offset(e) {
+				var rect = map.getBoundingClientRect();
+				return { x: e.clientX - rect.left - width / 2, y: e.clientY - rect.top - height / 2 };
+			}
+
+			zoomIn.addEventListener("click", function () { zoomAround(zoom + 1, 0, 0); });
+			zoomOut.addEventListener("click", function () { zoomAround(zoom - 1, 0, 0); });
+			map.addEventListener("wheel", function (e) {
+				e.preventDefault();
+				var at = offset(e);
+				zoomAround(zoom + (e.deltaY < 0 ? 1 : -1), at.x, at.y);
+			}, { passive: false });
+			map.addEventListener("dblclick", function (e) {
+				var at = offset(e);
+				zoomAround(zoom + 1, at.x, at.y);
+			});
+
+			// Dragging only moves the layer, it is drawn again once the pointer is released
+			var drag = null;
+			map.addEventListener("pointerdown", function (e) {
+				if (e.target.closest(".marker, .controls")) {
+					return;
+				}
+				drag = { x: e.clientX, y: e.clientY };
+				map.setPointerCapture(e.pointerId);
+			});
+			map.addEventListener("pointermove", function (e) {
+				if (drag) {
+					layer.style.transform = "translate(" + (e.clientX - drag.x) + "px," + (e.clientY - drag.y) + "px)";
+				}
+			});
+			map.addEventListener("pointerup", function (e) {
+				if (!drag) {
+					return;
+				}
+				center = { x: center.x - (e.clientX - drag.x), y: center.y - (e.clientY - drag.y) };
+				drag = null;
+				render();
+			});
+			window.addEventListener("resize", function () {
+				width = map.clientWidth;
+				height = map.clientHeight;
+				render();
+			});
+			render();
+		});
+	}
+
+	function fromBase64(data) {
+		return Uint8Array.from(atob(data), function (c) { return c.charCodeAt(0); });
+	}
+
+	// unlockShare Decrypts the file list using the same PBKDF2 and AES-GCM settings as the uploader
+	function unlockShare(share, password) {
+		var subtle = window.crypto.subtle;
+		return subtle.importKey("raw", new TextEncoder().encode(password), "PBKDF2", false, ["deriveKey"]).then(function (material) {
+			return subtle.deriveKey({ name: "PBKDF2", salt: fromBase64(share.salt), iterations: share.iterations, hash: "SHA-256" },
+				material, { name: "AES-GCM", length: 256 }, false, ["decrypt"]);
+		}).then(function (key) {
+			return subtle.decrypt({ name: "AES-GCM", iv: fromBase64(share.iv) }, key, fromBase64(share.data));
+		}).then(function (plainText) {
+			return JSON.parse(new TextDecoder().decode(plainText));
+		});
+	}
+
+	function sharePage() {
+		return getJSON("share.json").then(function (share) {
+			document.querySelector("h1").textContent = share.title;
+			if (share.expires && new Date(share.expires) < new Date()) {
+				showMessage("This link has expired.");
+				return;
+			}
+			if (!share.data) {
+				showItems(share.files || []);
+				return;
+			}
+
+			var input = $("input", { type: "password", placeholder: "Password", autofocus: "", "aria-label": "Password" });
+			var error = $("p", { "class": "error", hidden: "", text: "Wrong password." });
+			var form = $("form", { "class": "password" }, [input, error]);
+			form.addEventListener("submit", function (e) {
+				e.preventDefault();
+				unlockShare(share, input.value).then(showItems, function () {
+					error.hidden = false;
+				});
+			});
+			var main = document.querySelector("main");
+			main.textContent = "";
+			main.appendChild(form);
+			input.focus();
+		});
+	}
+
+	var pages = { main: mainPage, year: yearPage, month: monthPage, day: dayPage, timeline: timelinePage, map: mapPage, search: searchPage, album: albumPage, share: sharePage };
+	document.addEventListener("DOMContentLoaded", function () {
+		var page = pages[document.body.getAttribute("data-page")];
+		if (page) {
+			page().catch(function (err) { showMessage(err.message, true); });
+		}
+	});
+})();
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	filepath "path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderPageEscapesTitles(t *testing.T) {
+	setupProcess(t)
+	cfg.SiteTitle = `<script>alert("hi")</script>`
+
+	page, err := renderPage(pageData{Page: "main", Title: cfg.Title(), Assets: assetsPrefix})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(page), "<script>alert") {
+		t.Errorf("expected the title to be escaped:\n%s", page)
+	}
+}
+
+func TestThemeOverrides(t *testing.T) {
+	fake := setupProcess(t)
+	cfg.Theme = t.TempDir()
+	os.MkdirAll(filepath.Join(cfg.Theme, "templates"), 0777)
+	os.MkdirAll(filepath.Join(cfg.Theme, "assets"), 0777)
+	os.WriteFile(filepath.Join(cfg.Theme, "templates", "year.html"), []byte(`{{template "head" .}}<h1>Year {{.Year}}</h1>{{range .Items}}[{{.Name}}]{{end}}`), 0666)
+	os.WriteFile(filepath.Join(cfg.Theme, "assets", "app.css"), []byte("body { color: red; }"), 0666)
+	os.WriteFile(filepath.Join(cfg.Theme, "assets", "logo.svg"), []byte("<svg/>"), 0666)
+
+	createYearWebsite(fake, testBucket, "2016", []folderStruct{{Date: "2016-05-13", Thumb: "../_renditions/2016/2016-05-13/IMG_0001.jpg/thumb.jpg", Count: 1}})
+	page := string(fake.Object(testBucket, "2016/index.html"))
+	if !strings.Contains(page, "<h1>Year 2016</h1>[2016-05]") || !strings.Contains(page, `href="../assets/app.css"`) {
+		t.Errorf("expected the overridden template with the built-in layout, got:\n%s", page)
+	}
+
+	uploadAssets(fake, testBucket)
+	if css := string(fake.Object(testBucket, "assets/app.css")); css != "body { color: red; }" {
+		t.Errorf("expected app.css to be overridden, got %s", css)
+	}
+	for _, key := range []string{"assets/app.js", "assets/folder.svg", "assets/logo.svg"} {
+		if fake.Object(testBucket, key) == nil {
+			t.Errorf("expected %s to be uploaded", key)
+		}
+	}
+}
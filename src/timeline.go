@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// monthSummary A month on the year page and in timeline.json
+type monthSummary struct {
+	Month string `json:"month"` // 2006-01
+	Count int    `json:"count"`
+	Thumb string `json:"thumb,omitempty"` // cover, relative to the year folder
+}
+
+// timelineDay The photos and movies of a day in a timeline shard, like photos.json
+type timelineDay struct {
+	Date   string            `json:"date"`
+	Files  []string          `json:"files"`
+	URLs   map[string]string `json:"urls,omitempty"`
+	Thumbs map[string]string `json:"thumbs"` // of the files that have one, relative to the root unless presigned
+}
+
+// timelineShard The contents of a month's timeline.json
+type timelineShard struct {
+	Month string        `json:"month"`
+	Days  []timelineDay `json:"days"`
+}
+
+// monthName Formats a month like 2016-05 as May
+func monthName(month string) string {
+	date, err := time.Parse("2006-01", month)
+	if err != nil {
+		return month
+	}
+	return date.Format("January")
+}
+
+// relativeLink Makes a link relative to a parent folder, links to other sites are left alone
+func relativeLink(parent, link string) string {
+	if strings.Contains(link, "://") {
+		return link
+	}
+	return path.Join(parent, link)
+}
+
+// groupMonths Sums the dates of a year per month, the cover is picked from the covers of the dates
+func groupMonths(dates []folderStruct) []monthSummary {
+	var months []monthSummary
+	var monthDates [][]folderStruct
+	for _, dateF := range dates {
+		if len(dateF.Date) < len("2006-01") {
+			continue
+		}
+		month := dateF.Date[:len("2006-01")]
+		if len(months) == 0 || months[len(months)-1].Month != month {
+			months = append(months, monthSummary{Month: month, Thumb: folderIcon})
+			monthDates = append(monthDates, nil)
+		}
+		months[len(months)-1].Count += dateF.Count
+		monthDates[len(monthDates)-1] = append(monthDates[len(monthDates)-1], dateF)
+	}
+	for idx := range months {
+		if cover, ok := pickCover(dateCovers(monthDates[idx], pinnedCover(months[idx].Month))); ok {
+			months[idx].Thumb = cover.Thumb
+		}
+	}
+	return months
+}
+
+// createMonthWebsite Creates the index.html listing the dates in a month
+func createMonthWebsite(svc s3iface.S3API, bucketName, year, month string, dates []folderStruct) {
+	data := pageData{Page: "month", Title: year + "/" + month, Year: year, Month: month, Back: "../index.html", Assets: "../../" + assetsPrefix}
+	for _, dateF := range dates {
+		if strings.HasPrefix(dateF.Date, month) {
+			data.Items = append(data.Items, pageItem{Name: dateF.Date, Caption: dateF.Date, Count: dateF.Count, URL: "../" + dateF.Date + "/index.html", Thumb: relativeLink("../", dateF.Thumb)})
+		}
+	}
+	uploadPage(svc, bucketName, year+"/"+month+"/index.html", data)
+}
+
+// updateYear Regenerates the pages of a year after its dates.json changed, only the pages of the given
+// months are regenerated if any are given. Also updates the month counts in the timeline.
+func updateYear(svc s3iface.S3API, bucketName, year string, dates []folderStruct, months ...string) {
+	createYearWebsite(svc, bucketName, year, dates)
+	summaries := groupMonths(dates)
+	for _, summary := range summaries {
+		if len(months) == 0 || contains(months, summary.Month) {
+			createMonthWebsite(svc, bucketName, year, summary.Month, dates)
+		}
+	}
+	updateTimeline(svc, bucketName, year, summaries)
+}
+
+// contains Checks whether a list contains a value
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// updateTimeline Replaces the months of a year in timeline.json, the list of shards the timeline page loads
+func updateTimeline(svc s3iface.S3API, bucketName, year string, summaries []monthSummary) {
+	var timeline struct {
+		Months []monthSummary `json:"months"`
+	}
+	var oldJSON []byte
+	if reader := GetFromS3(svc, "timeline.json", bucketName); reader != nil {
+		json.NewDecoder(reader).Decode(&timeline)
+		oldJSON, _ = json.Marshal(timeline)
+	}
+
+	var months []monthSummary
+	for _, summary := range timeline.Months {
+		if !strings.HasPrefix(summary.Month, year+"-") {
+			months = append(months, summary)
+		}
+	}
+	for _, summary := range summaries {
+		// Covers are relative to the year folder, the timeline only needs the counts
+		months = append(months, monthSummary{Month: summary.Month, Count: summary.Count})
+	}
+	sort.Slice(months, func(i, j int) bool { return months[i].Month < months[j].Month })
+	timeline.Months = months
+
+	timelineJSON, _ := json.Marshal(timeline)
+	if string(timelineJSON) == string(oldJSON) {
+		return
+	}
+	UploadToS3(svc, "timeline.json", bucketName, timelineJSON, int64(len(timelineJSON)), true)
+	uploadPage(svc, bucketName, "timeline.html", pageData{Page: "timeline", Title: cfg.Title(), Back: "index.html", Assets: assetsPrefix})
+}
+
+// createTimelineShard Lists the photos of every date in a month into YYYY/YYYY-MM/timeline.json, so the
+// timeline can load a month at a time
+func createTimelineShard(svc s3iface.S3API, bucketName string, date time.Time) {
+	shard := timelineShard{Month: date.Format("2006-01")}
+	days := make(map[string]*timelineDay)
+	objects := GetObjectsFromBucket(svc, bucketName, date.Format("2006/2006-01-"))
+	legacy := legacyThumbs(objects, knownOriginals(svc, bucketName, objects))
+	thumbs := make(map[string]bool)
+	for _, obj := range GetObjectsFromBucket(svc, bucketName, renditionsPrefix+date.Format("2006/2006-01-")) {
+		thumbs[*obj.Key] = true
+	}
+	for _, obj := range objects {
+		matches := dayKeyRegExp.FindStringSubmatch(*obj.Key)
+		if _, ok := legacy[*obj.Key]; matches == nil || ok || IsGenerated(*obj.Key) || IsCompanion(*obj.Key) {
+			continue
+		}
+		day, ok := days[matches[1]]
+		if !ok {
+			day = &timelineDay{Date: matches[1], Thumbs: make(map[string]string)}
+			days[matches[1]] = day
+		}
+		day.Files = append(day.Files, matches[2])
+		if cfg.Access == AccessPresigned {
+			if day.URLs == nil {
+				day.URLs = make(map[string]string)
+			}
+			day.URLs[matches[2]] = PresignURL(svc, *obj.Key, bucketName, cfg.Expiry())
+		}
+		if thumbs[thumbKey(*obj.Key)] {
+			day.Thumbs[matches[2]] = thumbKey(*obj.Key)
+			if cfg.Access == AccessPresigned {
+				day.Thumbs[matches[2]] = PresignURL(svc, thumbKey(*obj.Key), bucketName, cfg.Expiry())
+			}
+		}
+	}
+	for _, day := range days {
+		shard.Days = append(shard.Days, *day)
+	}
+	sort.Slice(shard.Days, func(i, j int) bool { return shard.Days[i].Date < shard.Days[j].Date })
+
+	shardJSON, _ := json.Marshal(shard)
+	UploadToS3(svc, date.Format("2006/2006-01/timeline.json"), bucketName, shardJSON, int64(len(shardJSON)), true)
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"path"
+	filepath "path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// verifyReport Problems found by the verify command, written out as json
+type verifyReport struct {
+	LocalOnly          []string `json:"local_only"`          // in the output directory but not in the bucket
+	RemoteOnly         []string `json:"remote_only"`         // in the bucket but not in the output directory
+	Mismatched         []string `json:"mismatched"`          // size or checksum differs
+	MissingThumbnails  []string `json:"missing_thumbnails"`  // originals without a thumbnail
+	OrphanedThumbnails []string `json:"orphaned_thumbnails"` // thumbnails without an original
+	BrokenIndexEntries []string `json:"broken_index_entries"`
+
+	lock         sync.Mutex
+	staleFolders map[string]bool // day folders whose indexes need regenerating
+	staleDates   map[string]bool // dates.json entries to remove, keyed by 2006/2006-01-02
+	staleYears   map[string]bool // years.json entries to remove
+}
+
+// add Records a problem, safe to call from multiple goroutines
+func (r *verifyReport) add(list *[]string, key string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	*list = append(*list, key)
+}
+
+// Total Returns the number of problems found
+func (r *verifyReport) Total() int {
+	return len(r.LocalOnly) + len(r.RemoteOnly) + len(r.Mismatched) + len(r.MissingThumbnails) + len(r.OrphanedThumbnails) + len(r.BrokenIndexEntries)
+}
+
+// localFile A file in the output directory and the key it would have in the bucket
+type localFile struct {
+	fileName string
+	size     int64
+}
+
+// getLocalFiles Walks the output directory, keyed by the key each file would have in the bucket
+func getLocalFiles(outDir string) (map[string]localFile, error) {
+	files := make(map[string]localFile)
+	err := filepath.WalkDir(outDir, func(fileName string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !(IsJpeg(fileName) || IsHeic(fileName) || IsMovie(fileName)) {
+			return err
+		}
+
+		// Files outside of the date ordered layout aren't part of the archive
+		relDir, err := filepath.Rel(outDir, filepath.Dir(fileName))
+		if err != nil {
+			return err
+		}
+		date, err := time.Parse(cfg.Layout, filepath.ToSlash(relDir))
+		if err != nil {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files[date.Format("2006/2006-01-02/")+d.Name()] = localFile{fileName, info.Size()}
+		return nil
+	})
+	return files, err
+}
+
+// runParallel Calls fn for each item using a number of goroutines
+func runParallel(workers int, items []string, fn func(item string)) {
+	itemChan := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range itemChan {
+				fn(item)
+			}
+		}()
+	}
+	for _, item := range items {
+		itemChan <- item
+	}
+	close(itemChan)
+	wg.Wait()
+}
+
+// compareFiles Compares the output directory with the bucket
+func compareFiles(report *verifyReport, localFiles map[string]localFile, originals map[string]*s3.Object, checksums bool, workers int) {
+	var both []string
+	for key := range localFiles {
+		if _, ok := originals[key]; ok {
+			both = append(both, key)
+		} else {
+			report.LocalOnly = append(report.LocalOnly, localFiles[key].fileName)
+		}
+	}
+	for key := range originals {
+		if _, ok := localFiles[key]; !ok {
+			report.RemoteOnly = append(report.RemoteOnly, key)
+		}
+	}
+
+	runParallel(workers, both, func(key string) {
+		local, obj := localFiles[key], originals[key]
+		if local.size != *obj.Size {
+			// Encrypted originals are bigger, and can't be compared by checksum
+			if EncryptedSize(local.size) != *obj.Size {
+				report.add(&report.Mismatched, key)
+			}
+			return
+		}
+
+		etag := strings.Trim(*obj.ETag, `"`)
+		if !checksums || strings.Contains(etag, "-") {
+			return
+		}
+		sum, err := FileMD5(local.fileName)
+		if err != nil {
+			log.Error("Unable to read ", local.fileName, ": ", err)
+			return
+		}
+		if sum != etag {
+			report.add(&report.Mismatched, key)
+		}
+	})
+}
+
+// compareThumbnails Finds originals without thumbnails and thumbnails without originals
+func compareThumbnails(report *verifyReport, objects map[string]*s3.Object, originals map[string]*s3.Object) {
+	thumbs := make(map[string]bool)
+	for key := range originals {
+		thumbs[thumbKey(key)] = true
+		if _, ok := objects[thumbKey(key)]; !ok && !cfg.DisableThumbnails {
+			report.MissingThumbnails = append(report.MissingThumbnails, key)
+		}
+	}
+	for key := range objects {
+		if _, size, ok := renditionOf(key); ok && size == thumbSize && !thumbs[key] {
+			report.OrphanedThumbnails = append(report.OrphanedThumbnails, key)
+		}
+	}
+}
+
+// compareIndexes Checks that the years.json, dates.json and photos.json files match the bucket
+func compareIndexes(svc s3iface.S3API, bucketName string, report *verifyReport, objects map[string]*s3.Object, originals map[string]*s3.Object, workers int) {
+	folders := make(map[string]bool)
+	years := make(map[string]bool)
+	for key := range originals {
+		folders[path.Dir(key)] = true
+		years[path.Dir(path.Dir(key))] = true
+	}
+
+	// Every year listed needs originals, and every year with originals needs to be listed
+	listedFolders := make(map[string]bool)
+	listedYears := make(map[string]bool)
+	for _, year := range GetYears(svc, bucketName) {
+		listedYears[year] = true
+		if !years[year] {
+			report.BrokenIndexEntries = append(report.BrokenIndexEntries, "years.json: "+year)
+			report.staleYears[year] = true
+			continue
+		}
+
+		var dateStruct map[string][]folderStruct
+		reader := GetFromS3(svc, year+"/dates.json", bucketName)
+		if reader == nil {
+			continue
+		}
+		json.NewDecoder(reader).Decode(&dateStruct)
+		for _, dateF := range dateStruct["dates"] {
+			folderName := year + "/" + dateF.Date
+			listedFolders[folderName] = true
+			if !folders[folderName] {
+				report.BrokenIndexEntries = append(report.BrokenIndexEntries, year+"/dates.json: "+dateF.Date)
+				report.staleDates[folderName] = true
+				continue
+			}
+
+			// Thumbnails are relative to the year, other than presigned links
+			if !strings.Contains(dateF.Thumb, "://") {
+				if _, ok := objects[path.Join(year, dateF.Thumb)]; !ok {
+					report.BrokenIndexEntries = append(report.BrokenIndexEntries, year+"/dates.json: "+dateF.Thumb)
+					report.staleDates[folderName] = true
+					report.staleFolders[folderName] = true
+				}
+			}
+		}
+	}
+	for year := range years {
+		if !listedYears[year] {
+			report.BrokenIndexEntries = append(report.BrokenIndexEntries, "years.json: missing "+year)
+		}
+	}
+
+	// Every photos.json entry needs an object, and every original needs to be listed
+	var folderNames []string
+	for folderName := range folders {
+		folderNames = append(folderNames, folderName)
+		if !listedFolders[folderName] {
+			report.BrokenIndexEntries = append(report.BrokenIndexEntries, path.Dir(folderName)+"/dates.json: missing "+path.Base(folderName))
+			report.staleFolders[folderName] = true
+		}
+		if !listedYears[path.Dir(folderName)] {
+			report.staleFolders[folderName] = true
+		}
+	}
+	runParallel(workers, folderNames, func(folderName string) {
+		var photos struct {
+			Files []string `json:"files"`
+		}
+		reader := GetFromS3(svc, folderName+"/photos.json", bucketName)
+		if reader == nil || json.NewDecoder(reader).Decode(&photos) != nil {
+			report.add(&report.BrokenIndexEntries, folderName+"/photos.json: missing")
+			return
+		}
+
+		listed := make(map[string]bool)
+		for _, fileName := range photos.Files {
+			listed[folderName+"/"+fileName] = true
+			if _, ok := originals[folderName+"/"+fileName]; !ok {
+				report.add(&report.BrokenIndexEntries, folderName+"/photos.json: "+fileName)
+			}
+		}
+		for key := range originals {
+			if path.Dir(key) == folderName && !listed[key] {
+				report.add(&report.BrokenIndexEntries, folderName+"/photos.json: missing "+path.Base(key))
+			}
+		}
+	})
+
+	// Any broken photos.json entry means the folder needs regenerating
+	for _, entry := range report.BrokenIndexEntries {
+		if strings.Contains(entry, "/photos.json: ") {
+			report.staleFolders[strings.SplitN(entry, "/photos.json: ", 2)[0]] = true
+		}
+	}
+}
+
+// fixIndexes Removes stale dates.json and years.json entries, then regenerates the indexes of broken folders
+func fixIndexes(svc s3iface.S3API, bucketName string, report *verifyReport) {
+	staleYears := make(map[string]bool)
+	for folderName := range report.staleDates {
+		staleYears[path.Dir(folderName)] = true
+	}
+	for year := range staleYears {
+		var dateStruct map[string][]folderStruct
+		reader := GetFromS3(svc, year+"/dates.json", bucketName)
+		if reader == nil {
+			continue
+		}
+		json.NewDecoder(reader).Decode(&dateStruct)
+
+		var dates []folderStruct
+		for _, dateF := range dateStruct["dates"] {
+			if !report.staleDates[year+"/"+dateF.Date] {
+				dates = append(dates, dateF)
+			}
+		}
+		if len(dates) == 0 {
+			report.staleYears[year] = true
+		}
+		dateStruct["dates"] = dates
+		dateJSON, _ := json.Marshal(dateStruct)
+		UploadToS3(svc, year+"/dates.json", bucketName, dateJSON, int64(len(dateJSON)), true)
+		updateYear(svc, bucketName, year, dates)
+	}
+
+	if len(report.staleYears) > 0 {
+		var years []yearSummary
+		for _, year := range readYears(svc, bucketName) {
+			if !report.staleYears[year.Year] {
+				years = append(years, year)
+			}
+		}
+		writeYears(svc, bucketName, years)
+	}
+
+	for folderName := range report.staleFolders {
+		date, err := time.Parse("2006-01-02", path.Base(folderName))
+		if err != nil {
+			continue
+		}
+		createJSONandWebsiteForFolder(svc, bucketName, date)
+		log.Info("Regenerated indexes for ", folderName)
+	}
+}
+
+// verify Compares the output directory (if given), the bucket and the indexes in the bucket
+func verify(svc s3iface.S3API, bucketName, outDir string, checksums, fix bool, workers int) (*verifyReport, error) {
+	report := &verifyReport{
+		staleFolders: make(map[string]bool),
+		staleDates:   make(map[string]bool),
+		staleYears:   make(map[string]bool),
+	}
+
+	// Walk the output directory and list the bucket at the same time
+	var localFiles map[string]localFile
+	var localErr error
+	var wg sync.WaitGroup
+	if len(outDir) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			localFiles, localErr = getLocalFiles(outDir)
+		}()
+	}
+	objects := make(map[string]*s3.Object)
+	originals := make(map[string]*s3.Object)
+	untouched := make(map[string]*s3.Object)  // private originals of stripped copies and files that aren't published
+	liveVideos := make(map[string]*s3.Object) // copied to the output directory, but only listed with their photo
+	bucketObjects := GetObjectsFromBucket(svc, bucketName, "")
+	legacy := legacyThumbs(bucketObjects, knownOriginals(svc, bucketName, bucketObjects))
+	for _, obj := range bucketObjects {
+		objects[*obj.Key] = obj
+		if _, ok := legacy[*obj.Key]; ok {
+			continue // moved by the migrate command
+		}
+		if dayKeyRegExp.MatchString(*obj.Key) && !IsGenerated(*obj.Key) && !IsCompanion(*obj.Key) {
+			originals[*obj.Key] = obj
+		} else if dayKeyRegExp.MatchString(*obj.Key) && IsLiveVideo(*obj.Key) {
+			liveVideos[*obj.Key] = obj
+		} else if IsPrivateOriginal(*obj.Key) {
+			untouched[strings.TrimPrefix(*obj.Key, cfg.OriginalsPrefix)] = obj
+		}
+	}
+	wg.Wait()
+	if localErr != nil {
+		return nil, localErr
+	}
+
+	if localFiles != nil {
+		// The output directory has the untouched originals, not the stripped copies
+		remoteFiles := make(map[string]*s3.Object)
+		for key, obj := range originals {
+			if original, ok := untouched[key]; ok {
+				obj = original
+			}
+			remoteFiles[key] = obj
+		}
+		for key, obj := range untouched {
+			// Archived without being published
+			if _, ok := remoteFiles[key]; !ok && dayKeyRegExp.MatchString(key) && !IsSidecar(key) {
+				remoteFiles[key] = obj
+			}
+		}
+		for key, obj := range liveVideos {
+			if original, ok := untouched[key]; ok {
+				obj = original
+			}
+			remoteFiles[key] = obj
+		}
+		compareFiles(report, localFiles, remoteFiles, checksums, workers)
+	}
+	compareThumbnails(report, objects, originals)
+	compareIndexes(svc, bucketName, report, objects, originals, workers)
+
+	for _, list := range [][]string{report.LocalOnly, report.RemoteOnly, report.Mismatched, report.MissingThumbnails, report.OrphanedThumbnails, report.BrokenIndexEntries} {
+		sort.Strings(list)
+	}
+	if fix {
+		fixIndexes(svc, bucketName, report)
+	}
+	return report, nil
+}
+
+// logReport Logs a summary of the verify report
+func logReport(report *verifyReport) {
+	log.Info("Files only in the output directory: ", len(report.LocalOnly))
+	log.Info("Files only in the bucket: ", len(report.RemoteOnly))
+	log.Info("Files that differ: ", len(report.Mismatched))
+	log.Info("Originals without thumbnails: ", len(report.MissingThumbnails))
+	log.Info("Thumbnails without originals: ", len(report.OrphanedThumbnails))
+	log.Info("Broken index entries: ", len(report.BrokenIndexEntries))
+}
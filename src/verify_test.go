@@ -0,0 +1,194 @@
+package main
+
+import (
+	"os"
+	filepath "path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// deleteKeys Removes objects from the fake bucket
+func deleteKeys(fake *fakeS3, keys ...string) {
+	for _, key := range keys {
+		fake.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(testBucket), Key: aws.String(key)})
+	}
+}
+
+// putKey Uploads an object to the fake bucket without going through process
+func putKey(fake *fakeS3, key string, data []byte) {
+	fake.PutObject(&s3.PutObjectInput{Bucket: aws.String(testBucket), Key: aws.String(key), Body: aws.ReadSeekCloser(strings.NewReader(string(data)))})
+}
+
+// changeByte Flips a byte in the middle of a file, keeping its size
+func changeByte(t *testing.T, fileName string) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	os.WriteFile(fileName, data, 0666)
+}
+
+func TestVerifyFiles(t *testing.T) {
+	fake := setupProcess(t)
+	inDir, outDir := t.TempDir(), t.TempDir()
+	createFixtures(t, inDir, []fixture{
+		{"IMG_0001.jpg", day(2016, time.May, 13)},
+		{"IMG_0002.jpg", day(2016, time.May, 13)},
+		{"IMG_0003.jpg", day(2016, time.May, 14)},
+		{"IMG_0004.jpg", day(2016, time.May, 14)},
+	})
+	process(fake, inDir, outDir, testBucket)
+	report, err := verify(fake, testBucket, outDir, true, false, 2)
+	if err != nil || report.Total() != 0 {
+		t.Fatalf("expected verify to find nothing wrong, got %+v: %v", report, err)
+	}
+
+	local := func(key string) string { return filepath.Join(outDir, filepath.FromSlash(key)) }
+	// Truncated
+	data, _ := os.ReadFile(local("2016/2016-05-13/IMG_0001.jpg"))
+	os.WriteFile(local("2016/2016-05-13/IMG_0001.jpg"), data[:len(data)-1], 0666)
+	// Same size, different contents
+	changeByte(t, local("2016/2016-05-13/IMG_0002.jpg"))
+	// The ETag of a multipart upload isn't an md5, so only the size can be compared
+	changeByte(t, local("2016/2016-05-14/IMG_0003.jpg"))
+	fake.SetETag(testBucket, "2016/2016-05-14/IMG_0003.jpg", "0123456789abcdef0123456789abcdef-2")
+	// Only on one side
+	os.Remove(local("2016/2016-05-14/IMG_0004.jpg"))
+	os.MkdirAll(local("2016/2016-05-15"), 0777)
+	writeTestJPEG(t, local("2016/2016-05-15/IMG_0005.jpg"), day(2016, time.May, 15))
+
+	report, err = verify(fake, testBucket, outDir, true, false, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(report.Mismatched, ","); got != "2016/2016-05-13/IMG_0001.jpg,2016/2016-05-13/IMG_0002.jpg" {
+		t.Errorf("unexpected mismatched files: %s", got)
+	}
+	if got := strings.Join(report.RemoteOnly, ","); got != "2016/2016-05-14/IMG_0004.jpg" {
+		t.Errorf("unexpected files only in the bucket: %s", got)
+	}
+	if got := strings.Join(report.LocalOnly, ","); got != local("2016/2016-05-15/IMG_0005.jpg") {
+		t.Errorf("unexpected files only in the output directory: %s", got)
+	}
+
+	// Without checksums only the sizes are compared
+	report, _ = verify(fake, testBucket, outDir, false, false, 2)
+	if got := strings.Join(report.Mismatched, ","); got != "2016/2016-05-13/IMG_0001.jpg" {
+		t.Errorf("unexpected mismatched files without checksums: %s", got)
+	}
+}
+
+func TestVerifyEncrypted(t *testing.T) {
+	fake := setupProcess(t)
+	defer func(old *Keyring) { keyring = old }(keyring)
+	var err error
+	if keyring, err = NewKeyring("secret", ""); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Encrypt = true
+	inDir, outDir := t.TempDir(), t.TempDir()
+	createFixtures(t, inDir, []fixture{{"IMG_0001.jpg", day(2016, time.May, 13)}})
+	process(fake, inDir, outDir, testBucket)
+
+	// The output directory is compared with the encrypted original, not the published copy
+	report, err := verify(fake, testBucket, outDir, true, false, 1)
+	if err != nil || report.Total() != 0 {
+		t.Fatalf("expected verify to find nothing wrong, got %+v: %v", report, err)
+	}
+
+	fileName := filepath.Join(outDir, "2016", "2016-05-13", "IMG_0001.jpg")
+	data, _ := os.ReadFile(fileName)
+	os.WriteFile(fileName, append(data, 0), 0666)
+	report, _ = verify(fake, testBucket, outDir, true, false, 1)
+	if got := strings.Join(report.Mismatched, ","); got != "2016/2016-05-13/IMG_0001.jpg" {
+		t.Errorf("expected the size of the encrypted original to differ, got %s", got)
+	}
+}
+
+func TestVerifyThumbnails(t *testing.T) {
+	fake := setupProcess(t)
+	inDir := t.TempDir()
+	createFixtures(t, inDir, []fixture{
+		{"IMG_0001.jpg", day(2016, time.May, 13)},
+		{"IMG_0002.jpg", day(2016, time.May, 13)},
+	})
+	process(fake, inDir, "", testBucket)
+
+	thumb := fake.Object(testBucket, thumbKey("2016/2016-05-13/IMG_0002.jpg"))
+	deleteKeys(fake, thumbKey("2016/2016-05-13/IMG_0002.jpg"))
+	putKey(fake, thumbKey("2016/2016-05-13/IMG_0009.jpg"), thumb)
+
+	report, err := verify(fake, testBucket, "", false, false, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(report.MissingThumbnails, ","); got != "2016/2016-05-13/IMG_0002.jpg" {
+		t.Errorf("unexpected missing thumbnails: %s", got)
+	}
+	if got := strings.Join(report.OrphanedThumbnails, ","); got != thumbKey("2016/2016-05-13/IMG_0009.jpg") {
+		t.Errorf("unexpected orphaned thumbnails: %s", got)
+	}
+
+	// Without thumbnails none are missing
+	cfg.DisableThumbnails = true
+	report, _ = verify(fake, testBucket, "", false, false, 1)
+	if len(report.MissingThumbnails) != 0 {
+		t.Errorf("expected no missing thumbnails with thumbnails disabled, got %v", report.MissingThumbnails)
+	}
+}
+
+func TestVerifyIndexes(t *testing.T) {
+	fake := setupProcess(t)
+	inDir := t.TempDir()
+	createFixtures(t, inDir, []fixture{
+		{"IMG_0001.jpg", day(2016, time.May, 13)},
+		{"IMG_0002.jpg", day(2016, time.May, 13)},
+		{"IMG_0003.jpg", day(2016, time.May, 14)},
+		{"IMG_0004.jpg", day(2017, time.January, 1)},
+	})
+	process(fake, inDir, "", testBucket)
+
+	// Deleted behind the indexes' back
+	deleteKeys(fake, "2016/2016-05-13/IMG_0002.jpg", thumbKey("2016/2016-05-13/IMG_0002.jpg"))
+	deleteKeys(fake, "2016/2016-05-14/IMG_0003.jpg", thumbKey("2016/2016-05-14/IMG_0003.jpg"))
+	deleteKeys(fake, "2017/2017-01-01/IMG_0004.jpg", thumbKey("2017/2017-01-01/IMG_0004.jpg"))
+	// Uploaded without the indexes
+	photo := fake.Object(testBucket, "2016/2016-05-13/IMG_0001.jpg")
+	putKey(fake, "2016/2016-05-15/IMG_0005.jpg", photo)
+	putKey(fake, thumbKey("2016/2016-05-15/IMG_0005.jpg"), fake.Object(testBucket, thumbKey("2016/2016-05-13/IMG_0001.jpg")))
+
+	report, err := verify(fake, testBucket, "", false, false, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"2016/2016-05-13/photos.json: IMG_0002.jpg",
+		"2016/2016-05-15/photos.json: missing",
+		"2016/dates.json: 2016-05-14",
+		"2016/dates.json: missing 2016-05-15",
+		"years.json: 2017",
+	}
+	if got := strings.Join(report.BrokenIndexEntries, "\n"); got != strings.Join(expected, "\n") {
+		t.Errorf("unexpected broken index entries:\n%s\nexpected:\n%s", got, strings.Join(expected, "\n"))
+	}
+
+	// Fixing regenerates the broken folders and drops the stale entries
+	if _, err := verify(fake, testBucket, "", false, true, 2); err != nil {
+		t.Fatal(err)
+	}
+	report, err = verify(fake, testBucket, "", false, false, 2)
+	if err != nil || report.Total() != 0 {
+		t.Errorf("expected the indexes to be fixed, got %+v: %v", report, err)
+	}
+	if index := string(fake.Object(testBucket, "2016/2016-05-13/photos.json")); strings.Contains(index, "IMG_0002.jpg") {
+		t.Errorf("expected the deleted photo to be dropped, got %s", index)
+	}
+	if years := string(fake.Object(testBucket, "years.json")); strings.Contains(years, "2017") {
+		t.Errorf("expected 2017 to be dropped, got %s", years)
+	}
+}